@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ACK LOGIC
+// With -ack, consumers acknowledge each widget they handle successfully by sending its id back on
+// an ack channel, and producers record each widget they send. Once the run is over, any widget
+// that was sent but never acknowledged -- because its handler failed, it expired, or it was
+// abandoned by the drain timeout -- is reported rather than lost silently. A duplicate suppressed by
+// -dedup never reaches a consumer to be acknowledged, so it's left out instead.
+
+// ackTracker records the widgets sent and the acks received. A single goroutine, started by
+// calling drain, empties the ack channel as acks arrive, so consumers never block on it for long.
+type ackTracker struct {
+	acks  chan string
+	done  chan struct{} // closed once every ack has been drained
+	mutex sync.Mutex
+	sent  map[string]int // how many widgets with each id were sent and not yet acknowledged
+}
+
+func newAckTracker(buffer int) *ackTracker {
+	return &ackTracker{acks: make(chan string, buffer), done: make(chan struct{}), sent: make(map[string]int)}
+}
+
+func (t *ackTracker) drain() {
+	defer close(t.done)
+	for id := range t.acks {
+		t.forget(id)
+	}
+}
+
+// record notes that a widget was sent to the consumers. It must be called before the widget is
+// sent, so its ack can't arrive first.
+func (t *ackTracker) record(id string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sent[id]++
+}
+
+// forget undoes record for a widget that couldn't be sent after all, or won't be acknowledged
+// because it was suppressed as a duplicate.
+func (t *ackTracker) forget(id string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.sent[id]--; t.sent[id] <= 0 {
+		delete(t.sent, id)
+	}
+}
+
+// unacked closes the ack channel and returns the ids of every widget sent but not acknowledged,
+// in order. It must only be called after all consumers have returned.
+func (t *ackTracker) unacked() []string {
+	close(t.acks)
+	<-t.done
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ids := make([]string, 0, len(t.sent))
+	for id := range t.sent {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, errA := strconv.Atoi(ids[i])
+		b, errB := strconv.Atoi(ids[j])
+		if errA != nil || errB != nil {
+			return ids[i] < ids[j]
+		}
+		return a < b
+	})
+	return ids
+}
+
+// reportUnacked lists the widgets that were sent but never acknowledged, returning how many there were.
+func reportUnacked(out io.Writer, ids []string) int {
+	if len(ids) > 0 {
+		fmt.Fprintf(out, "%d widgets were sent but never acknowledged: %v\n", len(ids), ids)
+	}
+	return len(ids)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAcks(t *testing.T) {
+	cfg, err := parseConfig([]string{"-ack", "-n", "500", "-p", "3", "-c", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = io.Discard
+	if result, err := RunPipeline(cfg, nil); err != nil || result.Unacked != 0 {
+		t.Errorf("%d widgets unacknowledged after a clean run: %v", result.Unacked, err)
+	}
+
+	// Widgets whose handler fails are never acknowledged
+	cfg.handler = &countingHandler{failOn: "42", err: errors.New("database unavailable")}
+	if result, err := RunPipeline(cfg, nil); err != nil || result.Unacked != 1 {
+		t.Errorf("%d widgets unacknowledged, expected only the failed one: %v", result.Unacked, err)
+	}
+
+	// Duplicates suppressed by -dedup aren't waiting on an ack, but a failed original still is. The
+	// delay has each widget acknowledged before the next is sent.
+	path := filepath.Join(t.TempDir(), "widgets.txt")
+	listed := "1,Producer_1,false\n2,Producer_1,false\n1,Producer_2,false\n3,Producer_2,false\n2,Producer_1,false\n1,Producer_1,false\n"
+	if err := os.WriteFile(path, []byte(listed), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = parseConfig([]string{"-ack", "-dedup", "-from", path, "-c", "2", "-producerdelays", "10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = io.Discard
+	if result, err := RunPipeline(cfg, nil); err != nil || result.Suppressed != 3 || result.Unacked != 0 {
+		t.Errorf("%d widgets unacknowledged after suppressing %d duplicates: %v", result.Unacked, result.Suppressed, err)
+	}
+	cfg.handler = &countingHandler{failOn: "2", err: errors.New("database unavailable")}
+	if result, err := RunPipeline(cfg, nil); err != nil || result.Suppressed != 3 || result.Unacked != 1 {
+		t.Errorf("%d widgets unacknowledged after suppressing %d duplicates, expected only the failed one: %v", result.Unacked, result.Suppressed, err)
+	}
+
+	if _, err := parseConfig([]string{"-ack", "-fanout", "2"}); err == nil {
+		t.Errorf("-ack with -fanout not rejected")
+	}
+}
+
+func TestAckTracker(t *testing.T) {
+	tracker := newAckTracker(0)
+	go tracker.drain()
+	for _, id := range []string{"10", "9", "2", "1", "x"} {
+		tracker.record(id)
+	}
+	tracker.forget("x")
+	tracker.acks <- "9"
+	// A widget sent twice is waited on until both are acknowledged
+	tracker.record("7")
+	tracker.record("7")
+	tracker.acks <- "7"
+	unacked := tracker.unacked()
+	if len(unacked) != 4 || unacked[0] != "1" || unacked[1] != "2" || unacked[2] != "7" || unacked[3] != "10" {
+		t.Errorf("Unacknowledged widgets were %v, expected [1 2 7 10]", unacked)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ADMIN LOGIC
+// The admin API lets production be paused and resumed while the pipeline runs:
+//
+//	POST /pause   - producers stop making widgets until resumed
+//	POST /resume  - producers carry on
+//	GET  /status  - the number of widgets produced so far and whether production is paused, and
+//	                with -window, how many of the most recent widgets consumed were broken
+//
+// Paused producers still notice a stop signal, so a broken widget found while paused (or an
+// interrupt) shuts the pipeline down as usual.
+
+// pausePollInterval is how often a paused producer checks whether it may resume or should stop.
+const pausePollInterval = 10 * time.Millisecond
+
+// adminStatus is the body of a /status response.
+type adminStatus struct {
+	RunID    string        `json:"run_id,omitempty"`
+	Produced int           `json:"produced"`
+	Paused   bool          `json:"paused"`
+	Stopping bool          `json:"stopping"`
+	Window   *windowStatus `json:"window,omitempty"`
+}
+
+// newAdminHandler returns the admin API for the given producer group. window is nil unless the
+// consumers track recent broken widgets. runID, if not empty, is given in every /status.
+func newAdminHandler(g *producerGroup, window *brokenWindow, runID string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		g.paused.Store(true)
+	})
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		g.paused.Store(false)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		status := adminStatus{RunID: runID,
+			Produced: g.produced(),
+			Paused:   g.paused.Load(),
+			Stopping: stopRequested(g.producersShouldStop, g.producersShouldStopMutex)}
+		if window != nil {
+			s := window.status()
+			status.Window = &s
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+	return mux
+}
+
+// startAdmin serves the admin API for g on addr. Binding happens before returning, so a bad
+// address fails before any widgets are produced. The returned function shuts the server down.
+func startAdmin(addr string, g *producerGroup, window *brokenWindow, runID string) (stop func(), err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: newAdminHandler(g, window, runID)}
+	go srv.Serve(ln)
+	return func() { srv.Close() }, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAdmin(t *testing.T) {
+	widgetChan := make(chan widget)
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	producerGroup := newProducerGroup(config{numProducers: 1, numWidgets: 10, kthBadWidget: -1}, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+
+	server := httptest.NewServer(newAdminHandler(&producerGroup, nil, ""))
+	defer server.Close()
+
+	post := func(path string) {
+		resp, err := http.Post(server.URL+path, "", nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("POST %s failed: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+	status := func() adminStatus {
+		resp, err := http.Get(server.URL + "/status")
+		if err != nil {
+			t.Fatalf("GET /status failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var s adminStatus
+		if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+			t.Fatalf("Malformed status: %v", err)
+		}
+		return s
+	}
+
+	producerGroup.getWidget(1)
+	if s := status(); s.Produced != 1 || s.Paused {
+		t.Errorf("Unexpected status before pausing: %+v", s)
+	}
+
+	// While paused, getWidget blocks until production is resumed
+	post("/pause")
+	if !status().Paused {
+		t.Errorf("Status doesn't show production paused")
+	}
+	got := make(chan error)
+	go func() {
+		_, err := producerGroup.getWidget(1)
+		got <- err
+	}()
+	select {
+	case <-got:
+		t.Fatalf("Widget produced while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	post("/resume")
+	select {
+	case err := <-got:
+		if err != nil {
+			t.Errorf("Widget not produced after resuming: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Producer still blocked after resuming")
+	}
+
+	// A stop signal still gets through to a paused producer
+	post("/pause")
+	go func() {
+		_, err := producerGroup.getWidget(1)
+		got <- err
+	}()
+	requestStop(&shouldStop, &shouldStopMutex)
+	select {
+	case err := <-got:
+		if err == nil {
+			t.Errorf("Paused producer made a widget after being signaled to stop")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Paused producer didn't notice the stop signal")
+	}
+	if s := status(); s.Produced != 2 || !s.Stopping {
+		t.Errorf("Unexpected status after stopping: %+v", s)
+	}
+
+	// State changes must be POSTs
+	resp, err := http.Get(server.URL + "/pause")
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /pause not rejected")
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import "sync/atomic"
+
+// BROKEN POLICY LOGIC
+// BrokenPolicy decides what becomes of each broken widget a consumer receives: whether it stops
+// production, as it does by default, or is set aside while production carries on. Consumers
+// consult it once per broken widget, before the widget is handled, and stop production or record
+// the widget as dead-lettered accordingly, whatever the handler is. A policy is shared by a consumer group's consumers, and with
+// -fanout by every group if it's set in the config, so it must be safe for concurrent use.
+//
+// Production stops once the policy has chosen ActionStop for any widget. Every broken widget from
+// then on also stops production, whatever the policy says, since it already has.
+type BrokenPolicy interface {
+	OnBroken(w widget) BrokenAction
+}
+
+// BrokenAction is what a BrokenPolicy chooses to do with a broken widget.
+type BrokenAction int
+
+const (
+	ActionStop       BrokenAction = iota // stop production, recorded as broken
+	ActionDeadLetter                     // set the widget aside and carry on, recorded as dead-lettered
+)
+
+// StopOnBroken stops production on the first broken widget. It's the default policy.
+type StopOnBroken struct{}
+
+func (StopOnBroken) OnBroken(w widget) BrokenAction { return ActionStop }
+
+// DeadLetterBroken sets every broken widget aside, so production is never stopped by one.
+type DeadLetterBroken struct{}
+
+func (DeadLetterBroken) OnBroken(w widget) BrokenAction { return ActionDeadLetter }
+
+// CircuitBreaker dead-letters up to Threshold broken widgets, then trips, stopping production on
+// the next one. With a threshold of 0 it's StopOnBroken. -breaker-threshold gives each consumer
+// group a breaker of its own.
+type CircuitBreaker struct {
+	Threshold int
+	seen      atomic.Int64 // broken widgets counted against Threshold
+}
+
+func (b *CircuitBreaker) OnBroken(w widget) BrokenAction {
+	if b.seen.Add(1) <= int64(b.Threshold) {
+		return ActionDeadLetter
+	}
+	return ActionStop
+}
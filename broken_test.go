@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// typePolicy dead-letters broken widgets of one type and stops production for any other.
+type typePolicy struct {
+	tolerated string
+}
+
+func (p typePolicy) OnBroken(w widget) BrokenAction {
+	if w.widgetType == p.tolerated {
+		return ActionDeadLetter
+	}
+	return ActionStop
+}
+
+func TestCircuitBreakerPolicy(t *testing.T) {
+	b := &CircuitBreaker{Threshold: 2}
+	for i, want := range []BrokenAction{ActionDeadLetter, ActionDeadLetter, ActionStop, ActionStop} {
+		if action := b.OnBroken(widget{broken: true}); action != want {
+			t.Errorf("Broken widget %d got action %d, expected %d", i+1, action, want)
+		}
+	}
+	if (&CircuitBreaker{}).OnBroken(widget{broken: true}) != ActionStop {
+		t.Error("Breaker with no threshold didn't stop on the first broken widget")
+	}
+}
+
+func TestBrokenPolicy(t *testing.T) {
+	// Dead-lettering every broken widget never stops production
+	cfg, err := parseConfig([]string{"-n", "50", "-c", "2", "-every", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out, cfg.brokenPolicy = io.Discard, DeadLetterBroken{}
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Consumed != 50 || result.Broken != 10 || result.DeadLettered != 10 {
+		t.Errorf("Consumed %d widgets, %d broken and %d dead-lettered, expected 50, 10, and 10: %v", result.Consumed, result.Broken, result.DeadLettered, err)
+	}
+
+	// A custom policy decides per widget, and the first widget it stops for is reported
+	cfg, err = parseConfig([]string{"-n", "50", "-types", "gizmo=1,gadget=0", "-every", "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out, cfg.brokenPolicy = io.Discard, typePolicy{tolerated: "gizmo"}
+	result, err = RunPipeline(cfg, nil)
+	// Widgets alternate gizmo, gadget, so every gizmo is broken and widget 4 is the first broken gadget
+	if !errors.Is(err, ErrProductionStopped) || !strings.Contains(err.Error(), "widget 4") {
+		t.Errorf("Run returned %v, expected production stopped by widget 4", err)
+	}
+	if result.DeadLettered < 2 {
+		t.Errorf("Dead-lettered %d gizmos, expected at least widgets 1 and 3", result.DeadLettered)
+	}
+
+	// The policy applies to RunConsumers too
+	ch := make(chan widget, 20)
+	for i := 1; i <= 20; i++ {
+		ch <- widget{id: strconv.Itoa(i), time: time.Now(), broken: i%2 == 0}
+	}
+	close(ch)
+	var out lockedBuilder
+	consumers := RunConsumers(ch, ConsumerConfig{Consumers: 2, Out: &out, BrokenPolicy: DeadLetterBroken{}})
+	if consumers.Err != nil || consumers.Consumed != 20 || consumers.Broken != 10 || strings.Contains(out.b.String(), "stopping production") {
+		t.Errorf("RunConsumers dead-lettering broken widgets returned %+v, printing %q", consumers, out.b.String())
+	}
+}
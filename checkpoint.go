@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CHECKPOINT LOGIC
+// checkpoint records the id of every widget consumed, so that a run which crashes or is stopped
+// part way can be resumed without consuming any widget twice or missing any. The file holds one id
+// per line and is only ever appended to. Each id is written through to the file as soon as its
+// widget has been handled, so a killed process loses nothing it finished; a widget being handled at
+// the moment of the kill is the only one that can be delivered again.
+type checkpoint struct {
+	mutex    sync.Mutex // exclusion on writes from concurrent consumers
+	file     *os.File
+	resumed  map[int]bool // ids consumed by earlier runs, read-only once opened
+	writeErr error        // first error writing to the file, after which recording stops
+}
+
+// openCheckpoint loads the ids already recorded at path, if it exists, and opens it for appending.
+func openCheckpoint(path string) (*checkpoint, error) {
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	resumed := make(map[int]bool)
+	for _, line := range strings.Split(string(existing), "\n") {
+		// A line cut short by a crash is ignored; its widget will simply be made again
+		if id, err := strconv.Atoi(line); err == nil {
+			resumed[id] = true
+		}
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// End any line cut short, so the next id isn't appended to it
+	if len(existing) > 0 && existing[len(existing)-1] != '\n' {
+		if _, err := file.WriteString("\n"); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return &checkpoint{file: file, resumed: resumed}, nil
+}
+
+// done reports whether an earlier run consumed the widget with the given id.
+func (c *checkpoint) done(id int) bool {
+	return c.resumed[id]
+}
+
+// doneBetween counts the ids in [first, first+n) consumed by earlier runs.
+func (c *checkpoint) doneBetween(first, n int) int {
+	count := 0
+	for id := range c.resumed {
+		if id >= first && id < first+n {
+			count++
+		}
+	}
+	return count
+}
+
+// record notes that the widget with the given id has been consumed.
+func (c *checkpoint) record(id string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.writeErr != nil {
+		return c.writeErr
+	}
+	if _, err := fmt.Fprintln(c.file, id); err != nil {
+		c.writeErr = err
+	}
+	return c.writeErr
+}
+
+func (c *checkpoint) Close() error {
+	if err := c.file.Sync(); err != nil {
+		c.file.Close()
+		return err
+	}
+	return c.file.Close()
+}
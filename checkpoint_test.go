@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// crashingHandler counts the widgets it handles successfully. Once it has handled crashAfter
+// widgets (if non-zero) it crashes, failing fatally on every widget from then on.
+type crashingHandler struct {
+	mutex      sync.Mutex
+	counts     map[string]int
+	handled    int
+	crashAfter int
+}
+
+func (h *crashingHandler) Handle(w widget) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.crashAfter > 0 && h.handled >= h.crashAfter {
+		return &FatalError{Err: errors.New("simulated crash")}
+	}
+	h.handled++
+	h.counts[w.id]++
+	return nil
+}
+
+func TestCheckpointResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	handler := &crashingHandler{counts: make(map[string]int), crashAfter: 40}
+
+	cfg := defaultConfig()
+	cfg.numWidgets, cfg.numProducers, cfg.numConsumers = 100, 3, 2
+	cfg.bufferSize = 0
+	cfg.checkpoint = path
+	cfg.handler = handler
+	cfg.out = io.Discard
+
+	// The first run crashes part way through
+	if _, err := RunPipeline(cfg, nil); err == nil {
+		t.Fatalf("Simulated crash not reported")
+	}
+	firstRun := len(handler.counts)
+	if firstRun != 40 {
+		t.Fatalf("Crash let %d widgets through, expected 40", firstRun)
+	}
+
+	// The resumed run makes up exactly what's missing
+	handler.crashAfter = 0
+	result, err := RunPipeline(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Produced != 100-firstRun {
+		t.Errorf("Resumed run produced %d widgets, expected %d", result.Produced, 100-firstRun)
+	}
+	for i := 1; i <= 100; i++ {
+		if n := handler.counts[strconv.Itoa(i)]; n != 1 {
+			t.Errorf("Widget %d consumed %d times across the restart", i, n)
+		}
+	}
+	if len(handler.counts) != 100 {
+		t.Errorf("Consumed %d distinct widgets, expected 100", len(handler.counts))
+	}
+
+	// Nothing is left to do once everything has been consumed
+	result, err = RunPipeline(cfg, nil)
+	if err != nil || result.Produced != 0 {
+		t.Errorf("Completed run produced %d more widgets: %v", result.Produced, err)
+	}
+}
+
+func TestOpenCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+
+	// A line cut short by a crash is ignored
+	if err := os.WriteFile(path, []byte("1\n3\n2\n1"+"x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := openCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cp.done(1) || !cp.done(2) || !cp.done(3) || cp.done(4) || cp.doneBetween(2, 5) != 2 {
+		t.Errorf("Checkpoint loaded incorrectly: %v", cp.resumed)
+	}
+	cp.record("4")
+	cp.Close()
+
+	cp, err = openCheckpoint(path)
+	if err != nil || !cp.done(4) {
+		t.Errorf("Recorded id not persisted: %v", err)
+	}
+	cp.Close()
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// widgetRecord is the serialized form of a widget, since widget's own fields are unexported.
+type widgetRecord struct {
+	ID         string    `json:"id"`
+	Source     string    `json:"source"`
+	ProducerID int       `json:"producer_id"`
+	Type       string    `json:"type,omitempty"`
+	Time       time.Time `json:"time"`
+	Broken     bool      `json:"broken"`
+	Payload    []byte    `json:"payload,omitempty"`
+	// Carried so a consumer in another process continues the producer's trace
+	TraceParent string            `json:"traceparent,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+func newWidgetRecord(w widget) widgetRecord {
+	return widgetRecord{ID: w.id, Source: w.source, ProducerID: w.producerID, Type: w.widgetType, Time: w.time, Broken: w.broken, Payload: w.payload,
+		TraceParent: w.traceParent, Metadata: w.metadata}
+}
+
+func (r widgetRecord) widget() widget {
+	return widget{id: r.ID, source: r.Source, producerID: r.ProducerID, widgetType: r.Type, time: r.Time, broken: r.Broken, payload: r.Payload,
+		traceParent: r.TraceParent, metadata: r.Metadata}
+}
+
+// widgetEncoder writes widgets to a stream.
+type widgetEncoder interface {
+	Encode(w widget) error
+}
+
+// widgetDecoder reads widgets from a stream. Decode returns io.EOF once the stream is exhausted.
+type widgetDecoder interface {
+	Decode() (widget, error)
+}
+
+// Supported codecs for widget streams:
+//
+//	ndjson - one JSON object per line
+//	binary - each JSON object prefixed by its length as a big-endian uint32
+const (
+	codecNDJSON = "ndjson"
+	codecBinary = "binary"
+)
+
+// newWidgetEncoder returns an encoder for the named codec writing to out.
+func newWidgetEncoder(codec string, out io.Writer) (widgetEncoder, error) {
+	switch codec {
+	case codecNDJSON:
+		return ndjsonEncoder{json.NewEncoder(out)}, nil
+	case codecBinary:
+		return binaryEncoder{out}, nil
+	}
+	return nil, errors.New("unknown codec " + codec)
+}
+
+// newWidgetDecoder returns a decoder for the named codec reading from in.
+func newWidgetDecoder(codec string, in io.Reader) (widgetDecoder, error) {
+	switch codec {
+	case codecNDJSON:
+		return ndjsonDecoder{json.NewDecoder(in)}, nil
+	case codecBinary:
+		return binaryDecoder{bufio.NewReader(in)}, nil
+	}
+	return nil, errors.New("unknown codec " + codec)
+}
+
+type ndjsonEncoder struct {
+	enc *json.Encoder
+}
+
+func (e ndjsonEncoder) Encode(w widget) error {
+	// json.Encoder terminates every value with a newline
+	return e.enc.Encode(newWidgetRecord(w))
+}
+
+type ndjsonDecoder struct {
+	dec *json.Decoder
+}
+
+func (d ndjsonDecoder) Decode() (widget, error) {
+	var r widgetRecord
+	if err := d.dec.Decode(&r); err != nil {
+		return widget{}, err
+	}
+	return r.widget(), nil
+}
+
+type binaryEncoder struct {
+	out io.Writer
+}
+
+func (e binaryEncoder) Encode(w widget) error {
+	body, err := json.Marshal(newWidgetRecord(w))
+	if err != nil {
+		return err
+	}
+	// Write the prefix and body in one call so a frame is never split across writers
+	frame := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	copy(frame[4:], body)
+	_, err = e.out.Write(frame)
+	return err
+}
+
+type binaryDecoder struct {
+	in *bufio.Reader
+}
+
+func (d binaryDecoder) Decode() (widget, error) {
+	var size uint32
+	if err := binary.Read(d.in, binary.BigEndian, &size); err != nil {
+		return widget{}, err
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(d.in, body); err != nil {
+		return widget{}, err
+	}
+	var r widgetRecord
+	if err := json.Unmarshal(body, &r); err != nil {
+		return widget{}, err
+	}
+	return r.widget(), nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// COLOR LOGIC
+// -color highlights broken widgets in red when watching a run live. By default color is only used
+// when consumers print to a terminal, so output redirected to a file or a pipe stays free of
+// escape codes. NO_COLOR (https://no-color.org) and TERM=dumb turn it off too, unless it's forced.
+
+// Color modes, chosen with -color.
+const (
+	colorAuto   = "auto"   // color only when printing to a terminal
+	colorAlways = "always" // color even when redirected
+	colorNever  = "never"  // never color
+)
+
+// ANSI escape codes.
+const (
+	ansiRed   = "\x1b[31m"
+	ansiReset = "\x1b[0m"
+)
+
+// parseColorMode checks a -color mode.
+func parseColorMode(mode string) error {
+	if mode != colorAuto && mode != colorAlways && mode != colorNever {
+		return errors.New("unknown color mode " + mode + ", expected auto, always, or never")
+	}
+	return nil
+}
+
+// useColor reports whether output printed to out should be colored in the given mode.
+func useColor(mode string, out io.Writer) bool {
+	switch mode {
+	case colorAlways:
+		return true
+	case colorAuto:
+		f, ok := out.(*os.File)
+		return ok && isTerminal(f) && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+	}
+	return false
+}
+
+// colorize wraps text in the escape codes for color, leaving a trailing newline outside them so a
+// terminal never carries the color over to the next line.
+func colorize(text, color string) string {
+	n := len(text)
+	if n > 0 && text[n-1] == '\n' {
+		return color + text[:n-1] + ansiReset + "\n"
+	}
+	return color + text + ansiReset
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "os"
+
+// isTerminal reports whether f is a character device, which a terminal is. That also takes in
+// devices like /dev/null, but without a portable way to ask for terminal attributes it's the best
+// guess the standard library allows.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
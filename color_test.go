@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUseColor(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+
+	for _, out := range []io.Writer{&bytes.Buffer{}, file, devNull} {
+		if useColor(colorAuto, out) {
+			t.Errorf("Color used in auto mode printing to %T that isn't a terminal", out)
+		}
+		if !useColor(colorAlways, out) || useColor(colorNever, out) {
+			t.Errorf("Color mode not followed printing to %T", out)
+		}
+	}
+	if err := parseColorMode("sometimes"); err == nil {
+		t.Errorf("Unknown color mode accepted")
+	}
+}
+
+func TestColorizedOutput(t *testing.T) {
+	shouldStop := false
+	cfg := config{numConsumers: 1}
+	for _, color := range []bool{false, true} {
+		g := newConsumerGroup(cfg, nil, &sync.WaitGroup{}, &shouldStop, &sync.Mutex{}, noopSink{}, nil)
+		g.color = color
+		consumed := g.getConsumeMessage(widget{id: "1", source: "Producer_1"}, 1)
+		broken := g.getConsumeMessage(widget{id: "2", source: "Producer_1", broken: true}, 1)
+
+		if strings.Contains(consumed, "\x1b[") {
+			t.Errorf("Consumed widget colored: %q", consumed)
+		}
+		if colored := strings.HasPrefix(broken, ansiRed) && strings.HasSuffix(broken, ansiReset+"\n"); colored != color {
+			t.Errorf("Broken widget printed as %q with color %t", broken, color)
+		}
+	}
+
+	cfg, err := parseConfig([]string{"-color", "always", "-format", "csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := newConsumerGroup(cfg, nil, &sync.WaitGroup{}, &shouldStop, &sync.Mutex{}, noopSink{}, nil); g.color {
+		t.Errorf("CSV output colored")
+	}
+}
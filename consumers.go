@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// CONSUMER API
+// RunConsumers is the consumer half of the pipeline on its own, for a caller that makes widgets
+// some other way and owns the channel they arrive on. It is the counterpart of WidgetSource,
+// which replaces the producers' half instead.
+
+// ConsumerConfig configures RunConsumers.
+type ConsumerConfig struct {
+	Consumers int           // consumers receiving from the channel, at least 1
+	Handler   WidgetHandler // what consumers do with each widget, nil to print it to Out
+	Out       io.Writer     // where the default handler prints, os.Stdout if nil; written to concurrently
+	// BrokenPolicy decides whether each broken widget stops production, StopOnBroken if nil
+	BrokenPolicy BrokenPolicy
+	// Stop is called once if production should stop, because a consumer received a broken widget
+	// the BrokenPolicy didn't set aside, whatever the Handler, or Handler returned a *FatalError. The channel's owner should stop sending and close
+	// it; consumers carry on draining it until then. Nil if the owner doesn't need telling.
+	Stop func()
+}
+
+// ConsumerResult summarizes a finished RunConsumers.
+type ConsumerResult struct {
+	Consumed int   // widgets handled
+	Broken   int   // broken widgets handled
+	Err      error // wraps ErrProductionStopped if a broken widget stopped production, or is a handler's *FatalError
+}
+
+// RunConsumers runs cfg.Consumers consumers on ch, returning once ch is closed and drained.
+func RunConsumers(ch <-chan widget, cfg ConsumerConfig) ConsumerResult {
+	if cfg.Consumers < 1 {
+		return ConsumerResult{Err: errors.New("there must be at least one consumer")}
+	}
+	c := defaultConfig()
+	c.numConsumers, c.handler, c.out, c.brokenPolicy = cfg.Consumers, cfg.Handler, cfg.Out, cfg.BrokenPolicy
+
+	// Consumers take a channel they can also send on, so hand widgets over through one
+	in := make(chan widget)
+	go func() {
+		for w := range ch {
+			in <- w
+		}
+		close(in)
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(c.numConsumers)
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	g := newConsumerGroup(c, in, &wg, &shouldStop, &shouldStopMutex, noopSink{}, nil)
+	if cfg.Stop != nil {
+		g.onStop = sync.OnceFunc(cfg.Stop)
+	}
+	g.spawnConsumers()
+	wg.Wait()
+
+	result := ConsumerResult{Consumed: int(g.consumed.Load()), Broken: int(g.brokenCount.Load())}
+	result.Err = errors.Join(g.fatalError(), g.stoppedError())
+	return result
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// lockedBuilder is a strings.Builder that consumers can print to concurrently, as they can to stdout.
+type lockedBuilder struct {
+	mutex sync.Mutex
+	b     strings.Builder
+}
+
+func (l *lockedBuilder) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.b.Write(p)
+}
+
+func TestRunConsumers(t *testing.T) {
+	ch := make(chan widget, 100)
+	for i := 1; i <= 100; i++ {
+		ch <- widget{id: strconv.Itoa(i), time: time.Now()}
+	}
+	close(ch)
+	handler := &tallyingHandler{counts: make(map[string]int)}
+	result := RunConsumers(ch, ConsumerConfig{Consumers: 4, Handler: handler})
+	if result.Err != nil || result.Consumed != 100 || result.Broken != 0 {
+		t.Fatalf("Unexpected result: %+v", result)
+	}
+	for i := 1; i <= 100; i++ {
+		if n := handler.counts[strconv.Itoa(i)]; n != 1 {
+			t.Errorf("Widget %d handled %d times", i, n)
+		}
+	}
+}
+
+func TestRunConsumersBroken(t *testing.T) {
+	// The owner keeps sending until told to stop, then closes the channel
+	ch := make(chan widget)
+	stop := make(chan struct{})
+	var stops atomic.Int64
+	go func() {
+		defer close(ch)
+		for i := 1; ; i++ {
+			select {
+			case ch <- widget{id: strconv.Itoa(i), time: time.Now(), broken: i%5 == 0}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var out lockedBuilder
+	result := RunConsumers(ch, ConsumerConfig{Consumers: 2, Out: &out, Stop: func() {
+		stops.Add(1)
+		close(stop)
+	}})
+	if !errors.Is(result.Err, ErrProductionStopped) || !strings.Contains(result.Err.Error(), "widget 5") {
+		t.Errorf("Broken widget stop not reported: %v", result.Err)
+	}
+	// Broken widgets sent before the owner noticed are still drained, but Stop is called only once
+	if stops.Load() != 1 || result.Broken < 1 || result.Consumed < 5 {
+		t.Errorf("Stop called %d times, result %+v", stops.Load(), result)
+	}
+	if !strings.Contains(out.b.String(), "found a broken widget [id=5 ") {
+		t.Errorf("Broken widget not printed: %q", out.b.String())
+	}
+
+	if result := RunConsumers(ch, ConsumerConfig{}); result.Err == nil {
+		t.Error("RunConsumers without consumers succeeded")
+	}
+}
+
+func TestRunConsumersBrokenCustomHandler(t *testing.T) {
+	// A custom handler doesn't have to notice broken widgets for them to stop production
+	ch := make(chan widget, 10)
+	for i := 1; i <= 10; i++ {
+		ch <- widget{id: strconv.Itoa(i), time: time.Now(), broken: i == 3}
+	}
+	close(ch)
+	var stops atomic.Int64
+	handler := &tallyingHandler{counts: make(map[string]int)}
+	result := RunConsumers(ch, ConsumerConfig{Consumers: 2, Handler: handler, Stop: func() { stops.Add(1) }})
+	if !errors.Is(result.Err, ErrProductionStopped) || !strings.Contains(result.Err.Error(), "widget 3") {
+		t.Errorf("Broken widget stop not reported: %v", result.Err)
+	}
+	if stops.Load() != 1 || result.Broken != 1 || result.Consumed != 10 || handler.counts["3"] != 1 {
+		t.Errorf("Stop called %d times, result %+v", stops.Load(), result)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"sync/atomic"
+)
+
+// DEDUP LOGIC
+// Generated ids never repeat, but ids from -replay, -from, stdin, or a custom IDAllocator can. With
+// -dedup a stage between the producers and the consumers passes on only the first widget with
+// each id, so consumers see every id at most once, and counts the rest as suppressed. Numeric ids
+// are recorded in a bitset, one bit per id up to the highest seen, so memory grows with the range
+// of ids rather than the number of widgets; other ids, and numeric ones too large for the bitset,
+// fall back to a map.
+
+// dedupBitsetLimit bounds the ids recorded in the bitset, so one huge id can't allocate a huge
+// bitset. 1<<27 ids take 16MB.
+const dedupBitsetLimit = 1 << 27
+
+// idSet is a set of widget ids. It's only used by the dedup stage's goroutine, so has no lock.
+type idSet struct {
+	bits  []uint64
+	other map[string]struct{}
+}
+
+func newIDSet() *idSet {
+	return &idSet{other: make(map[string]struct{})}
+}
+
+// add adds id to the set, reporting whether it wasn't there already.
+func (s *idSet) add(id string) bool {
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 0 || n >= dedupBitsetLimit {
+		if _, seen := s.other[id]; seen {
+			return false
+		}
+		s.other[id] = struct{}{}
+		return true
+	}
+	word, bit := n/64, uint64(1)<<(n%64)
+	if word >= len(s.bits) {
+		// Grow by doubling, like append, so a rising run of ids is amortized
+		s.bits = append(s.bits, make([]uint64, max(word+1, 2*len(s.bits))-len(s.bits))...)
+	}
+	if s.bits[word]&bit != 0 {
+		return false
+	}
+	s.bits[word] |= bit
+	return true
+}
+
+// deduper is the dedup stage.
+type deduper struct {
+	seen       *idSet
+	suppressed atomic.Int64
+	done       chan struct{} // closed once run returns
+}
+
+func newDeduper() *deduper {
+	return &deduper{seen: newIDSet(), done: make(chan struct{})}
+}
+
+// run passes each widget from in to out the first time its id is seen, handing the rest to
+// discard, until in is closed or ctx is cancelled. Poison pills are always passed on. It doesn't
+// close out, so the pipeline can end the consumers' stream however it's configured to once run is
+// done.
+func (d *deduper) run(ctx context.Context, in <-chan widget, out chan<- widget, discard func(widget)) {
+	defer close(d.done)
+	for w := range in {
+		if w.pill > 0 || d.seen.add(w.id) {
+			select {
+			case out <- w:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		d.suppressed.Add(1)
+		discard(w)
+	}
+}
+
+// reportSuppressed says how many duplicate widgets the dedup stage suppressed, returning how many.
+func reportSuppressed(out io.Writer, d *deduper) int {
+	if d == nil {
+		return 0
+	}
+	suppressed := int(d.suppressed.Load())
+	if suppressed > 0 {
+		fmt.Fprintf(out, "Suppressed %d widgets with a duplicate id (-dedup)\n", suppressed)
+	}
+	return suppressed
+}
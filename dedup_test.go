@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestIDSet(t *testing.T) {
+	s := newIDSet()
+	for _, id := range []string{"0", "63", "64", "1000", "-5", "a7", strconv.Itoa(dedupBitsetLimit)} {
+		if !s.add(id) {
+			t.Errorf("%s reported as already added", id)
+		}
+		if s.add(id) {
+			t.Errorf("%s added twice", id)
+		}
+	}
+	if !s.add("1") || !s.add("999") {
+		t.Error("Neighbouring ids reported as already added")
+	}
+	// Only the out-of-range and non-numeric ids need the map
+	if len(s.other) != 3 || len(s.bits) < 1000/64+1 {
+		t.Errorf("Map has %d ids and bitset %d words, expected 3 and at least %d", len(s.other), len(s.bits), 1000/64+1)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "widgets.txt")
+	listed := "1,Producer_1,false\n2,Producer_1,false\n1,Producer_2,false\n3,Producer_2,false\n2,Producer_1,false\n1,Producer_1,false\n"
+	if err := os.WriteFile(path, []byte(listed), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseConfig([]string{"-from", path, "-p", "2", "-c", "2", "-dedup", "-maxinflight", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &tallyingHandler{counts: make(map[string]int)}
+	cfg.handler, cfg.out = handler, io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Produced != 6 || result.Consumed != 3 || result.Suppressed != 3 || result.Results[resultSkipped] != 3 {
+		t.Errorf("Produced %d, consumed %d, suppressed %d, skipped %d, expected 6, 3, 3, 3",
+			result.Produced, result.Consumed, result.Suppressed, result.Results[resultSkipped])
+	}
+	for _, id := range []string{"1", "2", "3"} {
+		if handler.counts[id] != 1 {
+			t.Errorf("Widget %s consumed %d times, expected once", id, handler.counts[id])
+		}
+	}
+
+	if _, err := parseConfig([]string{"-dedup", "-batchsize", "10"}); err == nil {
+		t.Error("-dedup accepted with -batchsize")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// DISPATCH LOGIC
+// By default every consumer takes widgets from the shared channel, so faster consumers get more.
+// With -weights, each consumer instead has its own channel and a dispatcher hands widgets out in
+// proportion to the consumers' weights, modeling consumers with different capacities.
+
+// parseWeights parses a list like "1,2,1". Weights must be positive.
+func parseWeights(list string) ([]int, error) {
+	var weights []int
+	for _, entry := range strings.Split(list, ",") {
+		weight, err := strconv.Atoi(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, errors.New("can't convert weight " + entry)
+		}
+		if weight < 1 {
+			return nil, errors.New("weights must be at least 1")
+		}
+		weights = append(weights, weight)
+	}
+	return weights, nil
+}
+
+// dispatch routes every widget from in to outs in proportion to weights, using smooth weighted
+// round robin so that each consumer's share is spread evenly rather than sent in bursts. Every
+// channel in outs is closed once in is closed or ctx is cancelled.
+func dispatch(ctx context.Context, in <-chan widget, outs []chan widget, weights []int) {
+	defer func() {
+		for _, out := range outs {
+			close(out)
+		}
+	}()
+	total := 0
+	for _, weight := range weights {
+		total += weight
+	}
+	current := make([]int, len(weights))
+	for w := range in {
+		next := 0
+		for i, weight := range weights {
+			current[i] += weight
+			if current[i] > current[next] {
+				next = i
+			}
+		}
+		current[next] -= total
+		select {
+		case outs[next] <- w:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
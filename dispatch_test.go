@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+func TestDispatch(t *testing.T) {
+	in := make(chan widget)
+	outs := []chan widget{make(chan widget, 8), make(chan widget, 8), make(chan widget, 8)}
+	go func() {
+		for i := 0; i < 8; i++ {
+			in <- widget{}
+		}
+		close(in)
+	}()
+	dispatch(t.Context(), in, outs, []int{1, 2, 1})
+	for i, expected := range []int{2, 4, 2} {
+		if n := len(outs[i]); n != expected {
+			t.Errorf("Consumer %d got %d widgets, expected %d", i+1, n, expected)
+		}
+		if _, ok := <-outs[i]; !ok && expected > 0 {
+			t.Errorf("Consumer %d channel closed early", i+1)
+		}
+	}
+	for i := range outs {
+		for range outs[i] {
+		}
+	}
+}
+
+func TestWeights(t *testing.T) {
+	cfg, err := parseConfig([]string{"-c", "3", "-weights", "1,2,1", "-n", "400"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &countingHandler{}
+	cfg.handler = handler
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Consumed != 400 || handler.handled.Load() != 400 {
+		t.Fatalf("Consumed %d widgets, expected 400: %v", result.Consumed, err)
+	}
+
+	for _, args := range [][]string{
+		{"-c", "2", "-weights", "1,2,1"},
+		{"-c", "2", "-weights", "1,0"},
+		{"-c", "2", "-weights", "1,x"},
+		{"-c", "2", "-weights", "1,2", "-fanout", "2"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v not rejected", args)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"time"
+)
+
+// DRAIN LOGIC
+// The drain command empties a backed-up queue as fast as it can, for cleaning up after a split or
+// distributed run: it takes every widget from a Unix domain socket, a TCP -listen address, or a
+// file sink log given with -replay, and only counts them. It's a preset consumer configuration
+// rather than a pipeline of its own: consumers hand each widget to a handler that does nothing, a
+// consumer per CPU unless -c says otherwise, each prefetching what's waiting. Broken widgets are
+// dead-lettered and drained like any other, since nothing is produced that they could stop.
+
+// drainPrefetch is how many waiting widgets each consumer takes at a time, unless -prefetch is given.
+const drainPrefetch = 64
+
+// discardHandler handles a widget by doing nothing with it.
+type discardHandler struct{}
+
+func (discardHandler) Handle(w widget) error { return nil }
+
+// drainPreset applies the drain command's configuration to cfg, whose options set were given on
+// the command line. Where widgets are drained from decides the mode: a replay runs the pipeline,
+// and a socket runs only consumers.
+func drainPreset(cfg config, set map[string]bool) (config, error) {
+	fromSocket := cfg.unixSocket != "" || cfg.listen != ""
+	switch {
+	case fromSocket && cfg.replay != "":
+		return config{}, errors.New("drain takes widgets from one of -unix-socket, -listen, or -replay")
+	case fromSocket:
+		cfg.mode = "consume"
+	case cfg.replay != "":
+		cfg.mode = "run"
+	default:
+		return config{}, errors.New("drain needs -unix-socket, -listen, or -replay to drain widgets from")
+	}
+	if !set["c"] && !set["num-consumers"] {
+		cfg.numConsumers = runtime.NumCPU()
+	}
+	if !set["prefetch"] {
+		cfg.prefetch = drainPrefetch
+	}
+	cfg.handler = discardHandler{}
+	cfg.brokenPolicy = DeadLetterBroken{}
+	cfg.drain = true
+	return cfg, nil
+}
+
+// reportDrained reports how many widgets were drained, and how fast.
+func reportDrained(out io.Writer, drained int, elapsed time.Duration) {
+	fmt.Fprintf(out, "Drained %d widgets in %s (%.1f widgets/sec)\n", drained, elapsed.Round(time.Millisecond), float64(drained)/elapsed.Seconds())
+}
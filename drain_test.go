@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"testing"
+)
+
+func TestDrain(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "widgets.jsonl")
+
+	// Record a run whose broken widget stops production partway
+	cfg := defaultConfig()
+	cfg.numWidgets, cfg.kthBadWidget = 500, 300
+	cfg.sink = "file:" + log
+	cfg.out = io.Discard
+	recorded, _ := RunPipeline(cfg, nil)
+
+	// Draining it takes every widget recorded, the broken one included, without stopping
+	cfg, err := parseConfig([]string{"drain", "-replay", log, "-c", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.mode != "run" || cfg.numConsumers != 3 || cfg.prefetch != drainPrefetch {
+		t.Errorf("Drain preset gave mode %s, %d consumers, and a prefetch of %d", cfg.mode, cfg.numConsumers, cfg.prefetch)
+	}
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Consumed != recorded.Consumed {
+		t.Errorf("Drained %d widgets, expected %d: %v", result.Consumed, recorded.Consumed, err)
+	}
+
+	cfg, err = parseConfig([]string{"drain", "-unix-socket", filepath.Join(t.TempDir(), "widgets.sock")})
+	if err != nil || cfg.mode != "consume" {
+		t.Errorf("Draining a socket gave mode %s: %v", cfg.mode, err)
+	}
+	for _, args := range [][]string{{"drain"}, {"drain", "-replay", log, "-listen", ":0"}, {"drain", "-n", "5"}} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// EVENT LOGIC
+// A pipeline can publish lifecycle events to an observer, e.g. to drive a live visualization.
+// Events are sent without blocking: if the observer's channel is full the event is dropped rather
+// than holding up production, so observers should keep up or give the channel a generous buffer.
+// With no observer, nothing is published.
+
+// EventType identifies what happened.
+type EventType string
+
+const (
+	EventProduced        EventType = "produced"         // a producer made a widget
+	EventConsumed        EventType = "consumed"         // a consumer handled a widget
+	EventProducerStopped EventType = "producer_stopped" // a producer returned
+	EventBreakerTripped  EventType = "breaker_tripped"  // the circuit breaker tripped on a broken widget
+)
+
+// Event is a single lifecycle event. Widget is the widget involved, if any, and Producer is the
+// number of the producer that stopped for EventProducerStopped.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Widget   widget
+	Producer int
+}
+
+// publish sends an event to events without blocking, dropping it if the channel is full.
+func publish(events chan<- Event, event Event) {
+	if events == nil {
+		return
+	}
+	event.Time = time.Now()
+	select {
+	case events <- event:
+	default:
+	}
+}
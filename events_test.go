@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.numWidgets, cfg.numProducers = 50, 2
+	cfg.out = io.Discard
+	events := make(chan Event, 1000)
+	cfg.events = events
+	if _, err := RunPipeline(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+	counts := make(map[EventType]int)
+	for event := range events {
+		counts[event.Type]++
+		if event.Time.IsZero() {
+			t.Errorf("%s event has no timestamp", event.Type)
+		}
+	}
+	if counts[EventProduced] != 50 || counts[EventConsumed] != 50 || counts[EventProducerStopped] != 2 {
+		t.Errorf("Unexpected event counts %v", counts)
+	}
+
+	// Tripping the breaker is published with the widget that did it
+	cfg.breakerThreshold = 1
+	cfg.types = []widgetType{{"dud", 1}}
+	events = make(chan Event, 1000)
+	cfg.events = events
+	RunPipeline(cfg, nil)
+	close(events)
+	tripped := 0
+	for event := range events {
+		if event.Type == EventBreakerTripped {
+			tripped++
+			if !event.Widget.broken {
+				t.Errorf("Breaker tripped by %v", event.Widget)
+			}
+		}
+	}
+	if tripped != 1 {
+		t.Errorf("Breaker trip published %d times, expected once", tripped)
+	}
+}
+
+func TestEventsDontBlock(t *testing.T) {
+	// Nobody reads the channel, so every event is dropped rather than stalling the pipeline
+	cfg := defaultConfig()
+	cfg.numWidgets = 1000
+	cfg.out = io.Discard
+	cfg.events = make(chan Event)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if result, err := RunPipeline(cfg, nil); err != nil || result.Consumed != 1000 {
+			t.Errorf("Consumed %d widgets, expected 1000: %v", result.Consumed, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pipeline blocked on an unread event channel")
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync/atomic"
+)
+
+// INJECTED ERROR LOGIC
+// -consumer-error-rate makes consumers fail a fraction of widgets at random, as a chaos test of
+// how the run copes with a handler that fails: the widget is logged and tallied as failed, isn't
+// checkpointed or acknowledged, and the consumer carries on with the next one. Broken widgets are
+// a producer's doing; these errors are the consumer's, so they're counted apart from them, and a
+// broken widget is never failed, so it still stops production.
+
+// ErrInjected is the error a widget fails with when -consumer-error-rate picks it.
+var ErrInjected = errors.New("injected error")
+
+// errorInjector picks widgets to fail at random. Each consumer has its own random source, seeded
+// from the run's seed, so the sequence of failures each consumer makes is reproducible, though
+// which widgets a consumer receives isn't.
+type errorInjector struct {
+	rate     float64
+	rngs     []*rand.Rand // one per consumer in the group, each only used by its own consumer
+	injected atomic.Int64
+}
+
+func newErrorInjector(rate float64, seed int64, consumers int) *errorInjector {
+	rngs := make([]*rand.Rand, consumers)
+	for i := range rngs {
+		// Producers' sources are seeded above the run's seed, so these are seeded below it
+		rngs[i] = rand.New(rand.NewSource(seed - int64(i+1)))
+	}
+	return &errorInjector{rate: rate, rngs: rngs}
+}
+
+// fail reports whether the consumer numbered i within its group, counting from 0, should fail w.
+func (e *errorInjector) fail(w widget, i int) bool {
+	if w.broken || e.rngs[i].Float64() >= e.rate {
+		return false
+	}
+	e.injected.Add(1)
+	return true
+}
+
+// reportInjected reports how many errors were injected into the group's consumers, and returns the
+// count.
+func reportInjected(cfg config, g *consumerGroup) int {
+	if g.injector == nil {
+		return 0
+	}
+	injected := int(g.injector.injected.Load())
+	if injected > 0 {
+		fmt.Fprintf(os.Stderr, "Injected %d consumer errors (-consumer-error-rate %g)\n", injected, cfg.injectErrorRate)
+	}
+	return injected
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestConsumerErrorRate(t *testing.T) {
+	run := func(args ...string) (Result, *tallyingHandler, error) {
+		cfg, err := parseConfig(append([]string{"-seed", "1"}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := &tallyingHandler{counts: make(map[string]int)}
+		cfg.handler, cfg.out = handler, io.Discard
+		result, err := RunPipeline(cfg, nil)
+		return result, handler, err
+	}
+
+	result, handler, err := run("-n", "1000", "-k", "-1", "-c", "1", "-consumer-error-rate", "10%")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Injected < 50 || result.Injected > 150 || result.Results[resultFailed] != result.Injected {
+		t.Errorf("Injected %d errors, %d widgets failed, expected about 100 of each", result.Injected, result.Results[resultFailed])
+	}
+	if len(handler.counts) != 1000-result.Injected {
+		t.Errorf("Handler given %d widgets, expected the %d not failed", len(handler.counts), 1000-result.Injected)
+	}
+	// The failures are picked from the seed, so a rerun fails the same widgets
+	if again, _, _ := run("-n", "1000", "-k", "-1", "-c", "1", "-consumer-error-rate", "10%"); again.Injected != result.Injected {
+		t.Errorf("Rerun injected %d errors, expected %d", again.Injected, result.Injected)
+	}
+
+	// A broken widget is never failed, so the handler still gets it, and production stops at it
+	result, handler, err = run("-n", "100", "-k", "20", "-buffer", "0", "-consumer-error-rate", "1")
+	if !errors.Is(err, ErrProductionStopped) || result.Broken != 1 || result.Injected != result.Produced-1 || len(handler.counts) != 1 {
+		t.Errorf("Injected %d errors into %d widgets, %d broken: %v", result.Injected, result.Produced, result.Broken, err)
+	}
+
+	for _, rate := range []string{"-0.1", "150%", "often"} {
+		if _, err := parseConfig([]string{"-consumer-error-rate", rate}); err == nil {
+			t.Errorf("-consumer-error-rate %s accepted", rate)
+		}
+	}
+}
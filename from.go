@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FROM LOGIC
+// -from produces the widgets listed in a text file, a lighter-weight alternative to -replay for
+// hand-written test inputs. Each line describes one widget as id,source,broken:
+//
+//	# a broken widget partway through
+//	1,Producer_1,false
+//	2,Producer_2,true
+//
+// The broken column is any boolean strconv.ParseBool accepts, and decides the broken flag alone.
+// Blank lines and lines starting with # are skipped. The whole file is read before anything is
+// produced, so a malformed line fails the run up front, naming the line. Widgets are produced in
+// the order listed, each stamped with the time it's produced.
+
+// textSource is a WidgetSource producing a list of widgets read by readTextWidgets, in order.
+type textSource struct {
+	mutex   sync.Mutex
+	widgets []widget
+	next    int  // index of the next widget to produce
+	closed  bool // set by Close; nothing more is produced
+}
+
+// openTextSource reads the widgets listed in the file at path.
+func openTextSource(path string) (*textSource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	widgets, err := readTextWidgets(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s %w", path, err)
+	}
+	return &textSource{widgets: widgets}, nil
+}
+
+// readTextWidgets parses the widgets listed in r, one id,source,broken line each.
+func readTextWidgets(r io.Reader) ([]widget, error) {
+	var widgets []widget
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected id,source,broken, got %q", number, line)
+		}
+		id, source := strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1])
+		if id == "" {
+			return nil, fmt.Errorf("line %d: widget has no id", number)
+		}
+		broken, err := strconv.ParseBool(strings.TrimSpace(fields[2]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: broken column %q isn't true or false", number, strings.TrimSpace(fields[2]))
+		}
+		widgets = append(widgets, widget{id: id, source: source, broken: broken})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(widgets) == 0 {
+		return nil, errors.New("lists no widgets")
+	}
+	return widgets, nil
+}
+
+func (s *textSource) Next() (widget, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return widget{}, errors.New("widget list closed")
+	}
+	if s.next == len(s.widgets) {
+		return widget{}, errors.New("no more widgets listed")
+	}
+	w := s.widgets[s.next]
+	s.next++
+	w.time = time.Now()
+	return w, nil
+}
+
+// Close releases the list; nothing more is produced. The file itself was closed once read.
+func (s *textSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	s.widgets = nil
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadTextWidgets(t *testing.T) {
+	widgets, err := readTextWidgets(strings.NewReader("# two widgets\n\n1,Producer_1,false\n  a7 , Producer_2 , true \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(widgets) != 2 || widgets[0].id != "1" || widgets[0].broken || widgets[1].id != "a7" || widgets[1].source != "Producer_2" || !widgets[1].broken {
+		t.Errorf("Read %v", widgets)
+	}
+
+	for _, test := range []struct {
+		input, err string
+	}{
+		{"1,Producer_1,false\n2,Producer_1\n", "line 2: expected id,source,broken"},
+		{"# header\n1,Producer_1,maybe\n", `line 2: broken column "maybe"`},
+		{",Producer_1,false\n", "line 1: widget has no id"},
+		{"# nothing but comments\n", "lists no widgets"},
+	} {
+		if _, err := readTextWidgets(strings.NewReader(test.input)); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q gave error %v, expected one about %q", test.input, err, test.err)
+		}
+	}
+}
+
+func TestFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "widgets.txt")
+	if err := os.WriteFile(path, []byte("1,Producer_1,false\n2,Producer_2,false\n3,Producer_1,true\n4,Producer_2,false\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseConfig([]string{"-from", path, "-p", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &capturingHandler{widgets: make(map[string]widget)}
+	cfg.handler, cfg.out = handler, io.Discard
+	cfg.brokenPolicy = DeadLetterBroken{}
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Produced != 4 || result.Broken != 1 {
+		t.Fatalf("Produced %d widgets, %d broken, expected 4 and 1: %v", result.Produced, result.Broken, err)
+	}
+	if w := handler.widgets["3"]; !w.broken || w.source != "Producer_1" || w.time.IsZero() {
+		t.Errorf("Widget 3 produced as %v", w)
+	}
+
+	// A malformed file fails the run before anything is produced
+	if err := os.WriteFile(path, []byte("1,Producer_1,false\n2,Producer_2\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPipeline(cfg); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Malformed file gave %v, expected an error naming line 2", err)
+	}
+	cfg.from = filepath.Join(t.TempDir(), "missing.txt")
+	if _, err := NewPipeline(cfg); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Missing file gave %v", err)
+	}
+
+	// Like a replay, the list is released once the run is over
+	if err := os.WriteFile(path, []byte("1,Producer_1,false\n2,Producer_2,false\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	listed, err := openTextSource(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listed.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if err := listed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if w, err := listed.Next(); err == nil {
+		t.Errorf("Produced %v after the list was closed", w)
+	}
+
+	for _, args := range [][]string{{"-from", path, "-k", "2"}, {"-from", path, "-replay", path}, {"-from", path, "-duration", "1s"}} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// HANDLER LOGIC
+// WidgetHandler processes each widget the consumers receive, so consumption can do something other
+// than print -- write to a database, validate, or forward over the network. A custom handler is
+// shared by every consumer, so it must be safe for concurrent use. Consumers stop production on a
+// broken widget before passing it on, whatever the handler does with it.
+//
+// An error from Handle is logged and the pipeline carries on, unless the error is a *FatalError. A
+// handler that holds resources can implement io.Closer: the pipeline closes it once every consumer
+// has returned, even if the run stopped early.
+type WidgetHandler interface {
+	Handle(w widget) error
+}
+
+// ContextHandler is implemented by a WidgetHandler that can give up on a widget part way. Consumers
+// call HandleContext instead of Handle, with a context that is cancelled if the run is abandoned,
+// as -maxruntime does; a handler that only implements Handle can't be interrupted.
+type ContextHandler interface {
+	HandleContext(ctx context.Context, w widget) error
+}
+
+// FatalError wraps a handler error that should stop the pipeline. Production is stopped, the
+// widgets already made are still drained, and the run returns the error.
+type FatalError struct {
+	Err error
+}
+
+func (e *FatalError) Error() string { return "fatal: " + e.Err.Error() }
+func (e *FatalError) Unwrap() error { return e.Err }
+
+// printHandler is the default handler for a single consumer. It prints each widget, as text or in
+// the configured output format, saying whether a broken widget stopped production. In quiet mode
+// only broken widgets are printed, and in ordered mode widgets are printed in id order.
+type printHandler struct {
+	g           *consumerGroup
+	consumerNum int
+}
+
+func (h printHandler) Handle(w widget) error {
+	consumeStr := h.g.getConsumeMessage(w, h.consumerNum)
+	show := !h.g.quiet || w.broken
+	if h.g.ordered != nil {
+		return h.g.ordered.put(w, consumeStr, show)
+	}
+	if !show {
+		return nil
+	}
+	return h.g.print(w, consumeStr)
+}
+
+// print writes a consumed widget to the consumers' output: text as given, or the widget in the
+// configured output format.
+func (g *consumerGroup) print(w widget, text string) error {
+	if g.output == nil {
+		fmt.Fprint(g.out, text)
+		return nil
+	}
+	return g.output.Write(w)
+}
+
+// handlerFor returns the handler consumer consumerNum passes widgets to.
+func (g *consumerGroup) handlerFor(consumerNum int) WidgetHandler {
+	if g.handler == nil {
+		return printHandler{g: g, consumerNum: consumerNum}
+	}
+	return g.handler
+}
+
+// handlerFailed logs an error from a handler, stopping production if it is fatal.
+func (g *consumerGroup) handlerFailed(w widget, consumerNum int, err error) {
+	fmt.Fprintf(os.Stderr, "Consumer_%d couldn't handle widget %s: %v\n", consumerNum, w.id, err)
+	var panicked *PanicError
+	if errors.As(err, &panicked) {
+		os.Stderr.Write(panicked.Stack)
+	}
+	var fatal *FatalError
+	if errors.As(err, &fatal) {
+		g.fatal.CompareAndSwap(nil, fatal)
+		g.stopProducers()
+	}
+}
+
+// closeHandler closes handler if it holds resources.
+func closeHandler(handler WidgetHandler) error {
+	if closer, ok := handler.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// fatalError returns the first fatal error from a handler, if there was one.
+func (g *consumerGroup) fatalError() error {
+	if fatal := g.fatal.Load(); fatal != nil {
+		return fatal
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingHandler counts the widgets it sees, failing with err on widget failOn.
+type countingHandler struct {
+	handled atomic.Int64
+	failOn  string
+	err     error
+}
+
+func (h *countingHandler) Handle(w widget) error {
+	h.handled.Add(1)
+	if w.id == h.failOn {
+		return h.err
+	}
+	return nil
+}
+
+func TestPrintHandlerPercent(t *testing.T) {
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	var out strings.Builder
+	consumerGroup := newConsumerGroup(config{numConsumers: 1, out: &out}, nil, &wg, &shouldStop, &shouldStopMutex, noopSink{}, nil)
+
+	// Widget fields are printed verbatim, never interpreted as a format string
+	w := widget{id: "1", source: "Producer_%s%d%%", producerID: 1, time: time.Now()}
+	if err := consumerGroup.handlerFor(1).Handle(w); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "source=Producer_%s%d%% ") || strings.Contains(out.String(), "%!") {
+		t.Errorf("Percent signs in a widget mangled: %q", out.String())
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	var out strings.Builder
+	consumerGroup := newConsumerGroup(config{numConsumers: 1, out: &out, quiet: true}, nil, &wg, &shouldStop, &shouldStopMutex, noopSink{}, nil)
+
+	handler := consumerGroup.handlerFor(1)
+	handler.Handle(widget{id: "1", source: "Producer_1", producerID: 1, time: time.Now()})
+	if out.Len() != 0 {
+		t.Errorf("Consumed widget printed in quiet mode: %q", out.String())
+	}
+	handler.Handle(widget{id: "2", source: "Producer_1", producerID: 1, time: time.Now(), broken: true})
+	if !strings.Contains(out.String(), "found a broken widget [id=2 ") {
+		t.Errorf("Broken widget not reported in quiet mode: %q", out.String())
+	}
+}
+
+func TestWidgetHandler(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.numWidgets, cfg.numProducers, cfg.numConsumers = 200, 2, 3
+	cfg.out = io.Discard
+
+	// A custom handler sees every widget, and an ordinary error doesn't stop the run
+	handler := &countingHandler{failOn: "10", err: errors.New("database unavailable")}
+	cfg.handler = handler
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || handler.handled.Load() != 200 || result.Consumed != 200 {
+		t.Errorf("Handler saw %d widgets, expected 200: %v", handler.handled.Load(), err)
+	}
+
+	// A fatal error stops production and is returned
+	cause := errors.New("disk full")
+	cfg.numWidgets, cfg.numProducers, cfg.numConsumers = 100000, 1, 1
+	cfg.bufferSize = 0
+	handler = &countingHandler{failOn: "10", err: &FatalError{Err: cause}}
+	cfg.handler = handler
+	_, err = RunPipeline(cfg, nil)
+	if !errors.Is(err, cause) {
+		t.Errorf("Fatal handler error not returned: %v", err)
+	}
+	if handler.handled.Load() >= 100000 {
+		t.Errorf("Fatal handler error didn't stop production")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// HARNESS
+// runHarness runs a whole pipeline in memory and hands back what happened to every widget, so tests
+// can assert on outcomes rather than on printed output. Widgets are collected in place of the
+// default handler.
+
+// harnessRun is the outcome of a pipeline run by runHarness.
+type harnessRun struct {
+	Result  Result
+	Err     error
+	Widgets []widget // in the order they were handled, once per group with -fanout
+}
+
+// ids returns the ids of the widgets handled, in the order they were handled.
+func (r harnessRun) ids(t *testing.T) []int {
+	ids := make([]int, len(r.Widgets))
+	for i, w := range r.Widgets {
+		ids[i] = mustAtoi(t, w.id)
+	}
+	return ids
+}
+
+// times counts how often each widget id was handled.
+func (r harnessRun) times() map[string]int {
+	times := make(map[string]int)
+	for _, w := range r.Widgets {
+		times[w.id]++
+	}
+	return times
+}
+
+// collectingHandler keeps every widget it handles, in order.
+type collectingHandler struct {
+	mutex   sync.Mutex
+	widgets []widget
+}
+
+func (h *collectingHandler) Handle(w widget) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.widgets = append(h.widgets, w)
+	return nil
+}
+
+// runHarness runs the pipeline described by args, which must parse and not use -forward. Once ctx is
+// done production is stopped as it would be by an interrupt, and the run fails the test if it
+// doesn't then finish promptly.
+func runHarness(ctx context.Context, t *testing.T, args ...string) harnessRun {
+	t.Helper()
+	cfg, err := parseConfig(args)
+	if err != nil {
+		t.Fatalf("Bad harness arguments %v: %v", args, err)
+	}
+	collector := &collectingHandler{}
+	cfg.handler = collector
+	p, err := NewPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	done := make(chan harnessRun, 1)
+	go func() {
+		result, err := p.Run(signals)
+		done <- harnessRun{Result: result, Err: err}
+	}()
+
+	var run harnessRun
+	select {
+	case run = <-done:
+	case <-ctx.Done():
+		signals <- os.Interrupt
+		select {
+		case run = <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v didn't stop within 5s of its context ending: %v", args, context.Cause(ctx))
+		}
+	}
+	// Every consumer has returned, so the collector is no longer written to
+	run.Widgets = collector.widgets
+	return run
+}
+
+func TestHarnessFanout(t *testing.T) {
+	run := runHarness(t.Context(), t, "-n", "200", "-p", "3", "-c", "2", "-fanout", "3")
+	if run.Err != nil {
+		t.Fatal(run.Err)
+	}
+	times := run.times()
+	if len(times) != 200 || run.Result.Consumed != 600 {
+		t.Fatalf("%d distinct widgets handled %d times in all", len(times), run.Result.Consumed)
+	}
+	for id, n := range times {
+		if n != 3 {
+			t.Errorf("Widget %s handled by %d groups, expected 3", id, n)
+		}
+	}
+}
+
+func TestHarnessOrdering(t *testing.T) {
+	// One producer and one consumer handle widgets in the order they were made
+	run := runHarness(t.Context(), t, "-n", "500", "-idstart", "1000")
+	if run.Err != nil {
+		t.Fatal(run.Err)
+	}
+	ids := run.ids(t)
+	if len(ids) != 500 || !slices.IsSorted(ids) || ids[0] != 1000 {
+		t.Errorf("Handled %d widgets out of order, or not starting at 1000: %v", len(ids), ids)
+	}
+}
+
+func TestHarnessBrokenWidget(t *testing.T) {
+	run := runHarness(t.Context(), t, "-n", "1000", "-k", "5", "-buffer", "0", "-c", "2")
+	if !errors.Is(run.Err, ErrProductionStopped) {
+		t.Errorf("Broken widget didn't stop production: %v", run.Err)
+	}
+	var broken []string
+	for _, w := range run.Widgets {
+		if w.broken {
+			broken = append(broken, w.id)
+		}
+	}
+	if !slices.Equal(broken, []string{"5"}) || run.Result.Produced >= 1000 {
+		t.Errorf("Broken widgets %v, %d produced", broken, run.Result.Produced)
+	}
+	if len(run.Widgets) != run.Result.Produced {
+		t.Errorf("Handled %d of the %d widgets produced", len(run.Widgets), run.Result.Produced)
+	}
+}
+
+func TestHarnessContext(t *testing.T) {
+	// A run that would take far too long is stopped once its context ends, and drains cleanly
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	run := runHarness(ctx, t, "-n", "100000000", "-p", "2", "-buffer", "100")
+	if run.Err != nil {
+		t.Fatal(run.Err)
+	}
+	if run.Result.Produced == 0 || run.Result.Produced >= 100000000 || len(run.Widgets) != run.Result.Produced {
+		t.Errorf("Produced %d and handled %d widgets before stopping", run.Result.Produced, len(run.Widgets))
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// HIGH-WATER MARK LOGIC
+// A consumer group's consumers share a high-water mark: the highest widget id any of them has
+// consumed so far, for progress bars and the like. It's the highest id seen, not a promise that
+// every id below it was consumed. Consumers take widgets in parallel, and producers make them in
+// parallel, so ids below the mark may still be buffered or being handled, and with -ttl or a drain
+// timeout may never be consumed at all. Only numeric ids move it, so widgets listed with -from or
+// -n - with ids of their own may leave it at 0.
+
+// highWaterMark is the highest numeric id observed, 0 before any. It's safe for concurrent use.
+type highWaterMark struct {
+	max atomic.Int64
+}
+
+// observe raises the mark to id, if it's a higher number.
+func (m *highWaterMark) observe(id string) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return
+	}
+	for {
+		current := m.max.Load()
+		if n <= current || m.max.CompareAndSwap(current, n) {
+			return
+		}
+	}
+}
+
+// load returns the mark.
+func (m *highWaterMark) load() int {
+	return int(m.max.Load())
+}
+
+// highWaterMark returns the highest id the group's consumers have consumed so far.
+func (g *consumerGroup) highWaterMark() int {
+	return g.highWater.load()
+}
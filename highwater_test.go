@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestHighWaterMark(t *testing.T) {
+	var mark highWaterMark
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			for id := offset; id <= 1000; id += 8 {
+				mark.observe(strconv.Itoa(id))
+			}
+		}(i)
+	}
+	wg.Wait()
+	mark.observe("a7")
+	mark.observe("12")
+	if mark.load() != 1000 {
+		t.Errorf("High-water mark %d, expected 1000", mark.load())
+	}
+
+	for _, fanout := range []string{"1", "2"} {
+		cfg, err := parseConfig([]string{"-n", "1000", "-p", "4", "-c", "4", "-idstart", "500", "-fanout", fanout})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.out = io.Discard
+		p, err := NewPipeline(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mark := p.Status().HighWater; mark != 0 {
+			t.Errorf("High-water mark %d before the run, expected 0", mark)
+		}
+		if _, err := p.Run(nil); err != nil {
+			t.Fatal(err)
+		}
+		if mark := p.Status().HighWater; mark != 1499 {
+			t.Errorf("-fanout %s: high-water mark %d, expected 1499", fanout, mark)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// HISTOGRAM LOGIC
+// -histogram prints the distribution of latencies from production to handling at the end of a
+// run, as a bar per bucket, for a quick look at its shape beyond the percentiles. The buckets are
+// split at -histogram-buckets if given, or else at the steps of a 1-2-5 series (1ms, 2ms, 5ms,
+// 10ms, ...) that fall within the range of latencies observed, or just its powers of ten when
+// that would give too many buckets. The first bucket takes every latency below the first split,
+// and the last every latency from the last split up.
+
+// histogramWidth is how many characters the longest bar takes.
+const histogramWidth = 40
+
+// histogramMaxBuckets is the most buckets an auto-scaled histogram has before it drops to powers of ten.
+const histogramMaxBuckets = 12
+
+// parseHistogramBuckets parses a list of the latencies to split buckets at, like "1ms,5ms,20ms".
+func parseHistogramBuckets(list string) ([]time.Duration, error) {
+	bounds, err := parseDurations(list)
+	if err != nil {
+		return nil, err
+	}
+	for i, bound := range bounds {
+		if bound == 0 || i > 0 && bound <= bounds[i-1] {
+			return nil, errors.New("histogram buckets must be positive and increasing")
+		}
+	}
+	return bounds, nil
+}
+
+// autoBuckets returns where to split buckets for latencies, which must be sorted: the 1-2-5 steps
+// above the lowest and up to the highest.
+func autoBuckets(latencies []time.Duration) []time.Duration {
+	lowest, highest := latencies[0], latencies[len(latencies)-1]
+	var bounds, decades []time.Duration
+	for decade := time.Nanosecond; decade <= highest; decade *= 10 {
+		for _, step := range []time.Duration{1, 2, 5} {
+			if bound := step * decade; bound > lowest && bound <= highest {
+				bounds = append(bounds, bound)
+				if step == 1 {
+					decades = append(decades, bound)
+				}
+			}
+		}
+	}
+	if len(bounds) >= histogramMaxBuckets {
+		return decades
+	}
+	return bounds
+}
+
+// writeHistogram prints a histogram of latencies to out, split at bounds, or auto-scaled if
+// bounds is empty. Nothing is printed without any latencies.
+func writeHistogram(out io.Writer, latencies []time.Duration, bounds []time.Duration) error {
+	if len(latencies) == 0 {
+		return nil
+	}
+	latencies = slices.Sorted(slices.Values(latencies))
+	if len(bounds) == 0 {
+		bounds = autoBuckets(latencies)
+	}
+	counts := make([]int, len(bounds)+1)
+	for _, latency := range latencies {
+		bucket, found := slices.BinarySearch(bounds, latency)
+		if found {
+			// A latency on a split belongs to the bucket it starts
+			bucket++
+		}
+		counts[bucket]++
+	}
+	most := slices.Max(counts)
+
+	fmt.Fprintf(out, "Latency histogram of %d widgets:\n", len(latencies))
+	w := tabwriter.NewWriter(out, 0, 0, 1, ' ', 0)
+	for i, count := range counts {
+		var label string
+		switch {
+		case len(bounds) == 0:
+			label = "all"
+		case i == 0:
+			label = "< " + bounds[0].String()
+		case i == len(bounds):
+			label = ">= " + bounds[i-1].String()
+		default:
+			label = bounds[i-1].String() + " - " + bounds[i].String()
+		}
+		bar := count * histogramWidth / most
+		if bar == 0 && count > 0 {
+			// Show that the bucket isn't empty, however few it has
+			bar = 1
+		}
+		fmt.Fprintf(w, "  %s\t|%s%s| %d\n", label, strings.Repeat("#", bar), strings.Repeat(" ", histogramWidth-bar), count)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteHistogram(t *testing.T) {
+	var latencies []time.Duration
+	for i := 0; i < 40; i++ {
+		latencies = append(latencies, 500*time.Microsecond)
+	}
+	latencies = append(latencies, 2*time.Millisecond, 5*time.Millisecond, 30*time.Millisecond)
+	var out bytes.Buffer
+	if err := writeHistogram(&out, latencies, []time.Duration{time.Millisecond, 5 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "Latency histogram of 43 widgets:\n" +
+		"  < 1ms     |" + strings.Repeat("#", 40) + "| 40\n" +
+		"  1ms - 5ms |#" + strings.Repeat(" ", 39) + "| 1\n" +
+		"  >= 5ms    |##" + strings.Repeat(" ", 38) + "| 2\n"
+	if out.String() != expected {
+		t.Errorf("Histogram printed as\n%s\nexpected\n%s", out.String(), expected)
+	}
+
+	out.Reset()
+	writeHistogram(&out, nil, nil)
+	if out.Len() != 0 {
+		t.Errorf("Histogram of no latencies printed %q", out.String())
+	}
+}
+
+func TestAutoBuckets(t *testing.T) {
+	for _, test := range []struct {
+		lowest, highest time.Duration
+		expected        []time.Duration
+	}{
+		{700 * time.Microsecond, 12 * time.Millisecond, []time.Duration{time.Millisecond, 2 * time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond}},
+		{time.Microsecond, time.Second, []time.Duration{10 * time.Microsecond, 100 * time.Microsecond, time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond, time.Second}},
+		{3 * time.Millisecond, 3 * time.Millisecond, nil},
+	} {
+		if bounds := autoBuckets([]time.Duration{test.lowest, test.highest}); !slices.Equal(bounds, test.expected) {
+			t.Errorf("Buckets for %s to %s split at %v, expected %v", test.lowest, test.highest, bounds, test.expected)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	cfg, err := parseConfig([]string{"-n", "100", "-histogram", "-histogram-buckets", "1ms,10ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = io.Discard
+	if result, err := RunPipeline(cfg, nil); err != nil || result.Latency.Max == 0 {
+		t.Errorf("Latencies weren't measured for -histogram: %+v, %v", result.Latency, err)
+	}
+
+	for _, args := range [][]string{{"-histogram-buckets", "1ms"}, {"-histogram", "-histogram-buckets", "5ms,1ms"}, {"-histogram", "-histogram-buckets", "0s"}} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ID LOGIC
+// IDAllocator hands out the ids of generated widgets, so a run can use something other than
+// sequential ids -- ranges reserved for this instance, a pool of ids, or random unique ids. Next
+// reports false once there are no ids left, which ends production. An allocator is shared by every
+// producer, so it must be safe for concurrent use.
+//
+// -k still counts widgets from 1 in the order their ids were handed out, whatever the ids are.
+type IDAllocator interface {
+	Next() (int, bool)
+}
+
+// sequentialAllocator is the default allocator, counting up from -idstart. It never runs out; the
+// widget count or duration decides when production ends.
+type sequentialAllocator struct {
+	next *atomic.Int64
+}
+
+func (a sequentialAllocator) Next() (int, bool) {
+	return int(a.next.Add(1) - 1), true
+}
+
+// poolAllocator hands out the ids in a fixed pool, in order, running out once all have been used.
+type poolAllocator struct {
+	mutex sync.Mutex
+	ids   []int
+}
+
+func newPoolAllocator(ids []int) *poolAllocator {
+	return &poolAllocator{ids: ids}
+}
+
+func (a *poolAllocator) Next() (int, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.ids) == 0 {
+		return 0, false
+	}
+	id := a.ids[0]
+	a.ids = a.ids[1:]
+	return id, true
+}
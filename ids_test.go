@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSequentialAllocator(t *testing.T) {
+	next := new(atomic.Int64)
+	next.Store(10)
+	allocator := sequentialAllocator{next: next}
+	var wg sync.WaitGroup
+	var seen sync.Map
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id, ok := allocator.Next()
+				if _, dup := seen.LoadOrStore(id, true); dup || !ok || id < 10 || id >= 810 {
+					t.Errorf("Allocated id %d, %t", id, ok)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPoolAllocator(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.numWidgets, cfg.numProducers, cfg.kthBadWidget = 10, 2, 2
+	cfg.breakerThreshold = 1 // so the broken widget doesn't stop production before the pool runs out
+	cfg.ids = newPoolAllocator([]int{100, 7, 42})
+	handler := &capturingHandler{widgets: make(map[string]widget)}
+	cfg.handler = handler
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Produced != 3 || result.Consumed != 3 {
+		t.Fatalf("Running out of ids produced %d and consumed %d: %v", result.Produced, result.Consumed, err)
+	}
+	for _, id := range []string{"100", "7", "42"} {
+		if _, ok := handler.widgets[id]; !ok {
+			t.Errorf("Widget %s from the pool not consumed", id)
+		}
+	}
+	brokenCount := 0
+	for _, w := range handler.widgets {
+		if w.broken {
+			brokenCount++
+		}
+	}
+	if brokenCount != 1 {
+		t.Errorf("%d widgets broken, expected only the second allocated", brokenCount)
+	}
+
+	if _, ok := newPoolAllocator(nil).Next(); ok {
+		t.Errorf("Empty pool handed out an id")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import "time"
+
+// IN-FLIGHT LOGIC
+// -maxinflight bounds the widgets that have been made but not yet taken by a consumer, whatever
+// the channel buffer, modeling a limit on work in progress. The limit is a semaphore shared by
+// producers and consumers: a producer takes a slot before making each widget, and a consumer gives
+// it back as soon as it receives the widget.
+
+// acquireInFlight waits for a free slot, reporting false if production is stopped or the run
+// abandoned in the meantime so a producer can't be left waiting forever.
+func (g *producerGroup) acquireInFlight() bool {
+	select {
+	case g.inflight <- struct{}{}:
+		return true
+	default:
+	}
+
+	ticker := time.NewTicker(pausePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case g.inflight <- struct{}{}:
+			return true
+		case <-g.ctx.Done():
+			return false
+		case <-ticker.C:
+			if stopRequested(g.producersShouldStop, g.producersShouldStopMutex) {
+				return false
+			}
+		}
+	}
+}
+
+// releaseInFlight gives back the slot taken for a widget that was never sent.
+func (g *producerGroup) releaseInFlight() {
+	<-g.inflight
+}
+
+// releaseInFlight gives back the slot of a widget a consumer has received.
+func (g *consumerGroup) releaseInFlight() {
+	if g.inflight != nil {
+		<-g.inflight
+	}
+}
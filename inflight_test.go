@@ -0,0 +1,40 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMaxInFlight(t *testing.T) {
+	cfg, err := parseConfig([]string{"-maxinflight", "5", "-n", "100", "-p", "4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := blockingHandler{release: make(chan struct{})}
+	cfg.handler = handler
+	cfg.out = io.Discard
+	p, err := NewPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan Result)
+	go func() {
+		result, _ := p.Run(nil)
+		done <- result
+	}()
+
+	// The consumer is stuck on its first widget, so only 5 more may be made despite the buffer
+	time.Sleep(100 * time.Millisecond)
+	if s := p.Status(); s.Produced > 6 {
+		t.Errorf("%d widgets made with 5 in flight and 1 being handled", s.Produced)
+	}
+	close(handler.release)
+	if result := <-done; result.Consumed != 100 {
+		t.Errorf("Consumed %d widgets, expected 100", result.Consumed)
+	}
+
+	if _, err := parseConfig([]string{"-maxinflight", "5", "-batchsize", "10"}); err == nil {
+		t.Errorf("-maxinflight with batching not rejected")
+	}
+}
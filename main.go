@@ -2,43 +2,124 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type widget struct {
-	id     string
-	source string
-	time   time.Time
-	broken bool
+	id         string
+	source     string
+	producerID int    // number of the producer that made the widget, for grouping without parsing source
+	widgetType string // kind of product, empty unless types are configured
+	time       time.Time
+	broken     bool
+	payload    []byte // data carried by the widget, empty unless -payloadsize is set
+	pill       int    // non-zero for a poison pill: the consumers it stops, counting the one receiving it
+	// W3C traceparent naming the span of the widget's production, empty unless tracing with -otel
+	traceParent string
+	metadata    map[string]string // key/value pairs describing the widget, never modified once it's sent
+	// Set by a consumer when the broken policy chose to dead-letter the widget rather than stop production
+	deadLettered bool
 }
 
 // String provides an implementation of the Stringer interface for widget, allowing it to be printed.
+// The time is rendered as a fixed-width hh:mm:ss.nnnnnnnnn so it can be parsed back unambiguously.
 func (w widget) String() string {
 	hour, minute, second := w.time.Clock()
-	return fmt.Sprintf("[id=%s source=%s time=%d:%d:%d.%d broken=%t]", w.id, w.source, hour, minute, second, w.time.Nanosecond(), w.broken)
+	typeStr := ""
+	if w.widgetType != "" {
+		typeStr = " type=" + w.widgetType
+	}
+	payloadStr := ""
+	if len(w.payload) > 0 {
+		payloadStr = fmt.Sprintf(" payload=%dB", len(w.payload))
+	}
+	metadataStr := ""
+	if len(w.metadata) > 0 {
+		metadataStr = " metadata={" + formatMetadata(w.metadata) + "}"
+	}
+	return fmt.Sprintf("[id=%s source=%s%s time=%02d:%02d:%02d.%09d broken=%t%s%s]", w.id, w.source, typeStr, hour, minute, second, w.time.Nanosecond(), w.broken, payloadStr, metadataStr)
+}
+
+// latencyAt returns how long w had been around at now. A widget passed over a channel keeps the
+// monotonic clock reading taken when it was made, so adjusting the wall clock mid-run doesn't
+// affect its latency. A widget decoded from a socket or a replay file only has the wall clock,
+// though, so if that was set back the latency is clamped to zero rather than going negative.
+func (w widget) latencyAt(now time.Time) time.Duration {
+	if latency := now.Sub(w.time); latency > 0 {
+		return latency
+	}
+	return 0
 }
 
 // PRODUCER LOGIC
 // producerGroup contains all of the shared data needed to spawn a group of widget producers.
 type producerGroup struct {
-	numberProducers          int         // Number of goroutines to spawn
-	idMutex                  sync.Mutex  // exclusion on incrementation of widget id
-	currentID                int         // Keeps track of the current widget's id number
-	producersShouldStop      *bool       // indicates whether or not the producers should halt
-	widgetChan               chan widget // channel to insert the widgets into
-	numOfWidgets             int         // number of widgets to produce
-	badWidgetNum             int
+	numberProducers          int             // Number of goroutines to spawn
+	currentID                *atomic.Int64   // Keeps track of the next widget's id number
+	ids                      IDAllocator     // hands out widget ids, sequentially from currentID by default
+	quotas                   []int           // widgets left for each producer to make with -perproducer, used instead of numOfWidgets
+	breakAfter               time.Duration   // with -random-break in duration mode, the first widget made this long after starting is broken
+	randomlyBroken           *atomic.Bool    // set once the widget broken by breakAfter has been made
+	acks                     *ackTracker     // records widgets sent, with -ack
+	inflight                 chan struct{}   // semaphore of widgets made but not yet received, with -maxinflight
+	producersShouldStop      *bool           // indicates whether or not the producers should halt
+	widgetChan               chan widget     // channel to insert the widgets into
+	numOfWidgets             *atomic.Int64   // number of widgets left to produce
+	badWidgetNum             int             // sequence number of the broken widget, counting from 1 regardless of idStart or producer
+	breakEvery               int             // with -every, widgets whose sequence number is a multiple of this are broken
+	idStart                  int             // id of the first widget
 	wg                       *sync.WaitGroup // waitgroup for the main thread
 	producersShouldStopMutex *sync.Mutex
+	rngs                     []*rand.Rand      // per-producer random sources, indexed by producerNumber-1
+	duration                 time.Duration     // if non-zero, produce continuously for this long instead of numOfWidgets widgets
+	deadline                 time.Time         // when production ends in duration mode, set on spawn
+	sendTimeout              time.Duration     // how long a producer waits to send a widget before giving up, 0 waits forever
+	batchSize                int               // widgets per batch, batching is only used when this is more than 1
+	batchChan                chan []widget     // channel to insert batches into, used instead of widgetChan when batching
+	types                    []widgetType      // kinds of widget to produce, each with its own broken rate
+	sources                  *sourcePool       // logical sources widgets are given, Producer_N if nil
+	typeAssignment           string            // how types are assigned to widgets, see assignType
+	paused                   *atomic.Bool      // while set, producers wait instead of making widgets
+	source                   WidgetSource      // where producers take widgets from, nil to generate them
+	events                   chan<- Event      // observer for lifecycle events, nil to publish none
+	delays                   []time.Duration   // think time per producer before each widget, cycled over the producers
+	jitter                   float64           // fraction by which each delay varies at random either way
+	madeBy                   []atomic.Int64    // widgets made by each producer, indexed by producerNumber-1
+	started                  time.Time         // when producers were spawned
+	alive                    *atomic.Int64     // producers still running
+	rampUp                   time.Duration     // gap between producers starting, 0 starts them all at once
+	payloadSize              sizeRange         // bytes of random payload in each widget
+	checkpoint               *checkpoint       // ids consumed by an earlier run, which aren't made again
+	skipped                  *atomic.Int64     // ids passed over because an earlier run consumed them
+	overflow                 string            // what to do when widgetChan is full, see offer
+	dropped                  *atomic.Int64     // widgets shed because widgetChan was full
+	tracing                  bool              // whether widgets are stamped with a traceparent, with -otel
+	metadata                 map[string]string // key/value pairs given to every widget, with -meta
+	ctx                      context.Context   // cancelled to abandon production, so no producer is left waiting
 }
 
 // spawnProducers spawns <number_producers> goroutines to produce widgets
 func (g *producerGroup) spawnProducers() {
+	g.started = time.Now()
+	if g.duration > 0 {
+		g.deadline = time.Now().Add(g.duration)
+	}
+	g.alive.Add(int64(g.numberProducers))
 	for i := 1; i <= g.numberProducers; i++ {
 		go g.produce(i)
 	}
@@ -48,67 +129,408 @@ func (g *producerGroup) spawnProducers() {
 // out of widgets, then calls wg.Done() to unblock the main thread.
 func (g *producerGroup) produce(producerNumber int) {
 	defer g.wg.Done()
+	defer g.alive.Add(-1)
+	defer publish(g.events, Event{Type: EventProducerStopped, Producer: producerNumber})
+	g.waitForRampUp(producerNumber)
+	if g.batchChan != nil {
+		g.produceBatches(producerNumber)
+		return
+	}
+	source := g.sourceFor(producerNumber)
 	for {
-		w, err := g.getWidget(producerNumber)
+		g.pace(producerNumber)
+		if g.inflight != nil && !g.acquireInFlight() {
+			return
+		}
+		w, err := source.Next()
+
+		if err != nil {
+			if g.inflight != nil {
+				g.releaseInFlight()
+			}
+			return
+		}
+		g.madeBy[producerNumber-1].Add(1)
+		w = g.labeled(g.traced(w))
+		publish(g.events, Event{Type: EventProduced, Widget: w})
+		if g.acks != nil {
+			g.acks.record(w.id)
+		}
+		if !g.send(w) {
+			if g.acks != nil {
+				g.acks.forget(w.id)
+			}
+			if g.inflight != nil {
+				g.releaseInFlight()
+			}
+			if g.ctx.Err() == nil {
+				fmt.Fprintf(os.Stderr, "Producer_%d couldn't send widget %s within %s, are any consumers left? -- stopping\n", producerNumber, w.id, g.sendTimeout)
+			}
+			return
+		}
+
+	}
+}
 
+// produceBatches is produce for batch mode. A batch is sent once it is full, once it holds a broken
+// widget (so the stop signal isn't held back waiting for the batch to fill), or once production ends
+// (so a partial batch is still consumed).
+func (g *producerGroup) produceBatches(producerNumber int) {
+	batch := make([]widget, 0, g.batchSize)
+	source := g.sourceFor(producerNumber)
+	for {
+		g.pace(producerNumber)
+		w, err := source.Next()
 		if err == nil {
-			g.widgetChan <- w
-		} else {
+			g.madeBy[producerNumber-1].Add(1)
+			w = g.labeled(g.traced(w))
+			publish(g.events, Event{Type: EventProduced, Widget: w})
+			batch = append(batch, w)
+		}
+
+		if len(batch) > 0 && (err != nil || w.broken || len(batch) == g.batchSize) {
+			if g.acks != nil {
+				for _, w := range batch {
+					g.acks.record(w.id)
+				}
+			}
+			if !g.sendBatch(batch) {
+				if g.acks != nil {
+					for _, w := range batch {
+						g.acks.forget(w.id)
+					}
+				}
+				if g.ctx.Err() == nil {
+					fmt.Fprintf(os.Stderr, "Producer_%d couldn't send a batch of %d widgets within %s, are any consumers left? -- stopping\n", producerNumber, len(batch), g.sendTimeout)
+				}
+				return
+			}
+			batch = make([]widget, 0, g.batchSize)
+		}
+
+		if err != nil {
 			return
 		}
+	}
+}
+
+// sendBatch is send for batch mode.
+func (g *producerGroup) sendBatch(batch []widget) bool {
+	if g.sendTimeout == 0 {
+		select {
+		case g.batchChan <- batch:
+			return true
+		case <-g.ctx.Done():
+			return false
+		}
+	}
+
+	select {
+	case g.batchChan <- batch:
+		return true
+	default:
+	}
 
+	timer := time.NewTimer(g.sendTimeout)
+	defer timer.Stop()
+	select {
+	case g.batchChan <- batch:
+		return true
+	case <-timer.C:
+		return false
+	case <-g.ctx.Done():
+		return false
 	}
 }
 
-// getWidget returns a widget given the current producer_group state (or indicates that production needs to stop).
-func (g *producerGroup) getWidget(producerNumber int) (widget, error) {
+// send puts w on widgetChan, giving up if that takes longer than sendTimeout (when it's non-zero)
+// or the run is abandoned.
+func (g *producerGroup) send(w widget) bool {
+	if g.overflow == overflowDropOldest || g.overflow == overflowDropNewest {
+		g.offer(w)
+		return true
+	}
+	if g.sendTimeout == 0 {
+		select {
+		case g.widgetChan <- w:
+			return true
+		case <-g.ctx.Done():
+			return false
+		}
+	}
+
+	// Only pay for a timer when the channel is full
+	select {
+	case g.widgetChan <- w:
+		return true
+	default:
+	}
+
+	timer := time.NewTimer(g.sendTimeout)
+	defer timer.Stop()
+	select {
+	case g.widgetChan <- w:
+		return true
+	case <-timer.C:
+		return false
+	case <-g.ctx.Done():
+		return false
+	}
+}
+
+// waitForRampUp holds a producer back until its turn to start, rampUp after the one before it.
+// A stop signal ends the wait early.
+func (g *producerGroup) waitForRampUp(producerNumber int) {
+	startAt := g.started.Add(time.Duration(producerNumber-1) * g.rampUp)
+	for time.Now().Before(startAt) && !stopRequested(g.producersShouldStop, g.producersShouldStopMutex) && g.ctx.Err() == nil {
+		time.Sleep(min(pausePollInterval, time.Until(startAt)))
+	}
+}
+
+// pace waits out the given producer's delay, if any, before it makes its next widget, so the
+// widget's time is stamped once the delay is over.
+func (g *producerGroup) pace(producerNumber int) {
+	if len(g.delays) > 0 {
+		delay := g.delays[(producerNumber-1)%len(g.delays)]
+		if g.jitter > 0 {
+			delay = jittered(delay, g.jitter, g.rand(producerNumber))
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-g.ctx.Done():
+		}
+	}
+}
+
+// jittered varies delay uniformly at random by up to jitter, a fraction of it, either way. The
+// mean is unchanged, so jitter makes arrivals irregular without changing the rate.
+func jittered(delay time.Duration, jitter float64, rng *rand.Rand) time.Duration {
+	return time.Duration(float64(delay) * (1 + jitter*(2*rng.Float64()-1)))
+}
+
+// mayProduce waits while production is paused, and returns an error if production has been
+// signaled to stop.
+func (g *producerGroup) mayProduce() error {
+	// While paused, keep checking for a stop signal so shutdown isn't held up
+	for g.paused.Load() {
+		if stopRequested(g.producersShouldStop, g.producersShouldStopMutex) {
+			return errors.New("production has been signaled to stop")
+		}
+		time.Sleep(pausePollInterval)
+	}
+
 	g.producersShouldStopMutex.Lock()
 	if *g.producersShouldStop {
 		g.producersShouldStopMutex.Unlock()
-		return widget{}, errors.New("production has been signaled to stop")
+		return errors.New("production has been signaled to stop")
 	}
 	g.producersShouldStopMutex.Unlock()
+	return nil
+}
 
-	// Critical section
-	g.idMutex.Lock()
+// getWidget returns a widget given the current producer_group state (or indicates that production needs to stop).
+func (g *producerGroup) getWidget(producerNumber int) (widget, error) {
+	if err := g.mayProduce(); err != nil {
+		return widget{}, err
+	}
 
-	if g.numOfWidgets == 0 {
-		g.idMutex.Unlock()
-		return widget{}, errors.New("no more widgets to produce")
+	// In duration mode the widget count doesn't apply, production just ends at the deadline
+	if g.duration > 0 && !time.Now().Before(g.deadline) {
+		return widget{}, errors.New("production time is up")
 	}
 
-	currentID := g.currentID
-	g.currentID++
-	g.numOfWidgets--
-	g.idMutex.Unlock()
+	// Claim a widget before taking an id, so exactly numOfWidgets ids are handed out
+	if g.duration == 0 && !g.claimWidget(producerNumber) {
+		return widget{}, errors.New("no more widgets to produce")
+	}
+	currentID, widgetNumber, ok := g.nextID()
+	if !ok {
+		return widget{}, errors.New("no more widget ids")
+	}
 
 	isBroken := false
 
-	// current_id is also the widget number that we're on
-	if currentID == g.badWidgetNum {
+	// -k counts widgets from 1 in the order ids are handed out, whatever id the first one had and
+	// whichever producer claims it, so exactly one widget is broken however many producers there are
+	if widgetNumber == g.badWidgetNum {
+		isBroken = true
+	}
+	// -every counts the same way, for a defect that keeps recurring
+	if g.breakEvery > 0 && widgetNumber%g.breakEvery == 0 {
+		isBroken = true
+	}
+	if g.breakAfter > 0 && time.Since(g.started) >= g.breakAfter && g.randomlyBroken.CompareAndSwap(false, true) {
+		fmt.Fprintf(os.Stderr, "Randomly broke widget %d, %s into the run\n", currentID, g.breakAfter)
 		isBroken = true
 	}
 
 	newWidget := widget{id: strconv.Itoa(currentID),
-		source: "Producer_" + strconv.Itoa(producerNumber),
-		time:   time.Now(),
-		broken: isBroken}
+		source:     "Producer_" + strconv.Itoa(producerNumber),
+		producerID: producerNumber,
+		time:       time.Now(),
+		broken:     isBroken}
+	if g.sources != nil {
+		newWidget.source = g.sources.pick(g.rand(producerNumber))
+	}
+
+	if g.payloadSize.max > 0 {
+		rng := g.rand(producerNumber)
+		newWidget.payload = make([]byte, g.payloadSize.size(rng))
+		rng.Read(newWidget.payload)
+	}
+
+	// Typed widgets may also come out broken at random, according to their type's rate
+	if len(g.types) > 0 {
+		widgetType := g.assignType(widgetNumber, producerNumber)
+		newWidget.widgetType = widgetType.name
+		if g.rand(producerNumber).Float64() < widgetType.brokenRate {
+			newWidget.broken = true
+		}
+	}
 
 	return newWidget, nil
 }
 
+// claimWidget takes one of the widgets left for the given producer to produce, reporting false if
+// there are none. The shared count uses compare-and-swap rather than a mutex so producers don't
+// serialize on it; with a per-producer quota, each producer only ever touches its own count.
+func (g *producerGroup) claimWidget(producerNumber int) bool {
+	if g.quotas != nil {
+		if g.quotas[producerNumber-1] <= 0 {
+			return false
+		}
+		g.quotas[producerNumber-1]--
+		return true
+	}
+	for {
+		remaining := g.numOfWidgets.Load()
+		if remaining <= 0 {
+			return false
+		}
+		if g.numOfWidgets.CompareAndSwap(remaining, remaining-1) {
+			return true
+		}
+	}
+}
+
+// nextID takes the next widget id from the allocator, along with the widget's number counting from
+// 1 in the order ids were handed out. Ids that a resumed checkpoint shows were already consumed are
+// passed over. It reports false once the allocator runs out of ids.
+func (g *producerGroup) nextID() (int, int, bool) {
+	for {
+		id, ok := g.ids.Next()
+		if !ok {
+			return 0, 0, false
+		}
+		number := id - g.idStart + 1
+		if _, sequential := g.ids.(sequentialAllocator); !sequential {
+			// The allocator picks its own ids, so advance the counter to keep -k and produced() in step
+			number = int(g.currentID.Add(1)) - g.idStart
+		}
+		if g.checkpoint == nil || !g.checkpoint.done(id) {
+			return id, number, true
+		}
+		g.skipped.Add(1)
+	}
+}
+
+// produced returns the number of widgets produced so far.
+func (g *producerGroup) produced() int {
+	return int(g.currentID.Load()) - g.idStart - int(g.skipped.Load())
+}
+
+// rand returns the random source owned by the given producer. Each producer has its own source,
+// so no locking is needed as long as a producer only uses its own.
+func (g *producerGroup) rand(producerNumber int) *rand.Rand {
+	return g.rngs[producerNumber-1]
+}
+
+// pickRandomBreak chooses where -random-break breaks a widget, using the run's seed so the choice
+// is reproducible. When counting widgets it returns the number of the widget to break, in [1,n].
+// In duration mode, where the count isn't known in advance, it instead returns a point in the run
+// after which the next widget made is broken.
+func pickRandomBreak(cfg config, idStart int) (int, time.Duration) {
+	rng := rand.New(rand.NewSource(cfg.seed))
+	if cfg.duration > 0 {
+		breakAfter := time.Duration(rng.Int63n(int64(cfg.duration))) + 1
+		fmt.Fprintf(os.Stderr, "Randomly breaking the first widget made %s into the run\n", breakAfter)
+		return -1, breakAfter
+	}
+	if cfg.numWidgets < 1 {
+		return -1, 0
+	}
+	number := 1 + rng.Intn(cfg.numWidgets)
+	fmt.Fprintf(os.Stderr, "Randomly breaking widget %d\n", idStart+number-1)
+	return number, 0
+}
+
 // newProducerGroup is a constructor for producer_group to simplify initialization.
-func newProducerGroup(numProducers, numWidgets, kthBadWidget int,
-	widgetChan chan widget, shouldStop *bool, wg *sync.WaitGroup, stopMutex *sync.Mutex) producerGroup {
-	return producerGroup{numberProducers: numProducers,
-		idMutex:                  sync.Mutex{},
+// Producer i's random source is seeded with cfg.seed+i, so a run is reproducible from its seed.
+func newProducerGroup(cfg config, widgetChan chan widget, shouldStop *bool, wg *sync.WaitGroup, stopMutex *sync.Mutex) producerGroup {
+	rngs := make([]*rand.Rand, cfg.numProducers)
+	for i := range rngs {
+		rngs[i] = rand.New(rand.NewSource(cfg.seed + int64(i+1)))
+	}
+	currentID, numOfWidgets := new(atomic.Int64), new(atomic.Int64)
+	idStart := cfg.idStart
+	if idStart == 0 {
+		idStart = 1
+	}
+	currentID.Store(int64(idStart))
+	var ids IDAllocator = sequentialAllocator{next: currentID}
+	if cfg.ids != nil {
+		ids = cfg.ids
+	}
+	numOfWidgets.Store(int64(cfg.numWidgets))
+	badWidgetNum, breakAfter := cfg.kthBadWidget, time.Duration(0)
+	if cfg.randomBreak {
+		badWidgetNum, breakAfter = pickRandomBreak(cfg, idStart)
+	}
+	var quotas []int
+	if cfg.perProducer > 0 {
+		quotas = make([]int, cfg.numProducers)
+		for i := range quotas {
+			quotas[i] = cfg.perProducer
+		}
+	}
+	return producerGroup{numberProducers: cfg.numProducers,
 		producersShouldStop:      shouldStop,
-		currentID:                1,
+		currentID:                currentID,
+		ids:                      ids,
+		quotas:                   quotas,
 		widgetChan:               widgetChan,
-		numOfWidgets:             numWidgets,
-		badWidgetNum:             kthBadWidget,
+		numOfWidgets:             numOfWidgets,
+		badWidgetNum:             badWidgetNum,
+		breakEvery:               cfg.breakEvery,
+		breakAfter:               breakAfter,
+		randomlyBroken:           new(atomic.Bool),
+		idStart:                  idStart,
 		wg:                       wg,
-		producersShouldStopMutex: stopMutex}
+		producersShouldStopMutex: stopMutex,
+		rngs:                     rngs,
+		duration:                 cfg.duration,
+		sendTimeout:              cfg.sendTimeout,
+		batchSize:                cfg.batchSize,
+		types:                    cfg.types,
+		sources:                  cfg.sources,
+		typeAssignment:           cfg.typeAssignment,
+		paused:                   new(atomic.Bool),
+		delays:                   cfg.producerDelays,
+		jitter:                   cfg.jitter,
+		overflow:                 cfg.overflow,
+		tracing:                  cfg.otel != "",
+		metadata:                 cfg.metadata,
+		dropped:                  new(atomic.Int64),
+		madeBy:                   make([]atomic.Int64, cfg.numProducers),
+		alive:                    new(atomic.Int64),
+		rampUp:                   cfg.rampUp,
+		payloadSize:              cfg.payloadSize,
+		skipped:                  new(atomic.Int64),
+		source:                   cfg.source,
+		events:                   cfg.events,
+		ctx:                      cfg.context()}
 }
 
 // CONSUMER LOGIC
@@ -120,119 +542,1299 @@ type consumerGroup struct {
 	wg                       *sync.WaitGroup
 	producersDone            *bool
 	producersShouldStopMutex *sync.Mutex
+	sink                     Sink                        // records every consumed widget
+	output                   widgetWriter                // renders consumed widgets, nil for human-readable text
+	drainTimeout             time.Duration               // how long consumers may drain once production ends, 0 is unlimited
+	drainExpired             chan struct{}               // closed once the drain timeout has passed
+	batchChan                chan []widget               // channel to receive batches from, used instead of widgetChan when batching
+	typeTallies              *typeTallies                // consumption counts by widget type
+	sourceTallies            *typeTallies                // consumption counts by source, only with -sources
+	results                  resultTally                 // widgets taken by consumers, by final result
+	highWater                *highWaterMark              // highest id consumed so far, shared by the group's consumers
+	out                      io.Writer                   // where text output is printed
+	consumed                 *atomic.Int64               // widgets handled so far
+	seenIDs                  *sync.Map                   // ids handled so far, nil unless verifying uniqueness
+	duplicates               *atomic.Int64               // widgets handled whose id had already been seen
+	order                    *orderChecker               // latest widget from each producer, nil unless verifying order
+	reorderWindow            int                         // widgets each consumer holds back to shuffle, 0 disables reordering
+	seed                     int64                       // seed for the consumers' reorder buffers
+	ttl                      time.Duration               // age after which a widget is dropped instead of consumed, 0 never expires
+	expired                  *atomic.Int64               // widgets dropped for being older than ttl
+	handler                  WidgetHandler               // what consumers do with each widget, nil to print it
+	tracer                   *spanExporter               // exports the spans of consumed widgets, nil unless tracing
+	fatal                    *atomic.Pointer[FatalError] // first fatal error from the handler
+	panics                   *atomic.Int64               // times the handler panicked
+	panicPolicy              string                      // whether a handler panic stops the pipeline, see callHandler
+	injector                 *errorInjector              // fails widgets at random before they're handled, nil unless -consumer-error-rate
+	alive                    *atomic.Int64               // consumers still running
+	consumerOffset           int                         // added to consumer numbers, so they're unique across -fanout groups
+	checkpoint               *checkpoint                 // where consumed ids are recorded, nil if not checkpointing
+	brokenID                 *atomic.Pointer[string]     // id of the broken widget that stopped production, if any
+	quiet                    bool                        // whether the default handler only prints broken widgets
+	color                    bool                        // whether the default handler prints broken widgets in red
+	consumerChans            []chan widget               // each consumer's own channel when dispatching by weight, used instead of widgetChan
+	breakerThreshold         int                         // broken widgets dead-lettered before production is stopped, with -breaker-threshold
+	brokenPolicy             BrokenPolicy                // decides whether each broken widget stops production
+	brokenCount              *atomic.Int64               // broken widgets seen
+	window                   *brokenWindow               // whether the most recent widgets consumed were broken, nil without -window
+	deadLettered             *atomic.Int64               // broken widgets set aside while the breaker tolerated them
+	trippedBy                *atomic.Pointer[string]     // id of the first broken widget the policy stopped production for, if any
+	events                   chan<- Event                // observer for lifecycle events, nil to publish none
+	ordered                  *orderedPrinter             // puts the default handler's output in id order, nil to print as consumed
+	latencies                [][]time.Duration           // latency of each widget handled, per consumer, when collected
+	warmup                   int                         // widgets consumed first whose latency isn't collected
+	throttle                 *throttle                   // adjusts consumers' think time toward a target latency, nil without -target-latency
+	acks                     *ackTracker                 // acknowledges widgets handled successfully, with -ack
+	inflight                 chan struct{}               // semaphore shared with the producers, with -maxinflight
+	pills                    *atomic.Int64               // poison pills swallowed, nil unless stopped by pills
+	onStop                   func()                      // also called to stop production, for producers outside the pipeline
+	prefetch                 int                         // widgets a consumer takes from widgetChan at a time, if they're waiting
+	ctx                      context.Context             // cancelled to abandon consumption, and passed to a ContextHandler
 }
 
 func (g *consumerGroup) spawnConsumers() {
+	g.alive.Add(int64(g.numberConsumers))
 	for i := 1; i <= g.numberConsumers; i++ {
-		go g.consume(i)
+		go g.consume(g.consumerOffset + i)
 	}
 }
 
 func (g *consumerGroup) consume(consumerNum int) {
-	// Channel won't be closed, so no need to check for err
 	defer g.wg.Done()
+	defer g.alive.Add(-1)
+
+	var reorder *reorderBuffer
+	if g.reorderWindow > 0 {
+		reorder = newReorderBuffer(g.reorderWindow, g.seed+int64(consumerNum))
+		// Whatever is still held back is handled before the consumer returns
+		defer func() {
+			for _, val := range reorder.drain() {
+				g.handle(val, consumerNum)
+			}
+		}()
+	}
+
+	// With weighted dispatch, each consumer has a channel of its own
+	widgetChan := g.widgetChan
+	if g.consumerChans != nil {
+		widgetChan = g.consumerChans[consumerNum-g.consumerOffset-1]
+	}
+	prefetched := make([]widget, 0, max(1, g.prefetch))
+
+	// Will continue until channel is closed from main, or the drain timeout passes
+	for {
+		// Check the timeout on its own first, so a consumer stops promptly even if widgets remain
+		select {
+		case <-g.drainExpired:
+			return
+		case <-g.ctx.Done():
+			return
+		default:
+		}
+
+		// Only one of widgetChan and batchChan is in use, and a nil channel is never selected
+		select {
+		case val, ok := <-widgetChan:
+			if !ok {
+				return
+			}
+			if val.pill > 0 {
+				g.swallowPill(widgetChan, val)
+				return
+			}
+			g.releaseInFlight()
+			batch, pill, closed := g.prefetchAfter(widgetChan, append(prefetched[:0], val))
+			for _, val := range batch {
+				g.deliver(reorder, val, consumerNum)
+			}
+			if pill.pill > 0 {
+				g.swallowPill(widgetChan, pill)
+				return
+			}
+			if closed {
+				return
+			}
+		case batch, ok := <-g.batchChan:
+			if !ok {
+				return
+			}
+			for _, val := range batch {
+				g.deliver(reorder, val, consumerNum)
+			}
+		case <-g.drainExpired:
+			return
+		case <-g.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliver handles val, first passing it through the consumer's reorder buffer if it has one.
+// Broken widgets skip the buffer, so production is stopped as soon as one arrives.
+func (g *consumerGroup) deliver(reorder *reorderBuffer, val widget, consumerNum int) {
+	if reorder == nil || val.broken {
+		g.handle(val, consumerNum)
+		return
+	}
+	if released, ok := reorder.push(val); ok {
+		g.handle(released, consumerNum)
+	}
+}
+
+// handle outputs and records a single widget.
+func (g *consumerGroup) handle(val widget, consumerNum int) {
+	var taken time.Time
+	if g.tracer != nil {
+		taken = time.Now()
+	}
+	result := g.classify(val)
+	// Tell the handler whether the broken policy set the widget aside
+	val.deadLettered = result == resultDeadLettered
+	if result == resultBroken {
+		// Whatever the handler makes of it, so a custom handler stops production too
+		g.stopForBroken(val)
+	}
+	if result == resultExpired {
+		fmt.Fprintf(os.Stderr, "Consumer_%d dropped expired widget %s\n", consumerNum, val.id)
+		g.expired.Add(1)
+		g.record(val, result, consumerNum)
+		if g.ordered != nil {
+			// Give up its place in the order so later widgets aren't held back
+			g.ordered.put(val, "", false)
+		}
+		return
+	}
+
+	if g.throttle != nil {
+		time.Sleep(g.throttle.delay())
+	}
+	handlerErr := g.callHandler(val, consumerNum)
+	if handlerErr != nil {
+		g.handlerFailed(val, consumerNum, handlerErr)
+		result = resultFailed
+		if g.ordered != nil {
+			// An injected error or a panic may have kept it from taking its place in the order
+			g.ordered.skip(val)
+		}
+	} else {
+		// Widgets that failed aren't checkpointed, so a resumed run tries them again
+		if g.checkpoint != nil {
+			if err := g.checkpoint.record(val.id); err != nil {
+				fmt.Fprintf(os.Stderr, "Consumer_%d couldn't checkpoint widget %s: %v\n", consumerNum, val.id, err)
+			}
+		}
+		if g.acks != nil {
+			g.acks.acks <- val.id
+		}
+	}
+	g.typeTallies.add(val)
+	if g.sourceTallies != nil {
+		g.sourceTallies.add(val)
+	}
+	if g.window != nil {
+		g.window.add(val.broken)
+	}
+	if g.throttle != nil {
+		g.throttle.observe(val.latencyAt(time.Now()))
+	}
+	// Widgets consumed during the warm-up still count, but their latency would skew the percentiles
+	g.highWater.observe(val.id)
+	if consumed := g.consumed.Add(1); g.latencies != nil && consumed > int64(g.warmup) {
+		// Only this consumer touches its own slice, so no lock is needed
+		i := consumerNum - g.consumerOffset - 1
+		g.latencies[i] = append(g.latencies[i], val.latencyAt(time.Now()))
+	}
+	publish(g.events, Event{Type: EventConsumed, Widget: val})
+	if g.seenIDs != nil {
+		if _, seen := g.seenIDs.LoadOrStore(val.id, struct{}{}); seen {
+			fmt.Fprintf(os.Stderr, "DUPLICATE: Consumer_%d received widget id %s more than once\n", consumerNum, val.id)
+			g.duplicates.Add(1)
+			result = resultDuplicate
+		}
+	}
+	g.record(val, result, consumerNum)
+	if g.order != nil {
+		g.verifyOrder(val, consumerNum)
+	}
+	if g.tracer != nil {
+		g.tracer.record(val, consumerNum, taken, time.Now(), handlerErr)
+	}
+}
+
+// record writes val's final result to the sink and tallies it, so the two always agree.
+func (g *consumerGroup) record(val widget, result ResultCode, consumerNum int) {
+	if err := g.sink.Write(val, result); err != nil {
+		fmt.Fprintf(os.Stderr, "Consumer_%d couldn't write widget %s to the sink: %v\n", consumerNum, val.id, err)
+	}
+	g.results.add(result, 1)
+}
+
+// duplicateError reports any duplicate ids found while verifying uniqueness.
+func (g *consumerGroup) duplicateError() error {
+	if n := g.duplicates.Load(); n > 0 {
+		return fmt.Errorf("%d widgets had a duplicate id", n)
+	}
+	return nil
+}
+
+// startDrainTimer starts the drain timeout. It should be called once production has ended and
+// widgetChan has been closed.
+func (g *consumerGroup) startDrainTimer() {
+	if g.drainTimeout > 0 {
+		time.AfterFunc(g.drainTimeout, func() { close(g.drainExpired) })
+	}
+}
+
+// abandonRemaining records every widget left in the closed widgetChan or batchChan as timed out,
+// returning how many there were. It must only be called after all consumers have returned.
+func (g *consumerGroup) abandonRemaining() int {
+	var remaining []widget
+	if g.batchChan != nil {
+		for batch := range g.batchChan {
+			remaining = append(remaining, batch...)
+		}
+	} else if g.pills != nil {
+		// Stopped by pills, the channel is never closed, so only what's buffered remains
+		for len(g.widgetChan) > 0 {
+			if val := <-g.widgetChan; val.pill == 0 {
+				remaining = append(remaining, val)
+			}
+		}
+	} else {
+		for val := range g.widgetChan {
+			remaining = append(remaining, val)
+		}
+	}
+
+	for _, val := range remaining {
+		if err := g.sink.Write(val, resultTimedOut); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write abandoned widget %s to the sink: %v\n", val.id, err)
+		}
+	}
+	g.results.add(resultTimedOut, len(remaining))
+	return len(remaining)
+}
 
-	// Will continue until channel is closed from main
-	for val := range g.widgetChan {
-		consumeStr := g.getConsumeMessage(val, consumerNum)
-		fmt.Printf(consumeStr)
+// classify decides the result recorded for a widget. Every mode's classification belongs here so
+// that a widget's fate is described consistently.
+func (g *consumerGroup) classify(val widget) ResultCode {
+	if g.ttl > 0 && val.latencyAt(time.Now()) > g.ttl {
+		return resultExpired
+	}
+	if val.broken {
+		g.brokenCount.Add(1)
+		// Once production has been stopped, later broken widgets can't be set aside instead
+		if g.trippedBy.Load() == nil && g.brokenPolicy.OnBroken(val) == ActionDeadLetter {
+			g.deadLettered.Add(1)
+			return resultDeadLettered
+		}
+		if g.trippedBy.CompareAndSwap(nil, &val.id) && g.breakerThreshold > 0 {
+			publish(g.events, Event{Type: EventBreakerTripped, Widget: val})
+		}
+		return resultBroken
+	}
+	return resultConsumed
+}
+
+// stopForBroken signals producers to stop because of broken widget w, remembering the first widget
+// to do so.
+func (g *consumerGroup) stopForBroken(w widget) {
+	g.brokenID.CompareAndSwap(nil, &w.id)
+	g.stopProducers()
+}
+
+// stoppedError wraps ErrProductionStopped with the id of the broken widget that stopped
+// production, or is nil if none did.
+func (g *consumerGroup) stoppedError() error {
+	if id := g.brokenID.Load(); id != nil {
+		return fmt.Errorf("%w by broken widget %s", ErrProductionStopped, *id)
+	}
+	return nil
+}
+
+// stopProducers signals producers to stop, and tells whoever owns the channel if they asked.
+func (g *consumerGroup) stopProducers() {
+	requestStop(g.producersShouldStop, g.producersShouldStopMutex)
+	if g.onStop != nil {
+		g.onStop()
 	}
-	return
 }
 
-// getConsumeMessage returns the message that the consumer should print out.
+// getConsumeMessage returns the message that the consumer should print out. A broken widget has
+// already stopped production by then, unless the broken policy set it aside.
 func (g *consumerGroup) getConsumeMessage(val widget, consumerNum int) string {
-	// Default case will only be picked if there's nothing on the channel
 	if val.broken {
-		g.producersShouldStopMutex.Lock()
-		*g.producersShouldStop = true
-		g.producersShouldStopMutex.Unlock()
-		return fmt.Sprintf("%s found a broken widget %s -- stopping production\n", "Consumer_"+strconv.Itoa(consumerNum), val)
+		msg := fmt.Sprintf("%s found a broken widget %s -- stopping production\n", "Consumer_"+strconv.Itoa(consumerNum), val)
+		if val.deadLettered {
+			msg = fmt.Sprintf("%s found a broken widget %s -- dead-lettering it\n", "Consumer_"+strconv.Itoa(consumerNum), val)
+		}
+		if g.color {
+			msg = colorize(msg, ansiRed)
+		}
+		return msg
 	}
-	return fmt.Sprintf("%s consumed %s in %s time\n", "Consumer_"+strconv.Itoa(consumerNum), val, time.Now().Sub(val.time))
+	return fmt.Sprintf("%s consumed %s in %s time\n", "Consumer_"+strconv.Itoa(consumerNum), val, val.latencyAt(time.Now()))
 }
 
 // newConsumerGroup is a constructor to simplify consumer group initialization.
-func newConsumerGroup(numConsumers int, widgetChan chan widget, wg *sync.WaitGroup, shouldStop *bool, stopMutex *sync.Mutex) consumerGroup {
-	return consumerGroup{numberConsumers: numConsumers,
+func newConsumerGroup(cfg config, widgetChan chan widget, wg *sync.WaitGroup, shouldStop *bool, stopMutex *sync.Mutex,
+	sink Sink, output widgetWriter) consumerGroup {
+	var drainExpired chan struct{}
+	if cfg.drainTimeout > 0 {
+		drainExpired = make(chan struct{})
+	}
+	var seenIDs *sync.Map
+	if cfg.verifyUnique {
+		seenIDs = &sync.Map{}
+	}
+	var order *orderChecker
+	if cfg.verifyOrder {
+		order = newOrderChecker()
+	}
+	var window *brokenWindow
+	if cfg.window > 0 {
+		window = newBrokenWindow(cfg.window)
+	}
+	brokenPolicy := cfg.brokenPolicy
+	if brokenPolicy == nil {
+		brokenPolicy = &CircuitBreaker{Threshold: cfg.breakerThreshold}
+	}
+	var throttle *throttle
+	if cfg.targetLatency > 0 {
+		throttle = newThrottle(cfg.targetLatency)
+	}
+	var latencies [][]time.Duration
+	if cfg.report != "" || cfg.sweep != nil || cfg.histogram {
+		latencies = make([][]time.Duration, cfg.numConsumers)
+	}
+	var pills *atomic.Int64
+	if cfg.shutdown == shutdownPill {
+		pills = new(atomic.Int64)
+	}
+	var sourceTallies *typeTallies
+	if cfg.sources != nil {
+		sourceTallies = newSourceTallies()
+	}
+	var injector *errorInjector
+	if cfg.injectErrorRate > 0 {
+		injector = newErrorInjector(cfg.injectErrorRate, cfg.seed, cfg.numConsumers)
+	}
+	return consumerGroup{numberConsumers: cfg.numConsumers,
 		widgetChan:               widgetChan,
 		wg:                       wg,
 		producersShouldStop:      shouldStop,
-		producersShouldStopMutex: stopMutex}
+		producersShouldStopMutex: stopMutex,
+		sink:                     sink,
+		output:                   output,
+		drainTimeout:             cfg.drainTimeout,
+		drainExpired:             drainExpired,
+		typeTallies:              newTypeTallies(),
+		sourceTallies:            sourceTallies,
+		results:                  newResultTally(),
+		highWater:                &highWaterMark{},
+		out:                      cfg.stdout(),
+		consumed:                 new(atomic.Int64),
+		seenIDs:                  seenIDs,
+		duplicates:               new(atomic.Int64),
+		order:                    order,
+		reorderWindow:            cfg.reorderWindow,
+		seed:                     cfg.seed,
+		ttl:                      cfg.ttl,
+		expired:                  new(atomic.Int64),
+		handler:                  cfg.handler,
+		tracer:                   cfg.tracer,
+		fatal:                    new(atomic.Pointer[FatalError]),
+		panics:                   new(atomic.Int64),
+		panicPolicy:              cfg.panicPolicy,
+		injector:                 injector,
+		alive:                    new(atomic.Int64),
+		brokenID:                 new(atomic.Pointer[string]),
+		quiet:                    cfg.quiet,
+		color:                    cfg.format == "text" && useColor(cfg.color, cfg.stdout()),
+		breakerThreshold:         cfg.breakerThreshold,
+		brokenPolicy:             brokenPolicy,
+		brokenCount:              new(atomic.Int64),
+		window:                   window,
+		deadLettered:             new(atomic.Int64),
+		trippedBy:                new(atomic.Pointer[string]),
+		latencies:                latencies,
+		warmup:                   cfg.warmup,
+		prefetch:                 cfg.prefetch,
+		throttle:                 throttle,
+		pills:                    pills,
+		events:                   cfg.events,
+		ctx:                      cfg.context()}
+}
+
+// config holds the tunable parameters for a run of the pipeline.
+type config struct {
+	numWidgets       int
+	numConsumers     int
+	numProducers     int
+	kthBadWidget     int
+	seed             int64                    // seed for all random behavior
+	seedSet          bool                     // whether seed was given on the command line
+	runID            string                   // tags standard error, the report, and exported spans; none if empty
+	runIDSet         bool                     // whether runID was given on the command line
+	mode             string                   // run, or produce/consume to split the pipeline across a socket
+	unixSocket       string                   // path of the Unix domain socket used in produce and consume modes
+	codec            string                   // wire format for widgets sent over a socket
+	forceAfter       time.Duration            // grace period after an interrupt before exiting forcibly, 0 waits indefinitely
+	duration         time.Duration            // if non-zero, produce for this long instead of producing numWidgets widgets
+	sendTimeout      time.Duration            // how long a producer may block sending a widget, 0 is unlimited
+	drainTimeout     time.Duration            // how long consumers may drain once production ends, 0 is unlimited
+	batchSize        int                      // widgets sent over the channel at a time, 1 disables batching
+	types            []widgetType             // kinds of widget to produce, none means untyped widgets
+	typeAssignment   string                   // how types are assigned to widgets, roundrobin or random
+	sources          *sourcePool              // logical sources generated widgets are given, Producer_N if nil
+	admin            string                   // address to serve the admin API on, empty to disable it
+	pprof            string                   // address to serve pprof profiles on, empty to disable it
+	sink             string                   // where consumed widgets are recorded, see openSink
+	format           string                   // output format for consumed widgets, text or csv
+	bufferSize       int                      // capacity of the channel between producers and consumers, -1 sizes it from numWidgets
+	out              io.Writer                // where consumed widgets are printed, os.Stdout if nil
+	verifyUnique     bool                     // whether consumers check that no widget id is seen twice
+	verifyOrder      bool                     // whether consumers check that each producer's widgets arrive in timestamp order
+	reorderWindow    int                      // widgets each consumer holds back and releases in random order, 0 disables it
+	dryRun           bool                     // print the resolved configuration instead of running
+	ttl              time.Duration            // age after which consumers drop a widget instead of consuming it, 0 never expires
+	source           WidgetSource             // where producers take widgets from, generated if nil
+	customSink       Sink                     // records consumed widgets instead of the sink described by sink, if set
+	handler          WidgetHandler            // what consumers do with each widget, printed if nil
+	otel             string                   // OpenTelemetry collector to export each widget's spans to, none if empty
+	metadata         map[string]string        // key/value pairs given to every widget produced
+	tracer           *spanExporter            // exports consumed widgets' spans to otel, set up when the run starts
+	ids              IDAllocator              // hands out generated widgets' ids, sequential from idStart if nil
+	replay           string                   // file sink log to replay instead of generating widgets
+	from             string                   // text file listing the widgets to produce, as id,source,broken lines
+	replayRebase     bool                     // stamp replayed widgets with the current time instead of their recorded one
+	replayPace       string                   // how fast widgets are replayed, fast or real
+	panicPolicy      string                   // what consumers do when the handler panics, continue or abort
+	injectErrorRate  float64                  // fraction of widgets consumers fail at random, as if the handler had
+	prefetch         int                      // widgets a consumer takes from the channel at a time, when that many are waiting
+	drain            bool                     // only count the widgets consumed, as fast as possible, reporting the total and rate
+	producerDelays   []time.Duration          // think time per producer before each widget, cycled over the producers
+	jitter           float64                  // fraction in [0,1) by which each producer delay varies at random either way
+	forward          string                   // TCP address consumers send widgets to instead of printing them
+	listen           string                   // TCP address to receive widgets from a remote producer on, implies consume mode
+	idStart          int                      // id of the first widget, 1 if unset
+	rampUp           time.Duration            // gap between producers starting, 0 starts them all at once
+	payloadSize      sizeRange                // bytes of random payload in each widget, a range picks each widget's at random; 0 for none
+	fanout           int                      // independent consumer groups that each receive every widget
+	checkpoint       string                   // file recording consumed ids, so an interrupted run can be resumed
+	quiet            bool                     // print only broken widgets and a final summary, not every widget consumed
+	progress         bool                     // draw a bar of the widgets consumed out of the total on standard error, if it's a terminal
+	weights          []int                    // relative share of widgets dispatched to each consumer, none to share one channel
+	breakerThreshold int                      // broken widgets tolerated before production is stopped, 0 stops on the first
+	brokenPolicy     BrokenPolicy             // decides what becomes of broken widgets, a breaker per group with breakerThreshold if nil
+	events           chan<- Event             // observer for lifecycle events, sent to without blocking; nil publishes none
+	maxRuntime       time.Duration            // give up on a run that takes longer than this, 0 is unlimited
+	ordered          bool                     // print consumed widgets in id order rather than as they're consumed
+	dedup            bool                     // pass on only the first widget with each id between producers and consumers
+	report           string                   // path to write a JSON report of the run to, none if empty
+	sweep            *sweepGrid               // combinations of options to benchmark a run of each, nil for a single run
+	sweepBudget      time.Duration            // how long a sweep may take in all, 0 is unlimited
+	warmup           int                      // widgets consumed first that are left out of the report's latencies
+	histogram        bool                     // print a histogram of latencies once the run ends
+	histogramBuckets []time.Duration          // latencies to split the histogram's buckets at, auto-scaled if none
+	showVersion      bool                     // print build information and exit
+	strict           bool                     // treat warnings about the configuration as errors
+	perProducer      int                      // widgets each producer makes, instead of numWidgets shared between them; 0 shares
+	randomBreak      bool                     // break one widget chosen at random from the seed, instead of the kth
+	breakEvery       int                      // break every widget whose sequence number is a multiple of this, 0 for none
+	stdin            bool                     // read the widget count, or specs of the widgets to produce, from standard input
+	splitBy          string                   // built-in classifier splitting the sink into a file per category, none if empty
+	classify         Classifier               // splits the sink into a file per category, overriding splitBy; nil for one sink
+	ack              bool                     // have consumers acknowledge widgets and report any never acknowledged
+	maxInFlight      int                      // widgets that may be made but not yet received by a consumer, 0 is unlimited
+	reportInterval   time.Duration            // how often to log the widgets consumed so far, 0 disables it
+	window           int                      // recent widgets consumed whose broken ratio is tracked, 0 tracks none
+	targetLatency    time.Duration            // latency consumers' think time is adjusted toward, 0 disables think time
+	shutdown         string                   // how consumers learn production has finished, shutdownClose or shutdownPill
+	overflow         string                   // what producers do when the channel is full: block, drop-oldest, or drop-newest
+	color            string                   // when to print broken widgets in red: auto, always, or never
+	multiprocess     bool                     // run the producers in a child process, connected over a Unix domain socket
+	childArgs        []string                 // with multiprocess, the options given to the producers' process
+	listening        func(net.Listener) error // called once consume mode is listening, e.g. to start its producer; nil if not needed
+	exit             func(code int)           // how an interrupt forces the process to exit, os.Exit if nil
+	ctx              context.Context          // cancelled to abandon the run at once, e.g. by -maxruntime; never if nil
+}
+
+// defaultConfig returns the configuration used for any option not given on the command line.
+func defaultConfig() config {
+	return config{numProducers: 1, numConsumers: 1, numWidgets: 10, kthBadWidget: -1, batchSize: 1, bufferSize: -1,
+		idStart: 1, typeAssignment: assignRoundRobin, fanout: 1, mode: "run", codec: codecNDJSON, format: "text",
+		shutdown: shutdownClose, overflow: overflowBlock, color: colorAuto, replayPace: replayPaceFast,
+		panicPolicy: panicContinue, prefetch: 1}
+}
+
+// defaultBufferLimit is the most widgets the channel holds unless -buffer says otherwise.
+const defaultBufferLimit = 100000
+
+// channelBuffer returns the capacity of the channel between producers and consumers. Unless set
+// explicitly, it has room for every widget when their number is known up front, so producers
+// never wait on consumers for a typical run, up to defaultBufferLimit so a big run doesn't
+// allocate room for all of them. When the number isn't known, it's defaultBufferLimit.
+func (cfg config) channelBuffer() int {
+	if cfg.bufferSize >= 0 {
+		return cfg.bufferSize
+	}
+	if cfg.duration > 0 || cfg.replay != "" || cfg.from != "" || cfg.mode == "consume" {
+		return defaultBufferLimit
+	}
+	return min(cfg.numWidgets, defaultBufferLimit)
+}
+
+// classifier returns what splits the sink by category, nil if it isn't split.
+func (cfg config) classifier() Classifier {
+	if cfg.classify != nil {
+		return cfg.classify
+	}
+	return classifiers[cfg.splitBy]
+}
+
+// stdout returns where consumed widgets are printed.
+func (cfg config) stdout() io.Writer {
+	if cfg.out == nil {
+		return os.Stdout
+	}
+	return cfg.out
+}
+
+// context returns the context whose cancellation abandons the run.
+func (cfg config) context() context.Context {
+	if cfg.ctx == nil {
+		return context.Background()
+	}
+	return cfg.ctx
+}
+
+// forceExit returns how an interrupt forces the process to exit.
+func (cfg config) forceExit() func(code int) {
+	if cfg.exit == nil {
+		return os.Exit
+	}
+	return cfg.exit
 }
 
 // parseArgs parses command line arguments and returns quantities for tunable parameters.
 func parseArgs(arguments []string) (numWidg, numCons, numProd, kthBadWidg int, err error) {
+	cfg, err := parseConfig(arguments)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	return cfg.numWidgets, cfg.numConsumers, cfg.numProducers, cfg.kthBadWidget, nil
+}
+
+// newFlagSet defines the command line options of command (run, produce, consume, or drain), storing
+// parsed values into cfg. The values already in cfg are the defaults. Each command only has the
+// options that apply to it; without a command every option is defined, along with -mode.
+func newFlagSet(cfg *config, command string) *flag.FlagSet {
+	name := "widgets"
+	if command != "" {
+		name += " " + command
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Func("seed", "seed for all random behavior (default: picked from the clock)", func(value string) error {
+		var err error
+		cfg.seed, err = strconv.ParseInt(value, 10, 64)
+		cfg.seedSet = true
+		return err
+	})
+	flags.Func("run-id", "tag every line on standard error, the report, and exported spans with `id`, or with none if empty (default: a random UUID)", func(value string) error {
+		cfg.runID, cfg.runIDSet = value, true
+		return nil
+	})
+	flags.StringVar(&cfg.unixSocket, "unix-socket", cfg.unixSocket, "`path` of the Unix domain socket used in produce and consume modes")
+	flags.StringVar(&cfg.codec, "codec", cfg.codec, "wire format for widgets sent over a socket, ndjson or binary")
+	flags.IntVar(&cfg.bufferSize, "buffer", cfg.bufferSize, "capacity of the channel between producers and consumers, -1 sizes it from -n")
+	flags.StringVar(&cfg.admin, "admin", cfg.admin, "`address` to serve the admin API on")
+	flags.StringVar(&cfg.otel, "otel", cfg.otel, "OpenTelemetry collector `endpoint` to export each widget's production and consumption spans to, e.g. http://localhost:4318")
+	flags.StringVar(&cfg.pprof, "pprof", cfg.pprof, "`address` to serve net/http/pprof profiles on while running, e.g. :6060")
+	flags.DurationVar(&cfg.forceAfter, "force-after", cfg.forceAfter, "grace period after an interrupt before exiting forcibly, 0 waits indefinitely")
+	flags.BoolVar(&cfg.dryRun, "dryrun", cfg.dryRun, "print the resolved configuration and exit without producing widgets")
+	flags.BoolVar(&cfg.strict, "strict", cfg.strict, "treat warnings about the configuration as errors, refusing to run")
+	flags.BoolVar(&cfg.showVersion, "version", cfg.showVersion, "print the version, commit, and Go version of this build and exit")
+	if command != "consume" && command != "drain" {
+		flags.Var(widgetCount{cfg}, "n", "`number` of widgets to produce, or - to read the count or widget specs from standard input")
+		flags.Var(widgetCount{cfg}, "num-widgets", "long form of -n")
+		flags.IntVar(&cfg.numProducers, "p", cfg.numProducers, "number of producers")
+		flags.IntVar(&cfg.numProducers, "num-producers", cfg.numProducers, "long form of -p")
+		flags.IntVar(&cfg.kthBadWidget, "k", cfg.kthBadWidget, "sequence number of the broken widget, counting from 1, or -1 for none")
+		flags.IntVar(&cfg.kthBadWidget, "kth-bad-widget", cfg.kthBadWidget, "long form of -k")
+		flags.BoolVar(&cfg.randomBreak, "random-break", cfg.randomBreak, "break one widget picked at random (from -seed) instead of the -k th")
+		flags.IntVar(&cfg.breakEvery, "every", cfg.breakEvery, "break every `n`th widget, counting as -k does, instead of the -k th; 0 for none")
+		flags.IntVar(&cfg.perProducer, "perproducer", cfg.perProducer, "widgets each producer makes, instead of -n shared between them")
+		flags.IntVar(&cfg.idStart, "idstart", cfg.idStart, "id of the first widget, so separate runs can use non-overlapping ids")
+		flags.DurationVar(&cfg.duration, "duration", cfg.duration, "produce for this long instead of producing -n widgets")
+		flags.Func("types", "kinds of widget to produce, as `name=rate,...`", func(value string) error {
+			var err error
+			cfg.types, err = parseTypes(value)
+			return err
+		})
+		flags.Func("meta", "metadata given to every widget produced, as `key=value,...`", func(value string) error {
+			var err error
+			cfg.metadata, err = parseMetadata(value)
+			return err
+		})
+		flags.Func("sources", "give generated widgets a source picked from a pool, as `name=weight,...` (weight 1 if left out)", func(value string) error {
+			var err error
+			cfg.sources, err = parseSources(value)
+			return err
+		})
+		flags.StringVar(&cfg.typeAssignment, "type-assign", cfg.typeAssignment, "how types are assigned to widgets, roundrobin or random")
+		flags.Func("payloadsize", "bytes of random payload carried by each widget, or `min-max` to pick each widget's size at random (default 0)", func(value string) error {
+			var err error
+			cfg.payloadSize, err = parseSizeRange(value)
+			return err
+		})
+		flags.DurationVar(&cfg.rampUp, "rampup", cfg.rampUp, "gap between producers starting, 0 starts them all at once")
+		flags.DurationVar(&cfg.sendTimeout, "sendtimeout", cfg.sendTimeout, "how long a producer may block sending a widget, 0 is unlimited")
+		flags.StringVar(&cfg.replay, "replay", cfg.replay, "replay the widgets recorded in a file sink `log` instead of generating them")
+		flags.StringVar(&cfg.from, "from", cfg.from, "produce the widgets listed in a text `file`, one id,source,broken line each")
+		flags.BoolVar(&cfg.replayRebase, "replay-rebase", cfg.replayRebase, "stamp replayed widgets with the time they are replayed")
+		flags.StringVar(&cfg.replayPace, "replay-pace", cfg.replayPace, "how fast widgets are replayed: fast, or real to keep the recorded gaps between them")
+		flags.Func("producerdelays", "think time before each widget, per producer, as `delay,...` (cycled if there are more producers)", func(value string) error {
+			var err error
+			cfg.producerDelays, err = parseDurations(value)
+			return err
+		})
+		flags.Func("jitter", "vary each -producerdelays delay at random by up to this `fraction` either way, e.g. 20% or 0.2", func(value string) error {
+			var err error
+			cfg.jitter, err = parseFraction(value)
+			return err
+		})
+	}
+	if command != "produce" {
+		flags.IntVar(&cfg.numConsumers, "c", cfg.numConsumers, "number of consumers")
+		flags.IntVar(&cfg.numConsumers, "num-consumers", cfg.numConsumers, "long form of -c")
+		flags.IntVar(&cfg.breakerThreshold, "breaker-threshold", cfg.breakerThreshold, "dead-letter up to `n` broken widgets before stopping production")
+		flags.StringVar(&cfg.sink, "sink", cfg.sink, "where consumed widgets are recorded, file:<path> or sqlite:<path>")
+		flags.StringVar(&cfg.splitBy, "split-by", cfg.splitBy, "record widgets in a sink per category, by id parity or type")
+		flags.BoolVar(&cfg.quiet, "quiet", cfg.quiet, "only print broken widgets and a final summary")
+		flags.StringVar(&cfg.color, "color", cfg.color, "print broken widgets in red: auto (only to a terminal), always, or never")
+		flags.StringVar(&cfg.format, "format", cfg.format, "output format for consumed widgets, text, csv, or protobuf")
+		flags.BoolVar(&cfg.verifyUnique, "verify-unique", cfg.verifyUnique, "check that no widget id is consumed twice")
+		flags.BoolVar(&cfg.verifyOrder, "verify-order", cfg.verifyOrder, "check that each producer's widgets arrive in the order they were made")
+		flags.IntVar(&cfg.reorderWindow, "reorder-window", cfg.reorderWindow, "widgets each consumer holds back and releases in random order")
+		flags.DurationVar(&cfg.ttl, "ttl", cfg.ttl, "age after which a widget is dropped instead of consumed, 0 never expires")
+		flags.DurationVar(&cfg.reportInterval, "report-interval", cfg.reportInterval, "how often to log the widgets consumed so far and their rate, 0 disables it")
+		flags.IntVar(&cfg.window, "window", cfg.window, "track how many of the last `n` widgets consumed were broken, 0 tracks none")
+		flags.IntVar(&cfg.prefetch, "prefetch", cfg.prefetch, "widgets a consumer takes from the channel at a time, if they're already waiting")
+		flags.StringVar(&cfg.panicPolicy, "panic-policy", cfg.panicPolicy, "when a handler panics, continue with the next widget or abort the run")
+		flags.Func("consumer-error-rate", "fail this `fraction` of widgets at random in consumers, as if the handler had, e.g. 1% or 0.01", func(value string) error {
+			var err error
+			cfg.injectErrorRate, err = parseFraction(value)
+			return err
+		})
+		flags.DurationVar(&cfg.targetLatency, "target-latency", cfg.targetLatency, "adjust consumers' think time to keep latency near this, 0 disables think time")
+	}
+	if command == "" || command == "run" {
+		flags.Func("weights", "dispatch widgets to each consumer in proportion to `weight,...`, one weight per consumer", func(value string) error {
+			var err error
+			cfg.weights, err = parseWeights(value)
+			return err
+		})
+		flags.IntVar(&cfg.fanout, "fanout", cfg.fanout, "independent groups of -c consumers that each receive every widget")
+		flags.IntVar(&cfg.batchSize, "batchsize", cfg.batchSize, "widgets sent over the channel at a time")
+		flags.DurationVar(&cfg.drainTimeout, "draintimeout", cfg.drainTimeout, "how long consumers may drain once production ends, 0 is unlimited")
+		flags.Func("sweep", "benchmark a run for each combination in a `grid` like p=1,4/c=1,4/buffer=0,1000, printing a table", func(value string) error {
+			var err error
+			cfg.sweep, err = parseSweepGrid(value)
+			return err
+		})
+		flags.DurationVar(&cfg.sweepBudget, "sweep-budget", cfg.sweepBudget, "how long a -sweep may take in all, 0 is unlimited")
+		flags.DurationVar(&cfg.maxRuntime, "maxruntime", cfg.maxRuntime, "give up on a run that takes longer than this, reporting a likely deadlock; 0 is unlimited")
+		flags.IntVar(&cfg.maxInFlight, "maxinflight", cfg.maxInFlight, "most widgets that may be made but not yet taken by a consumer, 0 is unlimited")
+		flags.BoolVar(&cfg.ack, "ack", cfg.ack, "have consumers acknowledge each widget handled and report any sent but never acknowledged")
+		flags.BoolVar(&cfg.progress, "progress", cfg.progress, "draw a progress bar on standard error, if it's a terminal; quiet if standard output is one too")
+		flags.BoolVar(&cfg.ordered, "ordered", cfg.ordered, "print consumed widgets in ascending id order")
+		flags.BoolVar(&cfg.dedup, "dedup", cfg.dedup, "suppress widgets whose id was already produced, so consumers see each id at most once")
+		flags.StringVar(&cfg.shutdown, "shutdown", cfg.shutdown, "how consumers are stopped once production ends: close the channel, or send a poison pill")
+		flags.BoolVar(&cfg.multiprocess, "multiprocess", cfg.multiprocess, "run the producers in a child process, connected to the consumers over a Unix domain socket")
+		flags.StringVar(&cfg.overflow, "overflow", cfg.overflow, "what producers do when the buffer is full: block, drop-oldest, or drop-newest")
+		flags.StringVar(&cfg.report, "report", cfg.report, "write a JSON report of the run to `file` once it ends")
+		flags.BoolVar(&cfg.histogram, "histogram", cfg.histogram, "print a histogram of latencies once the run ends")
+		flags.Func("histogram-buckets", "split the -histogram into buckets at `latency,...`, e.g. 1ms,5ms,20ms (default: scaled to the latencies)", func(value string) error {
+			var err error
+			cfg.histogramBuckets, err = parseHistogramBuckets(value)
+			return err
+		})
+		flags.IntVar(&cfg.warmup, "warmup", cfg.warmup, "leave the first `n` widgets consumed out of the report's latencies")
+		flags.StringVar(&cfg.forward, "forward", cfg.forward, "send consumed widgets to the TCP endpoint at `host:port` instead of printing them")
+		flags.StringVar(&cfg.checkpoint, "checkpoint", cfg.checkpoint, "record consumed ids in `file`, and resume from it if it exists")
+	}
+	if command == "drain" {
+		flags.StringVar(&cfg.replay, "replay", cfg.replay, "drain the widgets recorded in a file sink `log`")
+	}
+	if command == "" || command == "consume" || command == "drain" {
+		flags.StringVar(&cfg.listen, "listen", cfg.listen, "run only consumers, receiving widgets from a remote -forward on TCP `address`")
+	}
+	if command == "" {
+		flags.StringVar(&cfg.mode, "mode", cfg.mode, "run, or produce/consume to split the pipeline across a socket")
+	}
+	return flags
+}
+
+// printPlan describes the run cfg would perform.
+func printPlan(out io.Writer, cfg config) {
+	fmt.Fprintf(out, "Mode:           %s\n", cfg.mode)
+	fmt.Fprintf(out, "Producers:      %d\n", cfg.numProducers)
+	fmt.Fprintf(out, "Consumers:      %d\n", cfg.numConsumers)
+	if cfg.replay != "" {
+		fmt.Fprintf(out, "Widgets:        replayed from %s\n", cfg.replay)
+	} else if cfg.from != "" {
+		fmt.Fprintf(out, "Widgets:        listed in %s\n", cfg.from)
+	} else if cfg.duration > 0 {
+		fmt.Fprintf(out, "Widgets:        as many as can be made in %s\n", cfg.duration)
+	} else {
+		fmt.Fprintf(out, "Widgets:        %d\n", cfg.numWidgets)
+	}
+	if cfg.breakEvery > 0 {
+		fmt.Fprintf(out, "Broken widget:  every %d\n", cfg.breakEvery)
+	} else if cfg.kthBadWidget >= 0 {
+		fmt.Fprintf(out, "Broken widget:  %d\n", cfg.kthBadWidget)
+	} else {
+		fmt.Fprintf(out, "Broken widget:  none\n")
+	}
+	fmt.Fprintf(out, "First id:       %d\n", cfg.idStart)
+	fmt.Fprintf(out, "Channel buffer: %d widgets\n", cfg.channelBuffer())
+	fmt.Fprintf(out, "Batch size:     %d\n", cfg.batchSize)
+	if cfg.seedSet {
+		fmt.Fprintf(out, "Seed:           %d\n", cfg.seed)
+	} else {
+		fmt.Fprintf(out, "Seed:           picked from the clock\n")
+	}
+	if cfg.runID != "" {
+		fmt.Fprintf(out, "Run id:         %s\n", cfg.runID)
+	}
+}
+
+// commands are the subcommands that may be given before any options.
+var commands = []string{"run", "produce", "consume", "drain"}
+
+// splitCommand separates the subcommand, if any, from the options that follow it.
+func splitCommand(arguments []string) (string, []string) {
+	if len(arguments) > 0 && slices.Contains(commands, arguments[0]) {
+		return arguments[0], arguments[1:]
+	}
+	return "", arguments
+}
+
+// printUsage describes the options of the command given in arguments, and their defaults.
+func printUsage(out io.Writer, arguments []string) {
+	command, _ := splitCommand(arguments)
+	cfg := defaultConfig()
+	flags := newFlagSet(&cfg, command)
+	flags.SetOutput(out)
+	if command == "" {
+		fmt.Fprintln(out, "Usage: go run . [run|produce|consume|drain] [options]")
+		fmt.Fprintln(out, "Without a command, every option is accepted and -mode picks what to run.")
+	} else {
+		fmt.Fprintf(out, "Usage: go run . %s [options]\n", command)
+	}
+	flags.PrintDefaults()
+}
 
-	// If we don't have an even number of arguments, things haven't been paired up correctly, so panic.
-	if len(arguments)%2 != 0 {
-		return 0, 0, 0, 0, errors.New("invalid number of options")
+// parseConfig parses command line arguments into a config. They may start with a command (run,
+// produce, consume, or drain), which stands in for -mode and accepts only its own options. It returns
+// flag.ErrHelp if -help was asked for.
+func parseConfig(arguments []string) (config, error) {
+	cfg := defaultConfig()
+	command, arguments := splitCommand(arguments)
+	if command != "" {
+		cfg.mode = command
+	}
+	flags := newFlagSet(&cfg, command)
+	flags.SetOutput(io.Discard) // the caller decides whether to print usage
+	if err := flags.Parse(arguments); err != nil {
+		return config{}, err
+	}
+	if flags.NArg() > 0 {
+		return config{}, errors.New("unexpected argument " + flags.Arg(0))
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if command == "drain" {
+		var err error
+		if cfg, err = drainPreset(cfg, set); err != nil {
+			return config{}, err
+		}
 	}
 
-	// Default values
-	numProducers, numConsumers, numWidgets, kthBadWidget := 1, 1, 10, -1
+	if cfg.perProducer < 0 {
+		return config{}, errors.New("widgets per producer can't be negative")
+	}
+	if cfg.perProducer > 0 {
+		if set["n"] || set["num-widgets"] {
+			return config{}, errors.New("-perproducer and -n can't both be given")
+		}
+		if cfg.duration > 0 || cfg.checkpoint != "" || cfg.replay != "" {
+			return config{}, errors.New("-perproducer can't be combined with -duration, -checkpoint, or -replay")
+		}
+		cfg.numWidgets = cfg.perProducer * cfg.numProducers
+	}
 
-	for len(arguments) > 0 {
-		option := arguments[0]
-		quantity, err := strconv.Atoi(arguments[1])
+	if cfg.numProducers < 1 || cfg.numConsumers < 1 {
+		return config{}, errors.New("there must be at least one producer and one consumer")
+	}
+	if cfg.numWidgets < 0 {
+		return config{}, errors.New("number of widgets can't be negative")
+	}
+	// -duration, -replay, -from, and -n - each decide how many widgets there are, so only a plain
+	// count has to be positive, and consumers in consume mode don't produce at all
+	if cfg.numWidgets == 0 && cfg.duration == 0 && cfg.replay == "" && cfg.from == "" && !cfg.stdin && cfg.mode != "consume" && cfg.listen == "" {
+		return config{}, errors.New("-n 0 would produce nothing; give a positive number of widgets, or -duration to produce for a fixed time instead")
+	}
+	if cfg.kthBadWidget == 0 || cfg.kthBadWidget < -1 {
+		return config{}, errors.New("-k counts widgets from 1, or is -1 for no broken widget")
+	}
+	if cfg.randomBreak && (cfg.kthBadWidget != -1 || cfg.replay != "") {
+		return config{}, errors.New("-random-break can't be combined with -k or -replay")
+	}
+	if cfg.from != "" && (cfg.kthBadWidget != -1 || cfg.randomBreak || cfg.breakEvery > 0 || cfg.duration > 0 || cfg.replay != "" ||
+		cfg.stdin || cfg.perProducer > 0 || cfg.checkpoint != "") {
+		return config{}, errors.New("-from says which widgets are broken, so can't be combined with -k, -random-break, or -every, nor with -duration, -replay, -n -, -perproducer, or -checkpoint")
+	}
+	if cfg.stdin && (cfg.duration > 0 || cfg.replay != "" || cfg.checkpoint != "") {
+		return config{}, errors.New("-n - can't be combined with -duration, -replay, or -checkpoint")
+	}
+	if !(cfg.jitter >= 0 && cfg.jitter < 1) {
+		return config{}, errors.New("jitter must be at least 0 and less than 100%")
+	}
+	if cfg.jitter > 0 && len(cfg.producerDelays) == 0 {
+		return config{}, errors.New("-jitter varies -producerdelays, so needs them")
+	}
+	if cfg.breakEvery < 0 {
+		return config{}, errors.New("-every can't be negative")
+	}
+	if cfg.breakEvery > 0 && (cfg.kthBadWidget != -1 || cfg.randomBreak || cfg.replay != "") {
+		return config{}, errors.New("-every can't be combined with -k, -random-break, or -replay")
+	}
+	if cfg.typeAssignment != assignRoundRobin && cfg.typeAssignment != assignRandom {
+		return config{}, errors.New("invalid type assignment " + cfg.typeAssignment)
+	}
+	if cfg.batchSize < 1 {
+		return config{}, errors.New("batch size must be at least 1")
+	}
+	if cfg.bufferSize < -1 {
+		return config{}, errors.New("buffer size can't be negative")
+	}
+	if cfg.reorderWindow < 0 {
+		return config{}, errors.New("reorder window can't be negative")
+	}
+	if cfg.reportInterval < 0 {
+		return config{}, errors.New("report interval can't be negative")
+	}
+	if cfg.fanout < 1 {
+		return config{}, errors.New("fanout must be at least 1")
+	}
+	if cfg.fanout > 1 && (cfg.batchSize > 1 || cfg.drainTimeout > 0 || cfg.mode != "run" || cfg.listen != "") {
+		return config{}, errors.New("-fanout can't be combined with -batchsize, -draintimeout, or socket modes")
+	}
+	if cfg.checkpoint != "" && (cfg.duration > 0 || cfg.replay != "" || cfg.mode != "run" || cfg.listen != "") {
+		return config{}, errors.New("-checkpoint can't be combined with -duration, -replay, or socket modes")
+	}
+	if cfg.weights != nil {
+		if len(cfg.weights) != cfg.numConsumers {
+			return config{}, fmt.Errorf("%d weights given for %d consumers", len(cfg.weights), cfg.numConsumers)
+		}
+		if cfg.batchSize > 1 || cfg.drainTimeout > 0 || cfg.fanout > 1 || cfg.mode != "run" || cfg.listen != "" {
+			return config{}, errors.New("-weights can't be combined with -batchsize, -draintimeout, -fanout, or socket modes")
+		}
+	}
+	if cfg.maxInFlight < 0 {
+		return config{}, errors.New("max in-flight widgets can't be negative")
+	}
+	if cfg.maxInFlight > 0 && (cfg.batchSize > 1 || cfg.fanout > 1 || cfg.mode != "run" || cfg.listen != "") {
+		return config{}, errors.New("-maxinflight can't be combined with -batchsize, -fanout, or socket modes")
+	}
+	if cfg.ack && (cfg.fanout > 1 || cfg.mode != "run" || cfg.listen != "") {
+		return config{}, errors.New("-ack can't be combined with -fanout or socket modes")
+	}
+	if cfg.ordered && (cfg.fanout > 1 || cfg.checkpoint != "" || cfg.replay != "" || cfg.mode != "run" || cfg.listen != "") {
+		return config{}, errors.New("-ordered can't be combined with -fanout, -checkpoint, -replay, or socket modes")
+	}
+	if cfg.shutdown != shutdownClose && cfg.shutdown != shutdownPill {
+		return config{}, errors.New("unknown shutdown " + cfg.shutdown + ", expected close or pill")
+	}
+	if cfg.shutdown == shutdownPill && (cfg.batchSize > 1 || cfg.fanout > 1 || cfg.weights != nil || cfg.mode != "run" || cfg.listen != "") {
+		return config{}, errors.New("-shutdown pill can't be combined with -batchsize, -fanout, -weights, or socket modes")
+	}
+	switch cfg.overflow {
+	case overflowBlock:
+	case overflowDropOldest, overflowDropNewest:
+		if cfg.channelBuffer() == 0 {
+			return config{}, errors.New("-overflow " + cfg.overflow + " needs a buffer to overflow, but -buffer is 0")
+		}
+		if cfg.batchSize > 1 || cfg.maxInFlight > 0 || cfg.ack || cfg.sendTimeout > 0 || cfg.mode != "run" || cfg.listen != "" {
+			return config{}, errors.New("-overflow " + cfg.overflow + " can't be combined with -batchsize, -maxinflight, -ack, -sendtimeout, or socket modes")
+		}
+	default:
+		return config{}, errors.New("unknown overflow policy " + cfg.overflow + ", expected block, drop-oldest, or drop-newest")
+	}
+	if cfg.sweep != nil && (cfg.report != "" || cfg.sink != "" || cfg.checkpoint != "" || cfg.weights != nil || cfg.multiprocess || cfg.format == "protobuf" || cfg.mode != "run" || cfg.listen != "") {
+		return config{}, errors.New("-sweep can't be combined with -report, -sink, -checkpoint, -weights, -multiprocess, -format protobuf, or socket modes")
+	}
+	if cfg.sweepBudget < 0 {
+		return config{}, errors.New("sweep budget can't be negative")
+	}
+	if cfg.sweepBudget > 0 && cfg.sweep == nil {
+		return config{}, errors.New("-sweep-budget limits a sweep, so needs -sweep")
+	}
+	if cfg.sources != nil && (cfg.replay != "" || cfg.from != "") {
+		return config{}, errors.New("-sources names the sources of generated widgets, so can't be combined with -replay or -from")
+	}
+	if cfg.progress && (cfg.duration > 0 || cfg.replay != "" || cfg.from != "" || cfg.reportInterval > 0) {
+		return config{}, errors.New("-progress needs a widget count, so can't be combined with -duration, -replay, or -from, nor with -report-interval")
+	}
+	if cfg.dedup && (cfg.batchSize > 1 || cfg.multiprocess || cfg.mode != "run" || cfg.listen != "") {
+		return config{}, errors.New("-dedup sits between producers and consumers in one process, so can't be combined with -batchsize, -multiprocess, or socket modes")
+	}
+	if cfg.prefetch < 1 {
+		return config{}, errors.New("prefetch must be at least 1")
+	}
+	if cfg.prefetch > 1 && cfg.batchSize > 1 {
+		return config{}, errors.New("-prefetch can't be combined with -batchsize, which already receives widgets in bulk")
+	}
+	if !(cfg.injectErrorRate >= 0 && cfg.injectErrorRate <= 1) {
+		return config{}, errors.New("consumer error rate must be between 0 and 100%")
+	}
+	if cfg.panicPolicy != panicContinue && cfg.panicPolicy != panicAbort {
+		return config{}, errors.New("unknown panic policy " + cfg.panicPolicy + ", expected continue or abort")
+	}
+	switch cfg.replayPace {
+	case replayPaceFast:
+	case replayPaceReal:
+		if cfg.replay == "" {
+			return config{}, errors.New("-replay-pace real paces a replay, so needs -replay")
+		}
+	default:
+		return config{}, errors.New("unknown replay pace " + cfg.replayPace + ", expected fast or real")
+	}
+	if cfg.verifyOrder && (cfg.numConsumers > 1 || cfg.reorderWindow > 0 || cfg.replay != "" || cfg.stdin) {
+		return config{}, errors.New("-verify-order needs a single consumer, and can't be combined with -reorder-window, -replay, or -n -")
+	}
+	if cfg.window < 0 {
+		return config{}, errors.New("window can't be negative")
+	}
+	if cfg.targetLatency < 0 {
+		return config{}, errors.New("target latency can't be negative")
+	}
+	if cfg.otel != "" {
+		if _, err := otelEndpoint(cfg.otel); err != nil {
+			return config{}, err
+		}
+	}
+	if cfg.histogramBuckets != nil && !cfg.histogram {
+		return config{}, errors.New("-histogram-buckets splits the -histogram, so needs it")
+	}
+	if cfg.warmup < 0 {
+		return config{}, errors.New("warm-up can't be negative")
+	}
+	if err := parseColorMode(cfg.color); err != nil {
+		return config{}, err
+	}
+	if cfg.breakerThreshold < 0 {
+		return config{}, errors.New("breaker threshold can't be negative")
+	}
+	if cfg.idStart < 1 {
+		return config{}, errors.New("ids must start at 1 or more")
+	}
 
-		// If the string after the option can't be converted to an integer, panic.
+	if cfg.multiprocess {
+		if cfg.mode != "run" {
+			return config{}, errors.New("-multiprocess is only supported in run mode")
+		}
+		childArgs, err := checkMultiprocess(arguments)
 		if err != nil {
-			return 0, 0, 0, 0, errors.New("can't convert quantity to integer")
-		}
-
-		switch option {
-		case "-n":
-			numWidgets = quantity
-		case "-c":
-			numConsumers = quantity
-		case "-p":
-			numProducers = quantity
-		case "-k":
-			kthBadWidget = quantity
-		default:
-			return 0, 0, 0, 0, errors.New("invalid option")
+			return config{}, err
 		}
+		cfg.childArgs = childArgs
+	}
+
+	// Listening for a remote producer means only running consumers
+	if cfg.listen != "" {
+		if cfg.mode == "produce" {
+			return config{}, errors.New("-listen can't be used with -mode produce")
+		}
+		cfg.mode = "consume"
+	}
 
-		// Move the argument list over by two, so to the next optoin and integer pair
-		arguments = arguments[2:]
+	switch cfg.mode {
+	case "run":
+	case "produce", "consume":
+		if cfg.unixSocket == "" && cfg.listen == "" {
+			return config{}, errors.New("-mode " + cfg.mode + " requires -unix-socket")
+		}
+		if cfg.batchSize > 1 {
+			return config{}, errors.New("-batchsize is only supported in run mode")
+		}
+		if cfg.forward != "" {
+			return config{}, errors.New("-forward is only supported in run mode")
+		}
+		if cfg.maxRuntime > 0 {
+			return config{}, errors.New("-maxruntime is only supported in run mode")
+		}
+		if cfg.report != "" {
+			return config{}, errors.New("-report is only supported in run mode")
+		}
+	default:
+		return config{}, errors.New("invalid mode " + cfg.mode)
+	}
+	if cfg.codec != codecNDJSON && cfg.codec != codecBinary {
+		return config{}, errors.New("invalid codec " + cfg.codec)
+	}
+	if cfg.format != "text" && cfg.format != "csv" && cfg.format != "protobuf" {
+		return config{}, errors.New("invalid format " + cfg.format)
+	}
+	if _, ok := classifiers[cfg.splitBy]; cfg.splitBy != "" && !ok {
+		return config{}, errors.New("invalid split " + cfg.splitBy + ", expected parity or type")
+	}
+	if cfg.splitBy != "" && cfg.sink == "" {
+		return config{}, errors.New("-split-by needs a -sink to split")
 	}
 
-	return numWidgets, numConsumers, numProducers, kthBadWidget, nil
+	return cfg, nil
 }
 
-func max(a, b int) int {
-	if a > b {
-		return a
+// stopRequested reports whether production has been signaled to stop.
+func stopRequested(shouldStop *bool, stopMutex *sync.Mutex) bool {
+	stopMutex.Lock()
+	defer stopMutex.Unlock()
+	return *shouldStop
+}
+
+// requestStop signals production to stop.
+func requestStop(shouldStop *bool, stopMutex *sync.Mutex) {
+	stopMutex.Lock()
+	*shouldStop = true
+	stopMutex.Unlock()
+}
+
+// Exit statuses, so that scripts and CI can tell how a run ended.
+const (
+	exitOK           = 0   // every widget was produced and consumed
+	exitFailed       = 1   // the run failed for any reason not listed here
+	exitUsage        = 2   // the arguments or standard input were invalid
+	exitBroken       = 3   // a broken widget stopped production
+	exitDrainTimeout = 4   // widgets were left unconsumed when the drain timed out
+	exitInterrupted  = 130 // a second interrupt, or the -force-after grace period, cut shutdown short
+)
+
+// exitCode maps how a run ended to the status the process exits with. A broken widget takes
+// precedence over a drain timeout, since it's why the run ended early.
+func exitCode(result Result, err error) int {
+	switch {
+	case errors.Is(err, ErrProductionStopped):
+		return exitBroken
+	case err != nil:
+		return exitFailed
+	case result.Abandoned > 0:
+		return exitDrainTimeout
 	}
-	return b
+	return exitOK
 }
 
 func main() {
-	numWidgets, numConsumers, numProducers, kthBadWidget, err := parseArgs(os.Args[1:])
+	cfg, err := parseConfig(os.Args[1:])
+
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage(os.Stdout, os.Args[1:])
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printUsage(os.Stderr, os.Args[1:])
+		os.Exit(exitUsage)
+	}
+
+	if cfg.showVersion {
+		printVersion(os.Stdout)
+		return
+	}
+	// Once standard error is tagged it's no longer a terminal, so the progress bar is decided first
+	cfg.progress = cfg.progress && showProgress(os.Stderr)
+	if cfg.progress && showProgress(os.Stdout) {
+		// A line per widget would scroll the bar away
+		cfg.quiet = true
+	}
+	exit := os.Exit
+	if !cfg.runIDSet {
+		cfg.runID = newRunID()
+	}
+	if cfg.runID != "" {
+		untag, err := tagStderr(cfg.runID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Can't tag standard error with the run id:", err)
+			os.Exit(exitUsage)
+		}
+		exit = func(code int) {
+			untag()
+			os.Exit(code)
+		}
+	}
+	// A forced exit still has to flush what was written to standard error
+	cfg.exit = exit
 
+	if cfg.stdin {
+		if err := readStdin(&cfg, os.Stdin); err != nil {
+			fmt.Fprintln(os.Stderr, "Can't read widgets from standard input:", err)
+			exit(exitUsage)
+		}
+	}
+	warnings, err := validateRunnable(cfg)
+	for _, warning := range warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", warning)
+	}
 	if err != nil {
-		panic("Invalid arguments! The format is: go run main.go [-n <integer> ][-p <integer> ][-c <integer> ][-k <integer> ], where brackets denote an optional argument.")
+		fmt.Fprintln(os.Stderr, err)
+		exit(exitUsage)
+	}
+	if cfg.dryRun {
+		printPlan(os.Stdout, cfg)
+		exit(exitOK)
+	}
+
+	// Without an explicit seed, pick one and report it so the run can be replayed.
+	if !cfg.seedSet {
+		cfg.seed = time.Now().UnixNano()
+		fmt.Fprintf(os.Stderr, "Using seed %d (rerun with -seed %d to reproduce)\n", cfg.seed, cfg.seed)
+	}
+
+	// The first interrupt stops production gracefully, a second one exits immediately
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	var result Result
+	switch cfg.mode {
+	case "produce":
+		err = produceToSocket(cfg, signals)
+	case "consume":
+		result, err = consumeFromSocket(cfg, signals)
+	default:
+		if cfg.multiprocess {
+			result, err = runMultiprocess(cfg, signals)
+			break
+		}
+		if cfg.sweep != nil {
+			err = runSweep(cfg, signals)
+			break
+		}
+		start := time.Now()
+		result, err = RunPipeline(cfg, signals)
+		if cfg.drain {
+			reportDrained(os.Stdout, result.Consumed, result.Elapsed)
+		} else if cfg.quiet {
+			fmt.Printf("Produced %d widgets and consumed %d in %s\n", result.Produced, result.Consumed, result.Elapsed)
+		}
+		// The report is written however the run ended, so an early stop is on record too
+		if cfg.report != "" {
+			if reportErr := writeReport(cfg.report, cfg, os.Args[1:], start, result, err); reportErr != nil {
+				err = errors.Join(err, fmt.Errorf("can't write report: %w", reportErr))
+			}
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	exit(exitCode(result, err))
+}
+
+// reportDuration reports how many widgets were produced once a duration mode run's producers have stopped.
+func reportDuration(cfg config, g *producerGroup) {
+	if cfg.duration > 0 {
+		fmt.Fprintf(os.Stderr, "Produced %d widgets in %s\n", g.produced(), cfg.duration)
+	}
+}
+
+// reportProducerRates reports each producer's throughput when producers were given different
+// delays, to show the skew.
+func reportProducerRates(cfg config, g *producerGroup) {
+	if len(cfg.producerDelays) == 0 {
+		return
+	}
+	elapsed := time.Since(g.started)
+	for i := range g.madeBy {
+		made := g.madeBy[i].Load()
+		fmt.Fprintf(os.Stderr, "Producer_%d made %d widgets (%.1f/s)\n", i+1, made, float64(made)/elapsed.Seconds())
 	}
-	widgetChan := make(chan widget, max(100000, numWidgets))
+}
 
-	// https://stackoverflow.com/questions/19208725/example-for-sync-waitgroup-correct
-	var producerWG sync.WaitGroup
-	producerWG.Add(numProducers)
+// parseFraction parses a fraction given either as a percentage, like "20%", or a number, like "0.2".
+func parseFraction(value string) (float64, error) {
+	number, percent := strings.CutSuffix(value, "%")
+	fraction, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, errors.New("parse error")
+	}
+	if percent {
+		fraction /= 100
+	}
+	return fraction, nil
+}
 
-	var consumerWG sync.WaitGroup
-	consumerWG.Add(numConsumers)
+// parseDurations parses a comma separated list of durations, like "0,5ms,10ms".
+func parseDurations(list string) ([]time.Duration, error) {
+	var durations []time.Duration
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	for _, entry := range strings.Split(list, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		if d < 0 {
+			return nil, errors.New("delays can't be negative")
+		}
+		durations = append(durations, d)
+	}
+	return durations, nil
+}
 
-	producersShouldStopMutex := sync.Mutex{}
-	producersShouldStop := false
+// reportAbandoned reports any widgets the consumers didn't get to before the drain timeout, and
+// returns how many there were.
+func reportAbandoned(cfg config, g *consumerGroup) int {
+	abandoned := g.abandonRemaining()
+	if abandoned > 0 {
+		fmt.Fprintf(os.Stderr, "Drain timed out after %s -- %d widgets left unconsumed\n", cfg.drainTimeout, abandoned)
+	}
+	return abandoned
+}
 
-	producerGroup := newProducerGroup(numProducers, numWidgets, kthBadWidget, widgetChan, &producersShouldStop, &producerWG, &producersShouldStopMutex)
-	consumerGroup := newConsumerGroup(numConsumers, widgetChan, &consumerWG, &producersShouldStop, &producersShouldStopMutex)
+// reportExpired reports how many widgets were dropped for exceeding the ttl, and returns the count.
+func reportExpired(cfg config, g *consumerGroup) int {
+	expired := int(g.expired.Load())
+	if expired > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d widgets older than the %s ttl\n", expired, cfg.ttl)
+	}
+	return expired
+}
 
-	producerGroup.spawnProducers()
-	consumerGroup.spawnConsumers()
+// reportBreaker reports what became of the circuit breaker, returning how many broken widgets
+// were dead-lettered.
+func reportBreaker(cfg config, g *consumerGroup) int {
+	deadLettered := int(g.deadLettered.Load())
+	if cfg.breakerThreshold == 0 {
+		return deadLettered
+	}
+	if id := g.trippedBy.Load(); id != nil {
+		fmt.Fprintf(os.Stderr, "Circuit breaker tripped at broken widget %s after dead-lettering %d\n", *id, deadLettered)
+	} else {
+		fmt.Fprintf(os.Stderr, "Circuit breaker didn't trip: dead-lettered %d of %d tolerated broken widgets\n", deadLettered, cfg.breakerThreshold)
+	}
+	return deadLettered
+}
 
-	producerWG.Wait() // Will wait until all producers exit
-	close(widgetChan) // Signal consumers to return
-	consumerWG.Wait()
+// finishConsumers flushes the output and closes the sink once all consumers have returned.
+func finishConsumers(output widgetWriter, sink Sink) error {
+	var err error
+	if output != nil {
+		err = output.Flush()
+	}
+	if closeErr := closeSink(sink); err == nil {
+		err = closeErr
+	}
+	return err
 }
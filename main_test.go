@@ -1,7 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"os/exec"
 	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -17,14 +31,14 @@ func TestProducers(t *testing.T) {
 
 	shouldStopMutex := sync.Mutex{}
 
-	producerGroup := newProducerGroup(numProducers, numWidgets, kthBadWidget, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	producerGroup := newProducerGroup(config{numProducers: numProducers, numWidgets: numWidgets, kthBadWidget: kthBadWidget}, widgetChan, &shouldStop, &wg, &shouldStopMutex)
 
 	// Initial widget, should be normal
 	w, _ := producerGroup.getWidget(1)
-	if w.source != "Producer_1" || w.broken != false || w.id != "1" {
+	if w.source != "Producer_1" || w.producerID != 1 || w.broken != false || w.id != "1" {
 		t.Errorf("First widget is incorrect: %s", w)
 	}
-	if producerGroup.currentID != 2 {
+	if producerGroup.currentID.Load() != 2 {
 		t.Errorf("Did not increment id")
 	}
 
@@ -40,13 +54,13 @@ func TestProducers(t *testing.T) {
 		t.Errorf("Error isn't nil")
 	}
 
-	if producerGroup.numOfWidgets != 0 {
+	if producerGroup.numOfWidgets.Load() != 0 {
 		t.Errorf("Number of widgets remaining not decremented correctly")
 	}
 
 	shouldStop = true
 	// Test with should stop being true
-	producerGroup2 := newProducerGroup(numProducers, numWidgets, kthBadWidget, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	producerGroup2 := newProducerGroup(config{numProducers: numProducers, numWidgets: numWidgets, kthBadWidget: kthBadWidget}, widgetChan, &shouldStop, &wg, &shouldStopMutex)
 	_, err4 := producerGroup2.getWidget(1)
 	if err4 == nil {
 		t.Errorf("getWidget not heeding stop signals correctly")
@@ -62,25 +76,106 @@ func TestConsumers(t *testing.T) {
 	shouldStop := false
 	shouldStopMutex := sync.Mutex{}
 
-	consumerGroup := newConsumerGroup(numConsumers, widgetChan, &wg, &shouldStop, &shouldStopMutex)
+	consumerGroup := newConsumerGroup(config{numConsumers: numConsumers}, widgetChan, &wg, &shouldStop, &shouldStopMutex, noopSink{}, nil)
 
-	var validNormalWidget = regexp.MustCompile(`^Consumer_1 consumed \[id=[0-9]* source=Producer_[0-9]* time=[0-9]*:[0-9]*:[0-9]*.[0-9]* broken=false] in .* time`)
-	var validBrokenWidget = regexp.MustCompile(`^Consumer_1 found a broken widget \[id=[0-9]* source=Producer_[0-9]* time=[0-9]*:[0-9]*:[0-9]*.[0-9]* broken=true] -- stopping production`)
+	var validNormalWidget = regexp.MustCompile(`^Consumer_1 consumed \[id=[0-9]* source=Producer_[0-9]* time=[0-9]{2}:[0-9]{2}:[0-9]{2}\.[0-9]{9} broken=false] in .* time`)
+	var validBrokenWidget = regexp.MustCompile(`^Consumer_1 found a broken widget \[id=[0-9]* source=Producer_[0-9]* time=[0-9]{2}:[0-9]{2}:[0-9]{2}\.[0-9]{9} broken=true] -- stopping production`)
 
 	// Test normal widget consumption
-	widgetStr := consumerGroup.getConsumeMessage(widget{"1", "Producer_1", time.Now(), false}, 1)
+	widgetStr := consumerGroup.getConsumeMessage(widget{id: "1", source: "Producer_1", producerID: 1, time: time.Now(), broken: false}, 1)
 	if !validNormalWidget.MatchString(widgetStr) {
 		t.Errorf("getConsumeMessage has incorrect behavior on initial widget")
 	}
 
-	// Test broken widget consumption
-	widgetStr2 := consumerGroup.getConsumeMessage(widget{"1", "Producer_1", time.Now(), true}, 1)
-	if !validBrokenWidget.MatchString(widgetStr2) || shouldStop != true {
+	// Test broken widget consumption, which only describes the widget; handle is what stops production
+	widgetStr2 := consumerGroup.getConsumeMessage(widget{id: "1", source: "Producer_1", producerID: 1, time: time.Now(), broken: true}, 1)
+	if !validBrokenWidget.MatchString(widgetStr2) || shouldStop {
 		t.Errorf("getConsumeMesage not recognizing broken widgets")
 	}
 
 }
 
+func TestWidgetLatency(t *testing.T) {
+	// A widget sent over a channel keeps its monotonic clock reading
+	widgetChan := make(chan widget, 1)
+	widgetChan <- widget{id: "1", time: time.Now()}
+	w := <-widgetChan
+	if !strings.Contains(w.time.String(), "m=") {
+		t.Errorf("Widget lost its monotonic clock reading crossing a channel: %s", w.time)
+	}
+	if latency := w.latencyAt(time.Now()); latency < 0 {
+		t.Errorf("Negative latency %s", latency)
+	}
+
+	// Decoding only recovers the wall clock, which may have been set back since
+	var buf bytes.Buffer
+	enc, _ := newWidgetEncoder(codecNDJSON, &buf)
+	enc.Encode(widget{id: "2", time: time.Now().Add(time.Hour)})
+	dec, _ := newWidgetDecoder(codecNDJSON, &buf)
+	decoded, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(decoded.time.String(), "m=") {
+		t.Errorf("Decoded widget unexpectedly has a monotonic clock reading: %s", decoded.time)
+	}
+	if latency := decoded.latencyAt(time.Now()); latency != 0 {
+		t.Errorf("Latency of a widget from the future was %s, expected it clamped to 0", latency)
+	}
+	consumerGroup := newConsumerGroup(config{numConsumers: 1}, nil, nil, new(bool), &sync.Mutex{}, noopSink{}, nil)
+	if message := consumerGroup.getConsumeMessage(decoded, 1); !strings.HasSuffix(message, " in 0s time\n") {
+		t.Errorf("Unexpected message for a widget from the future: %s", message)
+	}
+}
+
+func TestWidgetString(t *testing.T) {
+	w := widget{id: "7", source: "Producer_2", producerID: 2, time: time.Date(2019, 8, 1, 9, 5, 3, 12345, time.UTC), broken: false}
+	expected := "[id=7 source=Producer_2 time=09:05:03.000012345 broken=false]"
+	if w.String() != expected {
+		t.Errorf("Widget rendered as %s, expected %s", w, expected)
+	}
+
+	// Only the payload's length is shown
+	w.payload = []byte("%s some bytes")
+	expected = "[id=7 source=Producer_2 time=09:05:03.000012345 broken=false payload=13B]"
+	if w.String() != expected {
+		t.Errorf("Widget rendered as %s, expected %s", w, expected)
+	}
+
+	// Metadata is rendered in key order
+	w.metadata = map[string]string{"region": "us", "env": "prod"}
+	expected = "[id=7 source=Producer_2 time=09:05:03.000012345 broken=false payload=13B metadata={env=prod,region=us}]"
+	if w.String() != expected {
+		t.Errorf("Widget rendered as %s, expected %s", w, expected)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	widgetChan := make(chan widget)
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	cfg := config{numProducers: 1, numWidgets: 2, kthBadWidget: -1, payloadSize: sizeRange{1024, 1024}}
+	producerGroup := newProducerGroup(cfg, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	w1, _ := producerGroup.getWidget(1)
+	w2, _ := producerGroup.getWidget(1)
+	if len(w1.payload) != 1024 || len(w2.payload) != 1024 {
+		t.Fatalf("Payloads are %d and %d bytes, expected 1024", len(w1.payload), len(w2.payload))
+	}
+	if string(w1.payload) == string(w2.payload) {
+		t.Errorf("Payloads aren't random")
+	}
+
+	// Payloads survive the trip over a socket
+	var buf bytes.Buffer
+	enc, _ := newWidgetEncoder(codecBinary, &buf)
+	enc.Encode(w1)
+	dec, _ := newWidgetDecoder(codecBinary, &buf)
+	if decoded, err := dec.Decode(); err != nil || !bytes.Equal(decoded.payload, w1.payload) {
+		t.Errorf("Payload not preserved by the codec: %v", err)
+	}
+}
+
 func TestInput(t *testing.T) {
 	// Odd number of arguments
 	args := []string{"-c", "10", "-a"}
@@ -89,6 +184,26 @@ func TestInput(t *testing.T) {
 		t.Errorf("Odd number of arguments not handled correctly")
 	}
 
+	// Defaults
+	numWidgets, numCons, numProd, kthBadWidg, err := parseArgs(nil)
+	if numWidgets != 10 || numCons != 1 || numProd != 1 || kthBadWidg != -1 || err != nil {
+		t.Errorf("Default arguments not being handled correctly")
+	}
+
+	// Help, and stray arguments that aren't options
+	if _, err = parseConfig([]string{"--help"}); !errors.Is(err, flag.ErrHelp) {
+		t.Errorf("Help not requested by --help: %v", err)
+	}
+	if _, err = parseConfig([]string{"-n", "5", "7"}); err == nil {
+		t.Errorf("Stray argument not rejected")
+	}
+
+	// Switches take no value
+	cfg, err := parseConfig([]string{"-verify-unique", "-n", "5"})
+	if !cfg.verifyUnique || cfg.numWidgets != 5 || err != nil {
+		t.Errorf("Switch not being handled correctly")
+	}
+
 	// Bad option
 	args = []string{"-z", "10"}
 	_, _, _, _, err2 := parseArgs(args)
@@ -105,9 +220,935 @@ func TestInput(t *testing.T) {
 
 	// Good arguments
 	args = []string{"-c", "10", "-n", "9993", "-p", "19", "-k", "5"}
-	numWidgets, numCons, numProd, kthBadWidg, err4 := parseArgs(args)
-	if numWidgets != 9993 || numCons != 10 || numProd != 19 || kthBadWidg != 5 || err4 != nil {
+	numWidgets, numCons, numProd, kthBadWidg, err = parseArgs(args)
+	if numWidgets != 9993 || numCons != 10 || numProd != 19 || kthBadWidg != 5 || err != nil {
 		t.Errorf("Good command line arguments not being handled correctly")
 	}
 
+	// Long forms and = syntax
+	numWidgets, numCons, numProd, kthBadWidg, err = parseArgs([]string{"--num-widgets=12", "--num-consumers", "3", "-p=4", "--kth-bad-widget=-1"})
+	if numWidgets != 12 || numCons != 3 || numProd != 4 || kthBadWidg != -1 || err != nil {
+		t.Errorf("Long form arguments not being handled correctly")
+	}
+	cfg, err = parseConfig([]string{"--types=gizmo=0.5", "--verify-unique=false", "--seed", "3"})
+	if len(cfg.types) != 1 || cfg.types[0].brokenRate != 0.5 || cfg.verifyUnique || cfg.seed != 3 || err != nil {
+		t.Errorf("Values containing = not being handled correctly")
+	}
+	if _, err = parseConfig([]string{"--num-gizmos=3"}); err == nil || !strings.Contains(err.Error(), "num-gizmos") {
+		t.Errorf("Unknown long option not rejected clearly: %v", err)
+	}
+
+	// Seed
+	cfg, err5 := parseConfig([]string{"-seed", "-42"})
+	if cfg.seed != -42 || !cfg.seedSet || err5 != nil {
+		t.Errorf("Seed not being handled correctly")
+	}
+
+	// Durations
+	cfg, err6 := parseConfig([]string{"-force-after", "1500ms"})
+	if cfg.forceAfter != 1500*time.Millisecond || err6 != nil {
+		t.Errorf("Force-after duration not being handled correctly")
+	}
+	_, err7 := parseConfig([]string{"-force-after", "10"})
+	if err7 == nil {
+		t.Errorf("Duration without a unit not rejected")
+	}
+
+}
+
+func TestCommands(t *testing.T) {
+	valid := map[string][]string{
+		"run":     {"run", "-n", "5", "-ordered"},
+		"produce": {"produce", "-unix-socket", "/tmp/w.sock", "-n", "5", "-p", "2"},
+		"consume": {"consume", "-listen", "127.0.0.1:0", "-c", "3"},
+	}
+	for mode, args := range valid {
+		if cfg, err := parseConfig(args); err != nil || cfg.mode != mode {
+			t.Errorf("%v parsed as mode %q: %v", args, cfg.mode, err)
+		}
+	}
+
+	// Each command only accepts its own options
+	for _, args := range [][]string{
+		{"produce", "-unix-socket", "/tmp/w.sock", "-c", "3"},
+		{"consume", "-unix-socket", "/tmp/w.sock", "-n", "5"},
+		{"run", "-listen", "127.0.0.1:0"},
+		{"run", "-mode", "produce"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v not rejected", args)
+		}
+	}
+
+	// Without a command, -mode still works
+	if cfg, err := parseConfig([]string{"-mode", "produce", "-unix-socket", "/tmp/w.sock"}); err != nil || cfg.mode != "produce" {
+		t.Errorf("-mode produce parsed as mode %q: %v", cfg.mode, err)
+	}
+
+	var out bytes.Buffer
+	printUsage(&out, []string{"consume", "-help"})
+	if usage := out.String(); !strings.Contains(usage, "go run . consume") || !strings.Contains(usage, "-listen") || strings.Contains(usage, "-num-widgets") {
+		t.Errorf("Unexpected usage for consume:\n%s", usage)
+	}
+}
+
+// FuzzParseArgs checks that any arguments, separated by NUL bytes, either parse to usable values
+// or are rejected with an error, and never cause a panic.
+func FuzzParseArgs(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"-n\x005",
+		"-c\x0010\x00-a",
+		"-n",
+		"--num-widgets=7\x00-k\x003",
+		"-p\x00-1",
+		"-c\x000",
+		"-weights\x001,2\x00-c\x002",
+		"produce\x00-unix-socket\x00/tmp/w.sock",
+		"-types\x00gizmo=0.5,gadget",
+		"-n\x009999999999999999999999",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, joined string) {
+		var args []string
+		if joined != "" {
+			args = strings.Split(joined, "\x00")
+		}
+		numWidgets, numCons, numProd, kthBadWidg, err := parseArgs(args)
+		if err != nil {
+			return
+		}
+		if numWidgets < 0 || numCons < 1 || numProd < 1 || (kthBadWidg != -1 && kthBadWidg < 1) {
+			t.Errorf("%q parsed to n=%d c=%d p=%d k=%d without an error", args, numWidgets, numCons, numProd, kthBadWidg)
+		}
+	})
+}
+
+func TestDryRun(t *testing.T) {
+	cfg, err := parseConfig([]string{"-dryrun", "-n", "500", "-p", "3", "-c", "2", "-k", "7", "-buffer", "64"})
+	if err != nil || !cfg.dryRun {
+		t.Fatalf("Dry run not parsed: %v", err)
+	}
+	var out strings.Builder
+	printPlan(&out, cfg)
+	for _, line := range []string{"Producers:      3\n", "Consumers:      2\n", "Widgets:        500\n", "Broken widget:  7\n", "Channel buffer: 64 widgets\n"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Plan is missing %q:\n%s", line, out.String())
+		}
+	}
+
+	// Invalid configurations are still rejected
+	if _, err := parseConfig([]string{"-dryrun", "-batchsize", "0"}); err == nil {
+		t.Errorf("Invalid configuration accepted in a dry run")
+	}
+}
+
+func TestSeed(t *testing.T) {
+	widgetChan := make(chan widget)
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+
+	group1 := newProducerGroup(config{numProducers: 2, numWidgets: 10, kthBadWidget: -1, seed: 7}, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	group2 := newProducerGroup(config{numProducers: 2, numWidgets: 10, kthBadWidget: -1, seed: 7}, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+
+	// The same seed must give every producer the same sequence
+	for producer := 1; producer <= 2; producer++ {
+		for i := 0; i < 5; i++ {
+			if group1.rand(producer).Int63() != group2.rand(producer).Int63() {
+				t.Errorf("Producer %d random sequence not reproducible from seed", producer)
+			}
+		}
+	}
+
+	// Producers must not share a sequence
+	group3 := newProducerGroup(config{numProducers: 2, numWidgets: 10, kthBadWidget: -1, seed: 7}, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	if group3.rand(1).Int63() == group3.rand(2).Int63() {
+		t.Errorf("Producers share a random sequence")
+	}
+}
+
+func TestDuration(t *testing.T) {
+	numProducers := 2
+	duration := 50 * time.Millisecond
+	widgetChan := make(chan widget, 100)
+	var wg sync.WaitGroup
+	wg.Add(numProducers)
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+
+	// The widget count must be ignored in duration mode
+	producerGroup := newProducerGroup(config{numProducers: numProducers, numWidgets: 1, kthBadWidget: -1, duration: duration}, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+
+	consumed := 0
+	drained := make(chan struct{})
+	go func() {
+		for range widgetChan {
+			consumed++
+		}
+		close(drained)
+	}()
+
+	start := time.Now()
+	producerGroup.spawnProducers()
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(widgetChan)
+	<-drained
+
+	if elapsed < duration {
+		t.Errorf("Producers stopped after %s, before the %s duration", elapsed, duration)
+	}
+	if producerGroup.produced() <= 1 || producerGroup.produced() != consumed {
+		t.Errorf("Produced %d widgets and consumed %d, expected continuous production", producerGroup.produced(), consumed)
+	}
+	if _, err := producerGroup.getWidget(1); err == nil {
+		t.Errorf("getWidget still producing after the deadline")
+	}
+}
+
+func TestZeroWidgets(t *testing.T) {
+	// A count of 0 only makes sense when something else decides how many widgets there are
+	if _, err := parseConfig([]string{"-n", "0"}); err == nil || !strings.Contains(err.Error(), "-duration") {
+		t.Errorf("-n 0 in count mode gave %v, expected an error pointing to -duration", err)
+	}
+	for _, args := range [][]string{
+		{"-n", "0", "-duration", "20ms"},
+		{"-n", "0", "-replay", "widgets.jsonl"},
+		{"-mode", "consume", "-unix-socket", "widgets.sock", "-n", "0"},
+		{"-n", "0", "-listen", ":0"},
+	} {
+		if _, err := parseConfig(args); err != nil {
+			t.Errorf("%v rejected: %v", args, err)
+		}
+	}
+
+	// The count is ignored in duration mode, so producers carry on past it
+	cfg, err := parseConfig([]string{"-n", "0", "-duration", "20ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Produced == 0 || result.Consumed != result.Produced {
+		t.Errorf("-n 0 -duration 20ms produced %d and consumed %d widgets: %v", result.Produced, result.Consumed, err)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	numConsumers := 2
+	numWidgets := 100
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+
+	for _, drainTimeout := range []time.Duration{0, time.Nanosecond} {
+		widgetChan := make(chan widget, numWidgets)
+		for i := 1; i <= numWidgets; i++ {
+			widgetChan <- widget{id: strconv.Itoa(i), source: "Producer_1", producerID: 1, time: time.Now(), broken: false}
+		}
+		close(widgetChan)
+
+		var wg sync.WaitGroup
+		wg.Add(numConsumers)
+		sink := &recordingSink{results: make(map[string]ResultCode)}
+		consumerGroup := newConsumerGroup(config{numConsumers: numConsumers, drainTimeout: drainTimeout}, widgetChan, &wg, &shouldStop, &shouldStopMutex, sink, csvDiscard(t))
+
+		// Let the timeout pass before consumers start, so none of the buffered widgets get consumed
+		consumerGroup.startDrainTimer()
+		time.Sleep(10 * time.Millisecond)
+		consumerGroup.spawnConsumers()
+		wg.Wait()
+		abandoned := consumerGroup.abandonRemaining()
+
+		if drainTimeout == 0 && abandoned != 0 {
+			t.Errorf("Widgets abandoned without a drain timeout")
+		}
+		if drainTimeout > 0 && abandoned != numWidgets {
+			t.Errorf("Expected all %d widgets abandoned after the drain timeout, got %d", numWidgets, abandoned)
+		}
+		for id, result := range sink.results {
+			if (drainTimeout > 0) != (result == resultTimedOut) {
+				t.Errorf("Widget %s recorded as %s with drain timeout %s", id, result, drainTimeout)
+			}
+		}
+		if len(sink.results) != numWidgets {
+			t.Errorf("Expected %d records, got %d", numWidgets, len(sink.results))
+		}
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	numProducers := 3
+	widgetChan := make(chan widget) // unbuffered, and nobody is consuming
+	var wg sync.WaitGroup
+	wg.Add(numProducers)
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+
+	producerGroup := newProducerGroup(config{numProducers: numProducers, numWidgets: 10, kthBadWidget: -1, sendTimeout: 20 * time.Millisecond}, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	producerGroup.spawnProducers()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Producers still blocked with no consumers")
+	}
+}
+
+func TestBatching(t *testing.T) {
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+
+	// Batches fill up to the batch size and the last partial batch is still sent
+	var wg sync.WaitGroup
+	wg.Add(2)
+	batchChan := make(chan []widget, 10)
+	producerGroup := newProducerGroup(config{numProducers: 2, numWidgets: 10, kthBadWidget: -1, batchSize: 4}, nil, &shouldStop, &wg, &shouldStopMutex)
+	producerGroup.batchChan = batchChan
+	producerGroup.spawnProducers()
+	wg.Wait()
+	close(batchChan)
+
+	seen := make(map[string]bool)
+	for batch := range batchChan {
+		if len(batch) == 0 || len(batch) > 4 {
+			t.Errorf("Batch of %d widgets sent with batch size 4", len(batch))
+		}
+		for _, w := range batch {
+			seen[w.id] = true
+		}
+	}
+	if len(seen) != 10 {
+		t.Errorf("Expected 10 widgets across all batches, got %d", len(seen))
+	}
+
+	// A broken widget ends its batch early so the stop signal isn't held back
+	wg.Add(1)
+	batchChan = make(chan []widget, 10)
+	producerGroup = newProducerGroup(config{numProducers: 1, numWidgets: 10, kthBadWidget: 3, batchSize: 8}, nil, &shouldStop, &wg, &shouldStopMutex)
+	producerGroup.batchChan = batchChan
+	producerGroup.spawnProducers()
+	wg.Wait()
+	close(batchChan)
+	first := <-batchChan
+	if len(first) != 3 || !first[2].broken {
+		t.Errorf("Batch with broken widget 3 not sent early: %v", first)
+	}
+
+	// Consumers handle the whole batch and signal the stop
+	wg.Add(1)
+	batchChan = make(chan []widget, 1)
+	sink := &recordingSink{results: make(map[string]ResultCode)}
+	consumerGroup := newConsumerGroup(config{numConsumers: 1}, nil, &wg, &shouldStop, &shouldStopMutex, sink, csvDiscard(t))
+	consumerGroup.batchChan = batchChan
+	consumerGroup.spawnConsumers()
+	batchChan <- first
+	close(batchChan)
+	wg.Wait()
+	if len(sink.results) != 3 || sink.results["3"] != resultBroken || !shouldStop {
+		t.Errorf("Batch with a broken widget not consumed correctly: %v", sink.results)
+	}
+}
+
+func TestExactWidgetCount(t *testing.T) {
+	numProducers := 50
+	numWidgets := 5000
+	widgetChan := make(chan widget, numWidgets)
+	var wg sync.WaitGroup
+	wg.Add(numProducers)
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+
+	producerGroup := newProducerGroup(config{numProducers: numProducers, numWidgets: numWidgets, kthBadWidget: -1}, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	producerGroup.spawnProducers()
+	wg.Wait()
+	close(widgetChan)
+
+	// Every id from 1 to numWidgets exactly once, no more
+	seen := make(map[string]bool)
+	for w := range widgetChan {
+		if seen[w.id] {
+			t.Errorf("Widget %s produced twice", w.id)
+		}
+		seen[w.id] = true
+	}
+	for i := 1; i <= numWidgets; i++ {
+		if !seen[strconv.Itoa(i)] {
+			t.Errorf("Widget %d never produced", i)
+		}
+	}
+	if len(seen) != numWidgets || producerGroup.produced() != numWidgets {
+		t.Errorf("Expected exactly %d widgets, got %d", numWidgets, len(seen))
+	}
+}
+
+func TestJitter(t *testing.T) {
+	for value, expected := range map[string]float64{"20%": 0.2, "0.2": 0.2, "0": 0, "99.5%": 0.995} {
+		cfg, err := parseConfig([]string{"-producerdelays", "1ms", "-jitter", value})
+		if err != nil || math.Abs(cfg.jitter-expected) > 1e-9 {
+			t.Errorf("-jitter %s parsed as %v: %v", value, cfg.jitter, err)
+		}
+	}
+	for _, args := range [][]string{
+		{"-producerdelays", "1ms", "-jitter", "100%"},
+		{"-producerdelays", "1ms", "-jitter", "-0.1"},
+		{"-producerdelays", "1ms", "-jitter", "NaN"},
+		{"-producerdelays", "1ms", "-jitter", "twenty"},
+		{"-jitter", "20%"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v not rejected", args)
+		}
+	}
+
+	// Delays stay within the jitter either way of the mean, and average out to it
+	rng := rand.New(rand.NewSource(1))
+	delay, total := 10*time.Millisecond, time.Duration(0)
+	low, high := delay, delay
+	for i := 0; i < 10000; i++ {
+		d := jittered(delay, 0.2, rng)
+		if d < low {
+			low = d
+		}
+		if d > high {
+			high = d
+		}
+		total += d
+	}
+	if low < 8*time.Millisecond || high > 12*time.Millisecond || low > 8100*time.Microsecond || high < 11900*time.Microsecond {
+		t.Errorf("20%% jitter on %s ranged from %s to %s", delay, low, high)
+	}
+	if mean := total / 10000; mean < 9900*time.Microsecond || mean > 10100*time.Microsecond {
+		t.Errorf("Jittered delays averaged %s, expected about %s", mean, delay)
+	}
+}
+
+func TestProducerDelays(t *testing.T) {
+	delays, err := parseDurations("0, 5ms,10ms")
+	if err != nil || len(delays) != 3 || delays[1] != 5*time.Millisecond {
+		t.Errorf("Delays parsed incorrectly: %v, %v", delays, err)
+	}
+	if delays, err := parseDurations(""); err != nil || delays != nil {
+		t.Errorf("Empty delays not treated as none: %v, %v", delays, err)
+	}
+	for _, list := range []string{"5", "-5ms", "5ms,,10ms"} {
+		if _, err := parseDurations(list); err == nil {
+			t.Errorf("Invalid delays %q not rejected", list)
+		}
+	}
+
+	// The delays cycle, so producers 1 and 3 run flat out while 2 and 4 are slowed down
+	cfg := config{numProducers: 4, kthBadWidget: -1, numWidgets: 1000, producerDelays: []time.Duration{0, 10 * time.Millisecond}}
+	widgetChan := make(chan widget, cfg.numWidgets)
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	producerGroup := newProducerGroup(cfg, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	wg.Add(cfg.numProducers)
+	producerGroup.spawnProducers()
+	wg.Wait()
+
+	fast := producerGroup.madeBy[0].Load() + producerGroup.madeBy[2].Load()
+	slow := producerGroup.madeBy[1].Load() + producerGroup.madeBy[3].Load()
+	if fast+slow != 1000 || fast <= 10*slow {
+		t.Errorf("Producers 1 and 3 made %d widgets and producers 2 and 4 made %d, expected a large skew", fast, slow)
+	}
+
+	// A widget is made once its producer's delay is over, so its time doesn't include the wait
+	cfg = config{numProducers: 1, kthBadWidget: -1, numWidgets: 1, producerDelays: []time.Duration{20 * time.Millisecond}}
+	widgetChan = make(chan widget, cfg.numWidgets)
+	producerGroup = newProducerGroup(cfg, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	started := time.Now()
+	wg.Add(cfg.numProducers)
+	producerGroup.spawnProducers()
+	wg.Wait()
+	if w := <-widgetChan; w.time.Sub(started) < 20*time.Millisecond {
+		t.Errorf("Widget made %s in, before its producer's 20ms delay was over", w.time.Sub(started))
+	}
+}
+
+func TestRampUp(t *testing.T) {
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+
+	// The last producer starts 150ms in, by when the others have made every widget
+	cfg := config{numProducers: 4, kthBadWidget: -1, numWidgets: 100, rampUp: 50 * time.Millisecond}
+	widgetChan := make(chan widget, cfg.numWidgets)
+	producerGroup := newProducerGroup(cfg, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	wg.Add(cfg.numProducers)
+	producerGroup.spawnProducers()
+	time.Sleep(20 * time.Millisecond)
+	if made := producerGroup.madeBy[3].Load(); made != 0 {
+		t.Errorf("Last producer made %d widgets before its turn", made)
+	}
+	wg.Wait()
+	if producerGroup.alive.Load() != 0 {
+		t.Errorf("Producers still counted as running")
+	}
+	if made := producerGroup.madeBy[3].Load(); made != 0 {
+		t.Errorf("Last producer made %d widgets after the others had made them all", made)
+	}
+
+	// Stopping doesn't wait for the ramp up to finish
+	cfg.rampUp = time.Hour
+	cfg.numWidgets = 10
+	widgetChan = make(chan widget, cfg.numWidgets)
+	producerGroup = newProducerGroup(cfg, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	wg.Add(cfg.numProducers)
+	producerGroup.spawnProducers()
+	requestStop(&shouldStop, &shouldStopMutex)
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Producers waiting to start didn't notice the stop signal")
+	}
+}
+
+// brokenCollector records the id of every broken widget it handles.
+type brokenCollector struct {
+	mutex sync.Mutex
+	ids   []string
+}
+
+func (h *brokenCollector) Handle(w widget) error {
+	if w.broken {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		h.ids = append(h.ids, w.id)
+	}
+	return nil
+}
+
+func TestKthWidget(t *testing.T) {
+	// However the ids are spread across producers, -k 5 breaks the widget with id 5 and no other,
+	// and stops production even though the handler is a custom one
+	for _, producers := range []int{1, 4, 32} {
+		cfg := defaultConfig()
+		cfg.numWidgets, cfg.numProducers, cfg.numConsumers, cfg.kthBadWidget = 1000, producers, 4, 5
+		cfg.out = io.Discard
+		handler := &brokenCollector{}
+		cfg.handler = handler
+		if _, err := RunPipeline(cfg, nil); !errors.Is(err, ErrProductionStopped) || !strings.Contains(err.Error(), "widget 5") {
+			t.Fatalf("With %d producers, run ended with %v, expected production stopped by widget 5", producers, err)
+		}
+		if len(handler.ids) != 1 || handler.ids[0] != "5" {
+			t.Errorf("With %d producers, broken widgets were %v, expected only 5", producers, handler.ids)
+		}
+	}
+
+	for _, k := range []string{"0", "-2"} {
+		if _, err := parseConfig([]string{"-k", k}); err == nil {
+			t.Errorf("-k %s not rejected", k)
+		}
+	}
+}
+
+func TestBreakEvery(t *testing.T) {
+	for _, producers := range []string{"1", "4"} {
+		cfg, err := parseConfig([]string{"-n", "100", "-p", producers, "-c", "3", "-every", "10", "-breaker-threshold", "100"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.out = io.Discard
+		handler := &brokenCollector{}
+		cfg.handler = handler
+		result, err := RunPipeline(cfg, nil)
+		if err != nil || result.Consumed != 100 {
+			t.Fatalf("Consumed %d of 100 widgets: %v", result.Consumed, err)
+		}
+		ids := make([]int, len(handler.ids))
+		for i, id := range handler.ids {
+			ids[i] = mustAtoi(t, id)
+		}
+		slices.Sort(ids)
+		if !slices.Equal(ids, []int{10, 20, 30, 40, 50, 60, 70, 80, 90, 100}) {
+			t.Errorf("With %s producers, broken widgets were %v", producers, ids)
+		}
+	}
+
+	// Once the breaker trips, production stops at the next broken widget
+	run := runHarness(t.Context(), t, "-n", "1000", "-every", "10", "-breaker-threshold", "5", "-buffer", "0")
+	if !errors.Is(run.Err, ErrProductionStopped) || !strings.Contains(run.Err.Error(), "widget 60") {
+		t.Errorf("Expected production to stop at widget 60: %v", run.Err)
+	}
+
+	for _, args := range [][]string{
+		{"-every", "-1"},
+		{"-every", "5", "-k", "3"},
+		{"-every", "5", "-random-break"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v not rejected", args)
+		}
+	}
+}
+
+// producerTally counts the widgets it handles by producer.
+type producerTally struct {
+	mutex  sync.Mutex
+	counts map[int]int
+}
+
+func (h *producerTally) Handle(w widget) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.counts[w.producerID]++
+	return nil
+}
+
+func TestPerProducer(t *testing.T) {
+	cfg, err := parseConfig([]string{"-p", "3", "-c", "2", "-perproducer", "50"})
+	if err != nil || cfg.numWidgets != 150 {
+		t.Fatalf("-perproducer 50 with 3 producers gave %d widgets: %v", cfg.numWidgets, err)
+	}
+	handler := &producerTally{counts: make(map[int]int)}
+	cfg.handler = handler
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Produced != 150 {
+		t.Fatalf("Produced %d widgets, expected 150: %v", result.Produced, err)
+	}
+	for producer := 1; producer <= 3; producer++ {
+		if n := handler.counts[producer]; n != 50 {
+			t.Errorf("Producer_%d made %d widgets, expected 50", producer, n)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-perproducer", "5", "-n", "10"},
+		{"-perproducer", "5", "--num-widgets", "10"},
+		{"-perproducer", "5", "-duration", "1s"},
+		{"-perproducer", "-1"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v not rejected", args)
+		}
+	}
+}
+
+func TestRandomBreak(t *testing.T) {
+	run := func(args ...string) []string {
+		cfg, err := parseConfig(append([]string{"-random-break", "-seed", "7", "-p", "4"}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.out = io.Discard
+		handler := &brokenCollector{}
+		cfg.handler = handler
+		if _, err := RunPipeline(cfg, nil); !errors.Is(err, ErrProductionStopped) {
+			t.Fatal(err)
+		}
+		return handler.ids
+	}
+
+	// The same seed breaks the same widget, somewhere in the run
+	first := run("-n", "1000")
+	if len(first) != 1 || mustAtoi(t, first[0]) < 1 || mustAtoi(t, first[0]) > 1000 {
+		t.Fatalf("Randomly broke %v, expected one widget in [1,1000]", first)
+	}
+	if again := run("-n", "1000"); len(again) != 1 || again[0] != first[0] {
+		t.Errorf("Same seed broke %v, then %v", first, again)
+	}
+
+	// Without a count, one widget is broken at a random point in the run
+	if broken := run("-duration", "50ms", "-producerdelays", "1ms"); len(broken) != 1 {
+		t.Errorf("Randomly broke %v in duration mode, expected one widget", broken)
+	}
+
+	if _, err := parseConfig([]string{"-random-break", "-k", "5"}); err == nil {
+		t.Errorf("-random-break with -k not rejected")
+	}
+}
+
+func TestIDStart(t *testing.T) {
+	widgetChan := make(chan widget, 10)
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+
+	// Ids start at the offset, and -k still picks the kth widget made
+	cfg := config{numProducers: 1, numWidgets: 5, kthBadWidget: 3, idStart: 1000000}
+	producerGroup := newProducerGroup(cfg, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	for i := 0; i < 5; i++ {
+		w, err := producerGroup.getWidget(1)
+		if err != nil || w.id != strconv.Itoa(1000000+i) || w.broken != (i == 2) {
+			t.Errorf("Widget %d is %v, %v", i+1, w, err)
+		}
+	}
+	if producerGroup.produced() != 5 {
+		t.Errorf("Counted %d widgets produced, expected 5", producerGroup.produced())
+	}
+
+	if cfg, err := parseConfig([]string{"-idstart", "500"}); err != nil || cfg.idStart != 500 {
+		t.Errorf("-idstart not parsed: %v", err)
+	}
+	if _, err := parseConfig([]string{"-idstart", "0"}); err == nil {
+		t.Errorf("-idstart 0 not rejected")
+	}
+}
+
+func TestVerifyUnique(t *testing.T) {
+	widgetChan := make(chan widget, 4)
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	cfg := config{numConsumers: 2, verifyUnique: true, out: io.Discard}
+	consumerGroup := newConsumerGroup(cfg, widgetChan, &wg, &shouldStop, &shouldStopMutex, noopSink{}, nil)
+
+	for _, id := range []string{"1", "2", "1", "3"} {
+		widgetChan <- widget{id: id, source: "Producer_1", producerID: 1, time: time.Now()}
+	}
+	close(widgetChan)
+	wg.Add(cfg.numConsumers)
+	consumerGroup.spawnConsumers()
+	wg.Wait()
+
+	if n := consumerGroup.duplicates.Load(); n != 1 || consumerGroup.duplicateError() == nil {
+		t.Errorf("Found %d duplicate ids, expected 1", n)
+	}
+
+	// A run with sequential ids has none
+	cfg = defaultConfig()
+	cfg.numWidgets, cfg.numProducers, cfg.numConsumers = 1000, 8, 8
+	cfg.verifyUnique = true
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Duplicates != 0 {
+		t.Errorf("Duplicate ids reported for a normal run: %d, %v", result.Duplicates, err)
+	}
+}
+
+func TestVerifyOrder(t *testing.T) {
+	widgetChan := make(chan widget, 5)
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	cfg := config{numConsumers: 1, verifyOrder: true, out: io.Discard}
+	consumerGroup := newConsumerGroup(cfg, widgetChan, &wg, &shouldStop, &shouldStopMutex, noopSink{}, nil)
+
+	start := time.Now()
+	// Producer_2's widgets are interleaved with Producer_1's, and only Producer_1's go backwards
+	widgetChan <- widget{id: "1", source: "Producer_1", producerID: 1, time: start.Add(2 * time.Millisecond)}
+	widgetChan <- widget{id: "2", source: "Producer_2", producerID: 2, time: start}
+	widgetChan <- widget{id: "3", source: "Producer_1", producerID: 1, time: start.Add(time.Millisecond)}
+	widgetChan <- widget{id: "4", source: "Producer_2", producerID: 2, time: start}
+	widgetChan <- widget{id: "5", source: "Producer_1", producerID: 1, time: start.Add(3 * time.Millisecond)}
+	close(widgetChan)
+	wg.Add(cfg.numConsumers)
+	consumerGroup.spawnConsumers()
+	wg.Wait()
+
+	if n := consumerGroup.order.violations.Load(); n != 1 || consumerGroup.orderError() == nil {
+		t.Errorf("Found %d widgets out of order, expected 1", n)
+	}
+
+	// Each producer sends its widgets in order, so a normal run has none
+	cfg = defaultConfig()
+	cfg.numWidgets, cfg.numProducers, cfg.numConsumers = 1000, 8, 1
+	cfg.verifyOrder = true
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.OutOfOrder != 0 {
+		t.Errorf("Widgets reported out of order in a normal run: %d, %v", result.OutOfOrder, err)
+	}
+
+	for _, args := range [][]string{
+		{"-verify-order", "-c", "2"},
+		{"-verify-order", "-reorder-window", "5"},
+		{"-verify-order", "-n", "-"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v not rejected", args)
+		}
+	}
+}
+
+func TestTTL(t *testing.T) {
+	widgetChan := make(chan widget, 3)
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	sink := &recordingSink{results: make(map[string]ResultCode)}
+	cfg := config{numConsumers: 1, ttl: time.Second, out: io.Discard}
+	consumerGroup := newConsumerGroup(cfg, widgetChan, &wg, &shouldStop, &shouldStopMutex, sink, nil)
+
+	widgetChan <- widget{id: "1", source: "Producer_1", producerID: 1, time: time.Now().Add(-time.Minute)}
+	widgetChan <- widget{id: "2", source: "Producer_1", producerID: 1, time: time.Now()}
+	widgetChan <- widget{id: "3", source: "Producer_1", producerID: 1, time: time.Now().Add(-time.Minute), broken: true}
+	close(widgetChan)
+	wg.Add(1)
+	consumerGroup.spawnConsumers()
+	wg.Wait()
+
+	if sink.results["1"] != resultExpired || sink.results["2"] != resultConsumed || sink.results["3"] != resultExpired {
+		t.Errorf("Unexpected results with a ttl: %v", sink.results)
+	}
+	if consumerGroup.expired.Load() != 2 || consumerGroup.consumed.Load() != 1 {
+		t.Errorf("Counted %d expired and %d consumed widgets, expected 2 and 1", consumerGroup.expired.Load(), consumerGroup.consumed.Load())
+	}
+	if shouldStop {
+		t.Errorf("Expired broken widget stopped production")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	stopped := fmt.Errorf("%w by broken widget 5", ErrProductionStopped)
+	for _, tc := range []struct {
+		result Result
+		err    error
+		want   int
+	}{
+		{Result{Produced: 10, Consumed: 10}, nil, exitOK},
+		{Result{Produced: 5, Consumed: 5}, stopped, exitBroken},
+		{Result{Produced: 10, Consumed: 4, Abandoned: 6}, nil, exitDrainTimeout},
+		{Result{Produced: 5, Consumed: 2, Abandoned: 3}, stopped, exitBroken},
+		{Result{}, errors.New("likely deadlock"), exitFailed},
+	} {
+		if got := exitCode(tc.result, tc.err); got != tc.want {
+			t.Errorf("exitCode(%+v, %v) = %d, expected %d", tc.result, tc.err, got, tc.want)
+		}
+	}
+
+	for args, want := range map[string]int{"-n 20": exitOK, "-n 20 -k 5": exitBroken} {
+		cfg, err := parseConfig(strings.Fields(args))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.out = io.Discard
+		if got := exitCode(RunPipeline(cfg, nil)); got != want {
+			t.Errorf("%s exited with %d, expected %d", args, got, want)
+		}
+	}
+}
+
+// TestMainEndToEnd runs the whole program, as main, in a process of its own, and checks what it
+// prints and how it exits. Run it with -race to check every component together.
+func TestMainEndToEnd(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-n", "20", "-p", "2", "-c", "2", "-k", "10", "-buffer", "0", "-seed", "1", "-run-id", "e2e")
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", "NO_COLOR=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitBroken {
+		t.Fatalf("Run exited with %v, expected status %d\n%s", err, exitBroken, stderr.String())
+	}
+
+	consumedLine := regexp.MustCompile(`^Consumer_[12] consumed \[id=([0-9]+) source=Producer_[12] time=[0-9:.]+ broken=false\] in .* time$`)
+	brokenLine := regexp.MustCompile(`^Consumer_[12] found a broken widget \[id=10 source=Producer_[12] time=[0-9:.]+ broken=true\] -- stopping production$`)
+	seen := make(map[int]bool)
+	broken := 0
+	for _, line := range strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n") {
+		if brokenLine.MatchString(line) {
+			broken++
+			seen[10] = true
+			continue
+		}
+		match := consumedLine.FindStringSubmatch(line)
+		if match == nil {
+			t.Errorf("Unexpected output line %q", line)
+			continue
+		}
+		id, _ := strconv.Atoi(match[1])
+		if seen[id] || id == 10 {
+			t.Errorf("Widget %d consumed more than once", id)
+		}
+		seen[id] = true
+	}
+	if broken != 1 {
+		t.Errorf("%d broken widget lines, expected 1", broken)
+	}
+	// Production stops once the broken widget is found, so every widget before it and any made
+	// meanwhile are consumed, with no gaps
+	if len(seen) < 10 {
+		t.Errorf("Consumed %d widgets, expected at least the first 10", len(seen))
+	}
+	for id := 1; id <= len(seen); id++ {
+		if !seen[id] {
+			t.Errorf("Widget %d never consumed, though %d widgets were", id, len(seen))
+		}
+	}
+	if !strings.Contains(stderr.String(), "production stopped early by broken widget 10\n") {
+		t.Errorf("Expected production to stop at widget 10, stderr was\n%s", stderr.String())
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n") {
+		if !strings.HasPrefix(line, "[run e2e] ") {
+			t.Errorf("Standard error line %q not tagged with the run id", line)
+		}
+	}
+}
+
+func TestChannelBuffer(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		expected int
+	}{
+		{[]string{"-n", "10"}, 10},
+		{[]string{"-n", "100000"}, 100000},
+		{[]string{"-n", "5000000"}, defaultBufferLimit},
+		{[]string{"-perproducer", "20", "-p", "3"}, 60},
+		{[]string{"-n", "10", "-buffer", "0"}, 0},
+		{[]string{"-n", "5000000", "-buffer", "200000"}, 200000},
+		{[]string{"-duration", "1s"}, defaultBufferLimit},
+		{[]string{"-replay", "widgets.jsonl"}, defaultBufferLimit},
+		{[]string{"consume", "-unix-socket", "widgets.sock"}, defaultBufferLimit},
+	} {
+		cfg, err := parseConfig(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buffer := cfg.channelBuffer(); buffer != test.expected {
+			t.Errorf("%v: buffer of %d widgets, expected %d", test.args, buffer, test.expected)
+		}
+	}
+}
+
+// TestForcedExitTagged interrupts the whole program, running in a process of its own, while it has
+// a backlog too big to drain within -force-after, and checks the forced exit's message still makes
+// it through the run id tagging.
+func TestForcedExitTagged(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Interrupts can't be sent to a process on Windows")
+	}
+	cmd := exec.Command(os.Args[0], "-duration", "1m", "-c", "1", "-quiet", "-report-interval", "50ms", "-force-after", "1ms", "-run-id", "e2e")
+	cmd.Env = append(os.Environ(), runMainEnv+"=1", "NO_COLOR=1")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer time.AfterFunc(10*time.Second, func() { cmd.Process.Kill() }).Stop()
+
+	// Interrupt once the pipeline is running, as the first throughput report shows
+	lines := bufio.NewScanner(stderr)
+	var output []string
+	for lines.Scan() {
+		output = append(output, lines.Text())
+		if strings.Contains(lines.Text(), "widgets so far") {
+			cmd.Process.Signal(os.Interrupt)
+			break
+		}
+	}
+	for lines.Scan() {
+		output = append(output, lines.Text())
+	}
+	err = cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != exitInterrupted {
+		t.Fatalf("Run exited with %v, expected status %d\n%s", err, exitInterrupted, strings.Join(output, "\n"))
+	}
+	if last := output[len(output)-1]; last != "[run e2e] Shutdown did not finish within 1ms -- exiting immediately" {
+		t.Errorf("Last line on standard error was %q, expected the forced exit's", last)
+	}
 }
@@ -0,0 +1,58 @@
+package main
+
+import "reflect"
+
+// MERGE LOGIC
+// mergeChannels fans several widget channels in to one, for feeding RunConsumers from producers
+// partitioned across channels, e.g. one per source. The merge takes from the inputs in turn, so a
+// busy input can't starve a quiet one: each widget comes from the next input after the last one
+// taken from that has a widget ready, and the merge only waits when none has.
+
+// mergeChannels returns a channel receiving every widget sent on chans, which is closed once all of
+// them are closed and drained. Widgets from any one input keep their order.
+func mergeChannels(chans ...chan widget) chan widget {
+	out := make(chan widget)
+	go func() {
+		defer close(out)
+		open := make([]chan widget, len(chans))
+		copy(open, chans)
+		next := 0 // index into open of the input to try first
+		for len(open) > 0 {
+			i, w, ok := receiveFrom(open, next)
+			if !ok {
+				open = append(open[:i], open[i+1:]...)
+				next = i
+			} else {
+				out <- w
+				next = i + 1
+			}
+			if next >= len(open) {
+				next = 0
+			}
+		}
+	}()
+	return out
+}
+
+// receiveFrom receives from the first of chans, trying them in turn from index start, that has a
+// widget ready or is closed, or waits for any of them if none is. It returns the index of the
+// channel received from, and whether a widget was received rather than the channel being closed.
+func receiveFrom(chans []chan widget, start int) (int, widget, bool) {
+	for n := range chans {
+		i := (start + n) % len(chans)
+		select {
+		case w, ok := <-chans[i]:
+			return i, w, ok
+		default:
+		}
+	}
+	cases := make([]reflect.SelectCase, len(chans))
+	for i, ch := range chans {
+		cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)}
+	}
+	i, value, ok := reflect.Select(cases)
+	if !ok {
+		return i, widget{}, false
+	}
+	return i, value.Interface().(widget), true
+}
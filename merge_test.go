@@ -0,0 +1,77 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMergeChannels(t *testing.T) {
+	// A busy input that's always ready doesn't keep the quiet ones waiting
+	busy, quiet, idle := make(chan widget, 100), make(chan widget, 100), make(chan widget)
+	for i := 1; i <= 100; i++ {
+		busy <- widget{id: "busy" + strconv.Itoa(i)}
+	}
+	for i := 1; i <= 3; i++ {
+		quiet <- widget{id: "quiet" + strconv.Itoa(i)}
+	}
+	close(busy)
+	close(quiet)
+	merged := mergeChannels(busy, quiet, idle)
+
+	var ids []string
+	for i := 0; i < 6; i++ {
+		ids = append(ids, (<-merged).id)
+	}
+	if expected := []string{"busy1", "quiet1", "busy2", "quiet2", "busy3", "quiet3"}; !slices.Equal(ids, expected) {
+		t.Errorf("Merged %v, expected %v", ids, expected)
+	}
+
+	// Widgets from each input keep their order, and the merge waits on an input that has none ready
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		idle <- widget{id: "idle1"}
+		close(idle)
+	}()
+	last := 3
+	sawIdle := false
+	for w := range merged {
+		if w.id == "idle1" {
+			sawIdle = true
+			continue
+		}
+		n, _ := strconv.Atoi(w.id[len("busy"):])
+		if n != last+1 {
+			t.Fatalf("Widget %s merged after busy%d", w.id, last)
+		}
+		last = n
+	}
+	if last != 100 || !sawIdle {
+		t.Errorf("Merge closed after busy%d, idle widget merged: %t", last, sawIdle)
+	}
+
+	// With no inputs, the merge is closed straight away
+	if _, ok := <-mergeChannels(); ok {
+		t.Error("Merge of no channels received a widget")
+	}
+}
+
+func TestMergeIntoConsumers(t *testing.T) {
+	var chans []chan widget
+	for source := 1; source <= 4; source++ {
+		ch := make(chan widget)
+		chans = append(chans, ch)
+		go func() {
+			for i := 1; i <= 250; i++ {
+				ch <- widget{id: strconv.Itoa(source*1000 + i), source: "Producer_" + strconv.Itoa(source), time: time.Now()}
+			}
+			close(ch)
+		}()
+	}
+	handler := &tallyingHandler{counts: make(map[string]int)}
+	result := RunConsumers(mergeChannels(chans...), ConsumerConfig{Consumers: 3, Handler: handler})
+	if result.Err != nil || result.Consumed != 1000 || len(handler.counts) != 1000 {
+		t.Errorf("Consumed %d widgets from 4 merged channels, %d distinct, expected 1000: %v", result.Consumed, len(handler.counts), result.Err)
+	}
+}
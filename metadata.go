@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// METADATA LOGIC
+// Widgets can carry arbitrary key/value metadata, making them self-describing for whatever filters
+// them downstream. -meta gives metadata applied to every widget produced. It travels with widgets
+// over a socket and into replay logs, and consumers include it in every output format.
+//
+// Widgets are passed between goroutines by value, which would leave them all sharing one map, so
+// every widget is given a map of its own and nothing modifies a widget's metadata once it's sent.
+
+// parseMetadata parses a list like "env=prod,region=us".
+func parseMetadata(list string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, entry := range strings.Split(list, ",") {
+		key, value, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, errors.New("invalid metadata " + entry + ", expected key=value")
+		}
+		if _, seen := metadata[key]; seen {
+			return nil, errors.New("metadata key " + key + " given more than once")
+		}
+		metadata[key] = strings.TrimSpace(value)
+	}
+	return metadata, nil
+}
+
+// formatMetadata renders metadata as parseMetadata reads it, with the keys sorted so widgets with
+// the same metadata always render the same way.
+func formatMetadata(metadata map[string]string) string {
+	entries := make([]string, 0, len(metadata))
+	for _, key := range slices.Sorted(maps.Keys(metadata)) {
+		entries = append(entries, key+"="+metadata[key])
+	}
+	return strings.Join(entries, ",")
+}
+
+// labeled gives w the -meta metadata, in a copy of any metadata it already has, e.g. from a replay.
+// Where both have a key, -meta wins.
+func (g *producerGroup) labeled(w widget) widget {
+	if len(g.metadata) == 0 {
+		return w
+	}
+	metadata := maps.Clone(w.metadata)
+	if metadata == nil {
+		metadata = make(map[string]string, len(g.metadata))
+	}
+	maps.Copy(metadata, g.metadata)
+	w.metadata = metadata
+	return w
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"maps"
+	"reflect"
+	"testing"
+)
+
+func TestParseMetadata(t *testing.T) {
+	metadata, err := parseMetadata("env=prod, region = us,empty=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"env": "prod", "region": "us", "empty": ""}; !reflect.DeepEqual(metadata, want) {
+		t.Errorf("Parsed %v, expected %v", metadata, want)
+	}
+	if formatted := formatMetadata(metadata); formatted != "empty=,env=prod,region=us" {
+		t.Errorf("Formatted as %s", formatted)
+	}
+	for _, list := range []string{"env", "=prod", "env=prod,env=dev", ""} {
+		if _, err := parseMetadata(list); err == nil {
+			t.Errorf("%q not rejected", list)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	cfg, err := parseConfig([]string{"-n", "20", "-p", "2", "-c", "2", "-meta", "env=prod,region=us"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &capturingHandler{widgets: make(map[string]widget)}
+	cfg.handler, cfg.out = handler, io.Discard
+	if _, err := RunPipeline(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"env": "prod", "region": "us"}
+	if len(handler.widgets) != 20 {
+		t.Fatalf("Consumed %d widgets, expected 20", len(handler.widgets))
+	}
+	for _, w := range handler.widgets {
+		if !reflect.DeepEqual(w.metadata, want) {
+			t.Errorf("Widget %s has metadata %v, expected %v", w.id, w.metadata, want)
+		}
+	}
+	// Every widget has a map of its own, so changing one leaves the rest alone
+	handler.widgets["1"].metadata["env"] = "dev"
+	for id, w := range handler.widgets {
+		if id != "1" && w.metadata["env"] != "prod" {
+			t.Fatalf("Widgets 1 and %s share metadata", id)
+		}
+	}
+	if cfg.metadata["env"] != "prod" {
+		t.Error("-meta changed through a widget")
+	}
+
+	// A widget's own metadata is kept, with -meta taking precedence
+	g := producerGroup{metadata: want}
+	own := map[string]string{"env": "dev", "owner": "qa"}
+	w := g.labeled(widget{id: "1", metadata: own})
+	if !reflect.DeepEqual(w.metadata, map[string]string{"env": "prod", "region": "us", "owner": "qa"}) || !maps.Equal(own, map[string]string{"env": "dev", "owner": "qa"}) {
+		t.Errorf("Labeled metadata %v from %v", w.metadata, own)
+	}
+}
+
+func TestMetadataCodec(t *testing.T) {
+	w := widget{id: "1", source: "Producer_1", producerID: 1, metadata: map[string]string{"env": "prod"}}
+	var buf bytes.Buffer
+	enc, _ := newWidgetEncoder(codecNDJSON, &buf)
+	if err := enc.Encode(w); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"metadata":{"env":"prod"}`)) {
+		t.Errorf("Metadata not encoded: %s", buf.String())
+	}
+	dec, _ := newWidgetDecoder(codecNDJSON, &buf)
+	decoded, err := dec.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.metadata, w.metadata) {
+		t.Errorf("Decoded metadata %v, expected %v", decoded.metadata, w.metadata)
+	}
+}
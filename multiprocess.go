@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MULTIPROCESS LOGIC
+// -multiprocess runs the producers in a child process, connected to the consumers in this one over
+// a Unix domain socket. It is produce and consume mode wired together automatically: the child is
+// this binary run with the produce command and the producers' options, so every widget crosses a
+// process boundary through the codec, and shutdown has to cross it too. Interrupts received here
+// are passed on to the child, which runs in a process group of its own so a Ctrl-C from the
+// terminal reaches it only once.
+
+// childOnlyFlags are options given to the producers' process alone, though consume mode has them too.
+var childOnlyFlags = map[string]bool{"admin": true}
+
+// parentOnlyFlags are options kept by the consumers' process alone, though produce mode has them too.
+var parentOnlyFlags = map[string]bool{"pprof": true, "dryrun": true, "version": true}
+
+// splitMultiprocessArgs divides a -multiprocess run's options between the producers' process and the
+// consumers' process, by which command accepts them. Options both accept go to both, apart from
+// those listed above. -seed is left out, since the child is given the seed this process resolved,
+// and so is -run-id, since the child's standard error is tagged as it passes through this
+// process's. An option neither command accepts, which only applies to running in a single process,
+// is an error.
+func splitMultiprocessArgs(arguments []string) (child, parent []string, err error) {
+	var all, produce, consume config
+	allFlags, produceFlags, consumeFlags := newFlagSet(&all, ""), newFlagSet(&produce, "produce"), newFlagSet(&consume, "consume")
+	for i := 0; i < len(arguments); i++ {
+		arg := arguments[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || arg == "-" {
+			return nil, nil, errors.New("unexpected argument " + arg)
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f := allFlags.Lookup(name)
+		if f == nil {
+			return nil, nil, errors.New("flag provided but not defined: -" + name)
+		}
+		option := []string{arg}
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && bf.IsBoolFlag()) {
+			if i+1 == len(arguments) {
+				return nil, nil, errors.New("flag needs an argument: -" + name)
+			}
+			i++
+			option = append(option, arguments[i])
+		}
+
+		switch {
+		case name == "multiprocess" || name == "mode" || name == "seed" || name == "run-id":
+		case name == "unix-socket":
+			return nil, nil, errors.New("-multiprocess picks its own Unix domain socket, so -unix-socket can't be given")
+		case childOnlyFlags[name]:
+			child = append(child, option...)
+		case parentOnlyFlags[name]:
+			parent = append(parent, option...)
+		case produceFlags.Lookup(name) != nil || consumeFlags.Lookup(name) != nil:
+			if produceFlags.Lookup(name) != nil {
+				child = append(child, option...)
+			}
+			if consumeFlags.Lookup(name) != nil {
+				parent = append(parent, option...)
+			}
+		default:
+			return nil, nil, errors.New("-" + name + " can't be combined with -multiprocess")
+		}
+	}
+	return child, parent, nil
+}
+
+// checkMultiprocess validates a -multiprocess run's options as the produce and consume commands
+// would, returning the options for the child.
+func checkMultiprocess(arguments []string) ([]string, error) {
+	child, parent, err := splitMultiprocessArgs(arguments)
+	if err != nil {
+		return nil, err
+	}
+	socket := []string{"-unix-socket", "multiprocess.sock"}
+	produce, err := parseConfig(append(append([]string{"produce"}, socket...), child...))
+	if err != nil {
+		return nil, fmt.Errorf("producers with -multiprocess: %w", err)
+	}
+	if produce.stdin {
+		// The child's standard input isn't this process's, so -n - has nothing to read
+		return nil, errors.New("-n - can't be combined with -multiprocess")
+	}
+	if _, err := parseConfig(append(append([]string{"consume"}, socket...), parent...)); err != nil {
+		return nil, fmt.Errorf("consumers with -multiprocess: %w", err)
+	}
+	return child, nil
+}
+
+// runMultiprocess runs the consumers for cfg in this process, and its producers in a child process.
+func runMultiprocess(cfg config, signals <-chan os.Signal) (Result, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return Result{}, err
+	}
+	dir, err := os.MkdirTemp("", "widgets")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.RemoveAll(dir)
+
+	cfg.mode, cfg.unixSocket = "consume", filepath.Join(dir, "widgets.sock")
+	args := append([]string{"produce", "-unix-socket", cfg.unixSocket, "-seed", strconv.FormatInt(cfg.seed, 10), "-run-id="}, cfg.childArgs...)
+	cmd := exec.Command(executable, args...)
+	// Standard output is for consumed widgets, so the child's diagnostics all go to standard error
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	ownProcessGroup(cmd)
+
+	forwarded := make(chan os.Signal, 2)
+	done := make(chan struct{})
+	defer close(done)
+	exited := make(chan error, 1)
+	cfg.listening = func(ln net.Listener) error {
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		go func() {
+			err := cmd.Wait()
+			if err != nil {
+				// A child that failed may never connect, so stop waiting for it
+				ln.Close()
+			}
+			exited <- err
+		}()
+		go func() {
+			for {
+				select {
+				case sig := <-signals:
+					// Tell the child first, in case this process then exits at once
+					cmd.Process.Signal(sig)
+					select {
+					case forwarded <- sig:
+					default:
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+		return nil
+	}
+
+	result, err := consumeFromSocket(cfg, forwarded)
+	if cmd.Process != nil {
+		childErr := <-exited
+		var exitErr *exec.ExitError
+		if errors.As(childErr, &exitErr) && exitErr.ExitCode() == exitBroken && errors.Is(err, ErrProductionStopped) {
+			// The child only saw this process hang up on it over the same broken widget
+			childErr = nil
+		}
+		if childErr != nil {
+			err = errors.Join(err, fmt.Errorf("producer process failed: %w", childErr))
+		}
+	}
+	return result, err
+}
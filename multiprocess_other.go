@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// ownProcessGroup does nothing where process groups aren't available, so a Ctrl-C may reach the
+// child directly as well as being passed on.
+func ownProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// runMainEnv makes the test binary run main instead of the tests, so it can stand in for the
+// program as the producers' process of a -multiprocess run.
+const runMainEnv = "WIDGETS_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+	}
+	os.Exit(m.Run())
+}
+
+func TestSplitMultiprocessArgs(t *testing.T) {
+	child, parent, err := splitMultiprocessArgs([]string{"-multiprocess", "-n", "50", "--p=2", "-c", "3", "-quiet",
+		"-codec", "binary", "-seed", "7", "-run-id", "r1", "-admin", ":0", "-pprof", ":0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"-n", "50", "--p=2", "-codec", "binary", "-admin", ":0"}; !slices.Equal(child, expected) {
+		t.Errorf("Producers' process given %q, expected %q", child, expected)
+	}
+	if expected := []string{"-c", "3", "-quiet", "-codec", "binary", "-pprof", ":0"}; !slices.Equal(parent, expected) {
+		t.Errorf("Consumers' process given %q, expected %q", parent, expected)
+	}
+
+	for _, args := range [][]string{
+		{"-multiprocess", "-fanout", "2"},
+		{"-multiprocess", "-report", "run.json"},
+		{"-multiprocess", "-unix-socket", "widgets.sock"},
+		{"-multiprocess", "-n", "-"},
+		{"-multiprocess", "-p", "0"},
+		{"-multiprocess", "-c", "0"},
+		{"-mode", "produce", "-unix-socket", "widgets.sock", "-multiprocess"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v not rejected", args)
+		}
+	}
+}
+
+func TestMultiprocess(t *testing.T) {
+	t.Setenv(runMainEnv, "1")
+	cfg, err := parseConfig([]string{"-multiprocess", "-n", "50", "-p", "2", "-c", "2", "-seed", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out lockedBuilder
+	cfg.out = &out
+	if _, err := runMultiprocess(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if consumed := strings.Count(out.b.String(), " consumed "); consumed != 50 {
+		t.Errorf("Consumed %d widgets from the producers' process, expected 50", consumed)
+	}
+
+	// A producers' process that fails before connecting doesn't leave the consumers waiting
+	cfg.childArgs = append(cfg.childArgs, "-no-such-option")
+	if _, err := runMultiprocess(cfg, nil); err == nil || !strings.Contains(err.Error(), "producer process failed") {
+		t.Errorf("Expected the producers' process to fail, got %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ORDER VERIFICATION LOGIC
+// A producer timestamps each widget as it makes it and sends them one at a time, so widgets from
+// any one producer should reach the consumers with their timestamps increasing. -verify-order
+// checks that invariant, which would only break through a bug in timestamping or delivery. It
+// complements -verify-unique: both are cheap checks on what consumers receive.
+//
+// Consumers race each other between receiving a widget and checking it, so the check is only
+// exact with a single consumer, which is all it allows.
+
+// orderChecker tracks the latest widget received from each producer.
+type orderChecker struct {
+	mutex      sync.Mutex
+	last       map[int]widget // latest widget received from each producer, by producer id
+	violations atomic.Int64   // widgets received with an earlier timestamp than one before them
+}
+
+func newOrderChecker() *orderChecker {
+	return &orderChecker{last: make(map[int]widget)}
+}
+
+// check records w, returning the widget from the same producer it arrived out of order after, if
+// there is one. A widget whose timestamp equals the last one's isn't out of order, since the
+// clock may not tick between two widgets.
+func (c *orderChecker) check(w widget) (previous widget, outOfOrder bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	previous, seen := c.last[w.producerID]
+	if seen && w.time.Before(previous.time) {
+		c.violations.Add(1)
+		return previous, true
+	}
+	c.last[w.producerID] = w
+	return widget{}, false
+}
+
+// verifyOrder checks val against the widgets received before it from the same producer, logging
+// it if it's out of order.
+func (g *consumerGroup) verifyOrder(val widget, consumerNum int) {
+	if previous, outOfOrder := g.order.check(val); outOfOrder {
+		fmt.Fprintf(os.Stderr, "OUT OF ORDER: Consumer_%d received widget %s from Producer_%d, produced at %s, after widget %s produced at %s\n",
+			consumerNum, val.id, val.producerID, val.time.Format(time.RFC3339Nano), previous.id, previous.time.Format(time.RFC3339Nano))
+	}
+}
+
+// orderError reports any widgets found out of order while verifying ordering.
+func (g *consumerGroup) orderError() error {
+	if g.order == nil {
+		return nil
+	}
+	if n := g.order.violations.Load(); n > 0 {
+		return fmt.Errorf("%d widgets arrived out of order", n)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ORDERED OUTPUT LOGIC
+// With several consumers, widgets are printed in whatever order the consumers finish them. In
+// ordered mode consumers still handle widgets in parallel, but their output passes through an
+// orderedPrinter that holds each widget back until every widget with a lower id has been printed.
+
+// orderedPrinter prints widgets in ascending id order, starting from next. Whichever consumer hands
+// over the widget that was being waited for prints it along with every held widget that follows.
+//
+// A broken widget stops production as soon as a consumer sees it, before it reaches the printer,
+// so holding it back in order doesn't delay the stop. Ids that never arrive (e.g. a widget whose
+// send timed out) leave a gap that holds back everything after it until flush is called once the
+// consumers have finished.
+type orderedPrinter struct {
+	mutex sync.Mutex
+	g     *consumerGroup
+	next  int
+	held  map[int]orderedWidget
+}
+
+// orderedWidget is a widget waiting for its turn to be printed.
+type orderedWidget struct {
+	w    widget
+	text string
+	show bool // false if the widget takes its place in the order but isn't printed, e.g. in quiet mode
+}
+
+func newOrderedPrinter(g *consumerGroup, first int) *orderedPrinter {
+	return &orderedPrinter{g: g, next: first, held: make(map[int]orderedWidget)}
+}
+
+// put hands over a widget and the text printed for it. A widget without a numeric id can't be
+// placed in the order, so it's printed at once.
+func (o *orderedPrinter) put(w widget, text string, show bool) error {
+	id, err := strconv.Atoi(w.id)
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if err != nil {
+		return o.emit(orderedWidget{w, text, show})
+	}
+
+	o.held[id] = orderedWidget{w, text, show}
+	var errs []error
+	for {
+		next, ok := o.held[o.next]
+		if !ok {
+			break
+		}
+		delete(o.held, o.next)
+		o.next++
+		errs = append(errs, o.emit(next))
+	}
+	return errors.Join(errs...)
+}
+
+// skip gives up w's place in the order if it was never put there, as when the handler failed or
+// panicked before printing it, so the widgets after it aren't held back.
+func (o *orderedPrinter) skip(w widget) error {
+	id, err := strconv.Atoi(w.id)
+	if err != nil {
+		return nil
+	}
+	o.mutex.Lock()
+	_, held := o.held[id]
+	placed := held || id < o.next
+	o.mutex.Unlock()
+	if placed {
+		return nil
+	}
+	// Only the consumer with w puts it, so nothing can have in the meantime
+	return o.put(w, "", false)
+}
+
+// flush prints every widget still held back, in id order, skipping over the gaps. It must only be
+// called after all consumers have returned.
+func (o *orderedPrinter) flush() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	ids := make([]int, 0, len(o.held))
+	for id := range o.held {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	var errs []error
+	for _, id := range ids {
+		errs = append(errs, o.emit(o.held[id]))
+		delete(o.held, id)
+	}
+	return errors.Join(errs...)
+}
+
+func (o *orderedPrinter) emit(held orderedWidget) error {
+	if !held.show {
+		return nil
+	}
+	return o.g.print(held.w, held.text)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var printedID = regexp.MustCompile(`\[id=(\d+) `)
+
+// printedIDs returns the id of every widget printed in out, in order.
+func printedIDs(t *testing.T, out string) []int {
+	var ids []int
+	for _, match := range printedID.FindAllStringSubmatch(out, -1) {
+		ids = append(ids, mustAtoi(t, match[1]))
+	}
+	return ids
+}
+
+func TestOrdered(t *testing.T) {
+	cfg, err := parseConfig([]string{"-ordered", "-p", "4", "-c", "8", "-n", "500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	cfg.out = &out
+	if _, err := RunPipeline(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	ids := printedIDs(t, out.String())
+	if len(ids) != 500 {
+		t.Fatalf("Printed %d widgets, expected 500", len(ids))
+	}
+	for i, id := range ids {
+		if id != i+1 {
+			t.Fatalf("Widget %d printed in position %d", id, i+1)
+		}
+	}
+
+	// A broken widget still stops production, and its output keeps its place
+	cfg.numWidgets, cfg.kthBadWidget, cfg.bufferSize = 100000, 50, 0
+	out.Reset()
+	RunPipeline(cfg, nil)
+	ids = printedIDs(t, out.String())
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("Widget %d printed after %d", ids[i], ids[i-1])
+		}
+	}
+	if len(ids) >= 100000 || !strings.Contains(out.String(), "broken widget [id=50 ") {
+		t.Errorf("Broken widget didn't stop an ordered run, %d printed", len(ids))
+	}
+
+	if _, err := parseConfig([]string{"-ordered", "-fanout", "2"}); err == nil {
+		t.Errorf("-ordered with -fanout not rejected")
+	}
+}
+
+func TestOrderedPrinterGaps(t *testing.T) {
+	var out bytes.Buffer
+	g := &consumerGroup{out: &out}
+	printer := newOrderedPrinter(g, 1)
+	for _, id := range []string{"3", "1", "4"} {
+		printer.put(widget{id: id}, id+"\n", true)
+	}
+	if out.String() != "1\n" {
+		t.Errorf("Printed %q before the gap was filled, expected only 1", out.String())
+	}
+
+	// Widgets that aren't shown still fill their place in the order
+	printer.put(widget{id: "2"}, "2\n", false)
+	if out.String() != "1\n3\n4\n" {
+		t.Errorf("Printed %q once the gap was filled", out.String())
+	}
+
+	// Flushing prints whatever is held past a gap that's never filled
+	printer.put(widget{id: "7"}, "7\n", true)
+	printer.put(widget{id: "6"}, "6\n", true)
+	printer.flush()
+	if out.String() != "1\n3\n4\n6\n7\n" {
+		t.Errorf("Printed %q after flushing", out.String())
+	}
+}
+
+func TestOrderedHandlerFailure(t *testing.T) {
+	// Widgets the handler fails, or panics over, give up their place rather than holding back the
+	// rest until the run ends
+	var out bytes.Buffer
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	cfg := defaultConfig()
+	cfg.out, cfg.injectErrorRate = &out, 1
+	g := newConsumerGroup(cfg, nil, &wg, &shouldStop, &shouldStopMutex, noopSink{}, nil)
+	g.ordered = newOrderedPrinter(&g, 1)
+	g.handle(widget{id: "1", time: time.Now()}, 1)
+	g.injector = nil
+	g.handler = &panickingHandler{id: "2"}
+	g.handle(widget{id: "2", time: time.Now()}, 1)
+	g.handler = nil
+	g.handle(widget{id: "3", time: time.Now()}, 1)
+	if ids := printedIDs(t, out.String()); len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("Printed %v after widgets 1 and 2 failed, expected 3 at once", ids)
+	}
+	if len(g.ordered.held) != 0 {
+		t.Errorf("%d widgets still held back", len(g.ordered.held))
+	}
+}
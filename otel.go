@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TRACING LOGIC
+// With -otel, each widget is traced as two linked spans, exported to an OpenTelemetry collector:
+// a producer span from the widget being made until a consumer takes it, and a consumer span, its
+// child, for handling it. Producers stamp each widget with a W3C traceparent naming its producer
+// span, which travels with the widget over a socket, so a consumer in another process continues
+// the same trace. Spans are exported in batches as OTLP/HTTP JSON, which needs nothing beyond the
+// standard library, rather than through the OpenTelemetry SDK.
+//
+// Tracing is off without -otel: widgets carry no traceparent and consumers record nothing.
+
+const (
+	otelBatchSize     = 512             // spans buffered before they're exported early
+	otelFlushInterval = time.Second     // how often buffered spans are exported
+	otelTimeout       = 5 * time.Second // how long an export may take
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindProducer = 4
+	spanKindConsumer = 5
+	statusCodeError  = 2
+)
+
+// newTraceParent returns a W3C traceparent for a new trace, naming a new span in it as the parent.
+func newTraceParent() string {
+	var ids [24]byte
+	rand.Read(ids[:])
+	return "00-" + hex.EncodeToString(ids[:16]) + "-" + hex.EncodeToString(ids[16:]) + "-01"
+}
+
+// parseTraceParent returns the trace and parent span ids of a W3C traceparent, hex encoded.
+func parseTraceParent(traceParent string) (traceID, spanID string, ok bool) {
+	parts := strings.Split(traceParent, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", "", false
+	}
+	return parts[1], parts[2], true
+}
+
+// newSpanID returns a random span id, hex encoded.
+func newSpanID() string {
+	var id [8]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// otelEndpoint returns the URL spans are exported to for an -otel collector address, which is
+// given as a base URL (http://localhost:4318) or just a host and port.
+func otelEndpoint(addr string) (string, error) {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", errors.New("invalid OpenTelemetry collector " + addr + ", expected e.g. http://localhost:4318")
+	}
+	return strings.TrimSuffix(u.String(), "/") + "/v1/traces", nil
+}
+
+// traced stamps w with a traceparent when tracing, unless it already has one, e.g. from a replay.
+func (g *producerGroup) traced(w widget) widget {
+	if g.tracing && w.traceParent == "" {
+		w.traceParent = newTraceParent()
+	}
+	return w
+}
+
+// The OTLP/HTTP JSON encoding of spans. Ids are hex and times are decimal strings of nanoseconds.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+		BoolValue   *bool   `json:"boolValue,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int) otlpAttribute {
+	s := strconv.Itoa(value)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+func boolAttribute(key string, value bool) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{BoolValue: &value}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// spanExporter buffers the spans of consumed widgets and exports them to a collector in batches.
+// A failed export is reported once and its spans are dropped, so an unreachable collector never
+// holds up the pipeline.
+type spanExporter struct {
+	endpoint string
+	runID    string // recorded as the run.id resource attribute, unless empty
+	client   *http.Client
+	mutex    sync.Mutex // exclusion on spans
+	spans    []otlpSpan
+	full     chan struct{} // signals the exporter that a batch is ready
+	done     chan struct{} // closed by Close
+	exited   chan struct{} // closed once the exporter has stopped
+	failed   atomic.Bool   // whether an export has failed, so it's reported only once
+}
+
+// newSpanExporter starts exporting spans to endpoint, a full OTLP/HTTP traces URL, until Close.
+func newSpanExporter(endpoint, runID string) *spanExporter {
+	e := &spanExporter{endpoint: endpoint,
+		runID:  runID,
+		client: &http.Client{Timeout: otelTimeout},
+		full:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		exited: make(chan struct{})}
+	go e.run()
+	return e
+}
+
+func (e *spanExporter) run() {
+	defer close(e.exited)
+	ticker := time.NewTicker(otelFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.done:
+			return
+		case <-ticker.C:
+		case <-e.full:
+		}
+		e.export()
+	}
+}
+
+// record adds the spans of a widget consumed by consumer consumerNum, which took it at taken and
+// finished handling it at handled. A widget without a traceparent starts a trace of its own.
+func (e *spanExporter) record(w widget, consumerNum int, taken, handled time.Time, handlerErr error) {
+	traceID, producerSpanID, ok := parseTraceParent(w.traceParent)
+	if !ok {
+		traceID, producerSpanID, _ = parseTraceParent(newTraceParent())
+	}
+	producer := otlpSpan{TraceID: traceID,
+		SpanID:            producerSpanID,
+		Name:              "produce widget",
+		Kind:              spanKindProducer,
+		StartTimeUnixNano: unixNano(w.time),
+		EndTimeUnixNano:   unixNano(taken),
+		Attributes:        []otlpAttribute{stringAttribute("widget.id", w.id), intAttribute("widget.producer", w.producerID)}}
+	if w.widgetType != "" {
+		producer.Attributes = append(producer.Attributes, stringAttribute("widget.type", w.widgetType))
+	}
+	consumer := otlpSpan{TraceID: traceID,
+		SpanID:            newSpanID(),
+		ParentSpanID:      producerSpanID,
+		Name:              "consume widget",
+		Kind:              spanKindConsumer,
+		StartTimeUnixNano: unixNano(taken),
+		EndTimeUnixNano:   unixNano(handled),
+		Attributes: []otlpAttribute{stringAttribute("widget.id", w.id), intAttribute("widget.consumer", consumerNum),
+			boolAttribute("widget.broken", w.broken)}}
+	if handlerErr != nil {
+		consumer.Status = &otlpStatus{Code: statusCodeError, Message: handlerErr.Error()}
+	} else if w.broken {
+		consumer.Status = &otlpStatus{Code: statusCodeError, Message: "broken widget"}
+	}
+
+	e.mutex.Lock()
+	e.spans = append(e.spans, producer, consumer)
+	full := len(e.spans) >= otelBatchSize
+	e.mutex.Unlock()
+	if full {
+		select {
+		case e.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// export sends the spans buffered so far.
+func (e *spanExporter) export() {
+	e.mutex.Lock()
+	spans := e.spans
+	e.spans = nil
+	e.mutex.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	if err := e.send(spans); err != nil && e.failed.CompareAndSwap(false, true) {
+		fmt.Fprintf(os.Stderr, "Couldn't export spans to %s, dropping them: %v\n", e.endpoint, err)
+	}
+}
+
+// send posts spans to the collector as one OTLP request.
+func (e *spanExporter) send(spans []otlpSpan) error {
+	resource := []otlpAttribute{stringAttribute("service.name", "widgets")}
+	if e.runID != "" {
+		resource = append(resource, stringAttribute("run.id", e.runID))
+	}
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: resource},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "widgets"}, Spans: spans}}}}})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("collector responded " + resp.Status)
+	}
+	return nil
+}
+
+// Close stops the exporter once the spans still buffered have been exported.
+func (e *spanExporter) Close() {
+	close(e.done)
+	<-e.exited
+	e.export()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// collector is a fake OpenTelemetry collector that keeps the spans exported to it.
+type collector struct {
+	mutex sync.Mutex
+	spans []otlpSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "not an OTLP/HTTP JSON export", http.StatusBadRequest)
+		return
+	}
+	var req otlpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, resource := range req.ResourceSpans {
+		for _, scope := range resource.ScopeSpans {
+			c.spans = append(c.spans, scope.Spans...)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	c := &collector{}
+	server := httptest.NewServer(c)
+	defer server.Close()
+
+	cfg, err := parseConfig([]string{"-n", "20", "-p", "2", "-c", "2", "-k", "20", "-otel", server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = io.Discard
+	if _, err := RunPipeline(cfg, nil); err == nil {
+		t.Fatal("Broken widget didn't stop the run")
+	}
+
+	// Every span has been exported once RunPipeline returns
+	producers := make(map[string]otlpSpan)
+	var consumers []otlpSpan
+	for _, span := range c.spans {
+		switch span.Kind {
+		case spanKindProducer:
+			producers[span.SpanID] = span
+		case spanKindConsumer:
+			consumers = append(consumers, span)
+		}
+	}
+	if len(producers) != 20 || len(consumers) != 20 {
+		t.Fatalf("Exported %d producer and %d consumer spans for 20 widgets", len(producers), len(consumers))
+	}
+	traces := make(map[string]bool)
+	for _, consumer := range consumers {
+		producer, ok := producers[consumer.ParentSpanID]
+		if !ok || producer.TraceID != consumer.TraceID || producer.EndTimeUnixNano != consumer.StartTimeUnixNano {
+			t.Errorf("Consumer span %+v isn't linked to its producer span", consumer)
+		}
+		traces[consumer.TraceID] = true
+		if broken := consumer.Status != nil && consumer.Status.Code == statusCodeError; broken != *consumer.Attributes[2].Value.BoolValue {
+			t.Errorf("Consumer span %+v has the wrong status", consumer)
+		}
+	}
+	if len(traces) != 20 {
+		t.Errorf("20 widgets traced in %d traces", len(traces))
+	}
+}
+
+func TestTraceParent(t *testing.T) {
+	traceParent := newTraceParent()
+	traceID, spanID, ok := parseTraceParent(traceParent)
+	if !ok || traceParent != "00-"+traceID+"-"+spanID+"-01" {
+		t.Errorf("Couldn't parse traceparent %s", traceParent)
+	}
+	for _, bad := range []string{"", "00-abc-def-01", "00-" + strings.Repeat("z", 32) + "-" + strings.Repeat("0", 16) + "-01"} {
+		if _, _, ok := parseTraceParent(bad); ok {
+			t.Errorf("Parsed invalid traceparent %q", bad)
+		}
+	}
+
+	// The traceparent survives a trip over a socket
+	var buf strings.Builder
+	enc, _ := newWidgetEncoder(codecNDJSON, &buf)
+	enc.Encode(widget{id: "1", traceParent: traceParent})
+	dec, _ := newWidgetDecoder(codecNDJSON, strings.NewReader(buf.String()))
+	if w, err := dec.Decode(); err != nil || w.traceParent != traceParent {
+		t.Errorf("Decoded traceparent %q, expected %q: %v", w.traceParent, traceParent, err)
+	}
+
+	for addr, expected := range map[string]string{
+		"localhost:4318":          "http://localhost:4318/v1/traces",
+		"https://collector:4318/": "https://collector:4318/v1/traces",
+	} {
+		if endpoint, err := otelEndpoint(addr); err != nil || endpoint != expected {
+			t.Errorf("Endpoint for %s was %s, expected %s: %v", addr, endpoint, expected, err)
+		}
+	}
+	if _, err := parseConfig([]string{"-otel", "ftp://collector"}); err == nil {
+		t.Errorf("Invalid collector accepted")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OUTPUT LOGIC
+// widgetWriter renders consumed widgets in a machine-readable format. Consumers share a single
+// widgetWriter, so implementations must be safe for concurrent use. Flush must be called once all
+// consumers have returned.
+type widgetWriter interface {
+	Write(w widget) error
+	Flush() error
+}
+
+// newWidgetWriter returns a writer for the named output format, or nil for the default
+// human-readable text.
+func newWidgetWriter(format string, out io.Writer) (widgetWriter, error) {
+	switch format {
+	case "text":
+		return nil, nil
+	case "csv":
+		return newCSVWriter(out)
+	case "protobuf":
+		return newProtobufWriter(out), nil
+	}
+	return nil, errors.New("unknown output format " + format)
+}
+
+var csvHeader = []string{"id", "source", "producer_id", "produced_time", "consumed_time", "latency_ns", "broken", "type", "metadata"}
+
+// csvWriter writes a header row followed by one row per consumed widget.
+type csvWriter struct {
+	mutex sync.Mutex // exclusion on writes from concurrent consumers
+	out   *csv.Writer
+}
+
+// newCSVWriter writes the header immediately, so it precedes every row no matter which consumer
+// writes first.
+func newCSVWriter(out io.Writer) (*csvWriter, error) {
+	w := &csvWriter{out: csv.NewWriter(out)}
+	if err := w.out.Write(csvHeader); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (c *csvWriter) Write(w widget) error {
+	consumed := time.Now()
+	row := []string{w.id,
+		w.source,
+		strconv.Itoa(w.producerID),
+		w.time.Format(time.RFC3339Nano),
+		consumed.Format(time.RFC3339Nano),
+		strconv.FormatInt(w.latencyAt(consumed).Nanoseconds(), 10),
+		strconv.FormatBool(w.broken),
+		w.widgetType,
+		formatMetadata(w.metadata)}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.out.Write(row)
+}
+
+func (c *csvWriter) Flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.out.Flush()
+	return c.out.Error()
+}
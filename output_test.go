@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCSVOutput(t *testing.T) {
+	numConsumers := 4
+	numWidgets := 50
+	widgetChan := make(chan widget, numWidgets)
+	var wg sync.WaitGroup
+	wg.Add(numConsumers)
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+
+	var out bytes.Buffer
+	output, err := newWidgetWriter("csv", &out)
+	if err != nil {
+		t.Fatalf("Can't create csv writer: %v", err)
+	}
+
+	consumerGroup := newConsumerGroup(config{numConsumers: numConsumers}, widgetChan, &wg, &shouldStop, &shouldStopMutex, noopSink{}, output)
+	consumerGroup.spawnConsumers()
+	for i := 1; i <= numWidgets; i++ {
+		widgetChan <- widget{id: strconv.Itoa(i), source: "Producer_1", producerID: 1, time: time.Now(), broken: i == numWidgets}
+	}
+	close(widgetChan)
+	wg.Wait()
+	if err := output.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatalf("Output is not valid CSV: %v", err)
+	}
+	if len(rows) != numWidgets+1 {
+		t.Fatalf("Expected a header and %d rows, got %d rows", numWidgets, len(rows))
+	}
+	if !reflect.DeepEqual(rows[0], csvHeader) {
+		t.Errorf("First row is not the header: %v", rows[0])
+	}
+
+	broken := 0
+	for _, row := range rows[1:] {
+		if reflect.DeepEqual(row, csvHeader) {
+			t.Errorf("Header written more than once")
+		}
+		if latency, err := strconv.ParseInt(row[5], 10, 64); err != nil || latency < 0 {
+			t.Errorf("Invalid latency in row %v", row)
+		}
+		if row[1] != "Producer_1" || row[2] != "1" {
+			t.Errorf("Invalid producer in row %v", row)
+		}
+		if row[6] == "true" {
+			broken++
+		}
+	}
+	if broken != 1 || !shouldStop {
+		t.Errorf("Broken widget not reported and signaled")
+	}
+}
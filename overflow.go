@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// OVERFLOW LOGIC
+// The widget channel is a bounded FIFO, so by default a producer that finds it full waits for a
+// consumer to make room. -overflow models a lossy transport instead: the channel is treated as a
+// ring buffer, and a producer that finds it full sheds a widget rather than waiting, either the
+// oldest one buffered or the one it was about to send.
+
+// What a producer does when the channel is full.
+const (
+	overflowBlock      = "block"       // wait for room, the default
+	overflowDropOldest = "drop-oldest" // take the oldest buffered widget off the channel to make room
+	overflowDropNewest = "drop-newest" // drop the widget being sent
+)
+
+// offer puts w on widgetChan without waiting, shedding a widget per the overflow policy if the
+// channel is full. A consumer can take the room freed by dropping the oldest widget before this
+// producer sends, in which case another is dropped, so one offer may drop several widgets.
+func (g *producerGroup) offer(w widget) {
+	for {
+		select {
+		case g.widgetChan <- w:
+			return
+		default:
+		}
+		if g.overflow == overflowDropNewest {
+			g.dropped.Add(1)
+			return
+		}
+		select {
+		case <-g.widgetChan:
+			g.dropped.Add(1)
+		default: // a consumer made room
+		}
+	}
+}
+
+// reportDropped reports how many widgets were shed because the channel was full, and returns the
+// count.
+func reportDropped(cfg config, g *producerGroup) int {
+	dropped := int(g.dropped.Load())
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped %d widgets when the buffer overflowed (-overflow %s)\n", dropped, cfg.overflow)
+	}
+	return dropped
+}
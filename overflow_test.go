@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gatedHandler records the ids of widgets handled, holding every consumer back until released.
+type gatedHandler struct {
+	release chan struct{}
+	mutex   sync.Mutex
+	ids     []string
+}
+
+func (h *gatedHandler) Handle(w widget) error {
+	<-h.release
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.ids = append(h.ids, w.id)
+	return nil
+}
+
+func TestOverflow(t *testing.T) {
+	// The consumer may or may not have taken the first widget before the buffer fills, so either
+	// it's consumed along with what was buffered, or it's buffered and dropped like the rest
+	for policy, want := range map[string][][]string{
+		overflowDropNewest: {{"1", "2", "3", "4", "5", "6"}, {"1", "2", "3", "4", "5"}},
+		overflowDropOldest: {{"1", "46", "47", "48", "49", "50"}, {"46", "47", "48", "49", "50"}},
+	} {
+		cfg, err := parseConfig([]string{"-n", "50", "-c", "1", "-buffer", "5", "-overflow", policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := &gatedHandler{release: make(chan struct{})}
+		cfg.handler, cfg.out = handler, io.Discard
+		p, err := NewPipeline(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan Result)
+		go func() {
+			result, err := p.Run(nil)
+			if err != nil {
+				t.Error(err)
+			}
+			done <- result
+		}()
+
+		// Producers never wait on a full buffer, so all of them finish while the consumer is held
+		deadline := time.Now().Add(5 * time.Second)
+		for p.Status().Produced < 50 || p.Status().Producers > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: producers blocked with the consumer held", policy)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(handler.release)
+		result := <-done
+
+		if !slices.Equal(handler.ids, want[0]) && !slices.Equal(handler.ids, want[1]) {
+			t.Errorf("%s: consumed %v, expected %v or %v", policy, handler.ids, want[0], want[1])
+		}
+		if result.Produced != 50 || result.Consumed+result.Dropped != 50 || result.Consumed != len(handler.ids) {
+			t.Errorf("%s: produced %d, consumed %d, and dropped %d widgets", policy, result.Produced, result.Consumed, result.Dropped)
+		}
+	}
+}
+
+func TestOverflowOptions(t *testing.T) {
+	for _, args := range [][]string{
+		{"-overflow", "drop-everything"},
+		{"-overflow", "drop-oldest", "-buffer", "0"},
+		{"-overflow", "drop-newest", "-batchsize", "5"},
+		{"-overflow", "drop-newest", "-maxinflight", "5"},
+		{"-overflow", "drop-oldest", "-ack"},
+		{"-overflow", "drop-oldest", "-sendtimeout", "1s"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v not rejected", args)
+		}
+	}
+	if _, err := parseConfig([]string{"-overflow", "block", "-buffer", "0"}); err != nil {
+		t.Errorf("-overflow block rejected: %v", err)
+	}
+}
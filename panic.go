@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+)
+
+// PANIC LOGIC
+// A buggy custom handler might panic. Unrecovered, a panic in any consumer takes the whole program
+// down with it, leaving the widgets still buffered undrained and the run unreported. Consumers
+// recover from handler panics instead, treating each as an error from the handler: it's logged
+// along with the handler's stack, counted, and the consumer carries on with the next widget. Under
+// -panic-policy abort a panic is a fatal error, which stops the pipeline as any other would.
+
+// What a consumer does once its handler has panicked.
+const (
+	panicContinue = "continue" // log it and handle the next widget, the default
+	panicAbort    = "abort"    // stop the pipeline, as a *FatalError from the handler does
+)
+
+// PanicError is the error from a handler that panicked.
+type PanicError struct {
+	Value any    // what the handler panicked with
+	Stack []byte // the handler's goroutine stack when it panicked
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("handler panicked: %v", e.Value) }
+
+// callHandler passes w to consumer consumerNum's handler, returning a *PanicError if it panics,
+// wrapped in a *FatalError under -panic-policy abort. If -consumer-error-rate picks w to fail, it
+// returns ErrInjected without calling the handler.
+func (g *consumerGroup) callHandler(w widget, consumerNum int) (err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			g.panics.Add(1)
+			err = &PanicError{Value: value, Stack: debug.Stack()}
+			if g.panicPolicy == panicAbort {
+				err = &FatalError{Err: err}
+			}
+		}
+	}()
+	if g.injector != nil && g.injector.fail(w, consumerNum-g.consumerOffset-1) {
+		return ErrInjected
+	}
+	handler := g.handlerFor(consumerNum)
+	if h, ok := handler.(ContextHandler); ok {
+		return h.HandleContext(g.ctx, w)
+	}
+	return handler.Handle(w)
+}
+
+// reportPanics reports how many times handlers panicked, and returns the count.
+func reportPanics(cfg config, g *consumerGroup) int {
+	panics := int(g.panics.Load())
+	if panics > 0 {
+		fmt.Fprintf(os.Stderr, "Recovered from %d handler panics (-panic-policy %s)\n", panics, cfg.panicPolicy)
+	}
+	return panics
+}
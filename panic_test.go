@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+// panickingHandler panics on one widget id and records every other widget handled.
+type panickingHandler struct {
+	id      string
+	mutex   sync.Mutex
+	handled []string
+}
+
+func (h *panickingHandler) Handle(w widget) error {
+	if w.id == h.id {
+		panic("can't handle widget " + w.id)
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.handled = append(h.handled, w.id)
+	return nil
+}
+
+func TestHandlerPanic(t *testing.T) {
+	cfg, err := parseConfig([]string{"-n", "20", "-c", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &panickingHandler{id: "5"}
+	cfg.handler, cfg.out = handler, io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil {
+		t.Fatalf("Run failed with -panic-policy continue: %v", err)
+	}
+	if result.Panics != 1 || result.Consumed != 20 || len(handler.handled) != 19 {
+		t.Errorf("%d panics, %d widgets consumed and %d handled, expected 1, 20, and 19", result.Panics, result.Consumed, len(handler.handled))
+	}
+
+	// Aborting stops the run with the panic as its error
+	cfg, err = parseConfig([]string{"-n", "20", "-c", "2", "-panic-policy", "abort"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler = &panickingHandler{id: "5"}
+	cfg.handler, cfg.out = handler, io.Discard
+	result, err = RunPipeline(cfg, nil)
+	var fatal *FatalError
+	var panicked *PanicError
+	if !errors.As(err, &fatal) || !errors.As(err, &panicked) || panicked.Value != "can't handle widget 5" || len(panicked.Stack) == 0 {
+		t.Errorf("Run with -panic-policy abort returned %v, expected a fatal panic", err)
+	}
+	if result.Panics != 1 {
+		t.Errorf("%d panics, expected 1", result.Panics)
+	}
+
+	if _, err := parseConfig([]string{"-panic-policy", "ignore"}); err == nil {
+		t.Error("Unknown panic policy accepted")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// PAYLOAD LOGIC
+// -payloadsize gives every widget a payload of random bytes. It's either a fixed size, like 1024,
+// or a range, like 100-4096, from which each widget's size is picked at random using the run's
+// seed, to model messages of varying size and the allocation patterns they cause.
+
+// sizeRange is the value of -payloadsize: the fewest and most bytes of payload a widget carries.
+type sizeRange struct {
+	min, max int
+}
+
+// parseSizeRange parses a size like "1024", or a range like "100-4096" that includes both ends.
+func parseSizeRange(value string) (sizeRange, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-") {
+		return sizeRange{}, errors.New("payload size can't be negative")
+	}
+	low, high, isRange := strings.Cut(value, "-")
+	if !isRange {
+		high = low
+	}
+	min, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		return sizeRange{}, errors.New("can't convert payload size " + value)
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(high))
+	if err != nil {
+		return sizeRange{}, errors.New("can't convert payload size " + value)
+	}
+	if max < 0 {
+		return sizeRange{}, errors.New("payload size can't be negative")
+	}
+	if min > max {
+		return sizeRange{}, errors.New("payload size range " + value + " has its minimum above its maximum")
+	}
+	return sizeRange{min: min, max: max}, nil
+}
+
+func (r sizeRange) String() string {
+	if r.min == r.max {
+		return strconv.Itoa(r.min)
+	}
+	return fmt.Sprintf("%d-%d", r.min, r.max)
+}
+
+// size returns the size of a widget's payload, picked using rng for a range.
+func (r sizeRange) size(rng *rand.Rand) int {
+	if r.min == r.max {
+		return r.min
+	}
+	return r.min + rng.Intn(r.max-r.min+1)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseSizeRange(t *testing.T) {
+	for value, expected := range map[string]sizeRange{"1024": {1024, 1024}, "100-4096": {100, 4096}, "0-10": {0, 10}, "7-7": {7, 7}} {
+		if r, err := parseSizeRange(value); err != nil || r != expected {
+			t.Errorf("%q parsed as %v, %v, expected %v", value, r, err, expected)
+		}
+	}
+	for value, expected := range map[string]string{"-5": "negative", "10--5": "negative", "4096-100": "minimum above its maximum", "big": "can't convert", "1-": "can't convert"} {
+		if _, err := parseSizeRange(value); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q gave error %v, expected one about %q", value, err, expected)
+		}
+	}
+}
+
+func TestPayloadSizeRange(t *testing.T) {
+	sizes := func(seed int64) []int {
+		cfg, err := parseConfig([]string{"-n", "200", "-payloadsize", "100-200"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.seed = seed
+		var wg sync.WaitGroup
+		shouldStop := false
+		producerGroup := newProducerGroup(cfg, make(chan widget), &shouldStop, &wg, &sync.Mutex{})
+		var sizes []int
+		for range 200 {
+			w, _ := producerGroup.getWidget(1)
+			sizes = append(sizes, len(w.payload))
+		}
+		return sizes
+	}
+
+	first := sizes(1)
+	seen := make(map[int]bool)
+	for _, size := range first {
+		if size < 100 || size > 200 {
+			t.Fatalf("Payload of %d bytes, expected 100 to 200", size)
+		}
+		seen[size] = true
+	}
+	if len(seen) < 50 {
+		t.Errorf("Only %d different payload sizes in 200 widgets", len(seen))
+	}
+	// The sizes are picked from the seed, so a rerun makes the same ones
+	for i, size := range sizes(1) {
+		if size != first[i] {
+			t.Fatalf("Widget %d's payload is %d bytes on a rerun, expected %d", i+1, size, first[i])
+		}
+	}
+}
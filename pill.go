@@ -0,0 +1,33 @@
+package main
+
+// POISON PILL LOGIC
+// With -shutdown pill, consumers are told production has finished by a poison pill sent after the
+// last widget, rather than by closing the channel. That suits a channel which can't be closed
+// because something else might still send on it. The consumer that swallows a pill passes a new
+// one on for those still running, so each consumer takes exactly one pill and then returns.
+
+// Ways of telling consumers that production has finished.
+const (
+	shutdownClose = "close" // close the channel
+	shutdownPill  = "pill"  // send a poison pill down it
+)
+
+// poisonPill returns a pill for the given number of consumers still to stop, counting the one
+// that receives it.
+func poisonPill(remaining int) widget {
+	return widget{id: "poison-pill", pill: remaining}
+}
+
+// swallowPill counts a pill taken from widgetChan by a consumer, which then returns, and passes a
+// pill on to the next consumer if any remain. Once the drain has timed out the other consumers
+// return anyway, so passing it on is given up rather than risk blocking on a full channel.
+func (g *consumerGroup) swallowPill(widgetChan chan widget, pill widget) {
+	g.pills.Add(1)
+	if pill.pill > 1 {
+		select {
+		case widgetChan <- poisonPill(pill.pill - 1):
+		case <-g.drainExpired:
+		case <-g.ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPoisonPillShutdown(t *testing.T) {
+	for _, args := range [][]string{
+		{"-c", "1"},
+		{"-c", "4"},
+		{"-c", "8", "-buffer", "0"},
+		{"-c", "3", "-p", "3", "-reorder-window", "5"},
+	} {
+		cfg, err := parseConfig(append([]string{"-shutdown", "pill", "-n", "200", "-seed", "1"}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.out = io.Discard
+		p, err := NewPipeline(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan Result)
+		go func() {
+			result, err := p.Run(nil)
+			if err != nil {
+				t.Error(err)
+			}
+			done <- result
+		}()
+
+		select {
+		case result := <-done:
+			if result.Consumed != 200 || result.Abandoned != 0 {
+				t.Errorf("%v: consumed %d and abandoned %d of 200 widgets", args, result.Consumed, result.Abandoned)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: consumers didn't all stop", args)
+		}
+		if pills := p.consumers[0].pills.Load(); pills != int64(cfg.numConsumers) {
+			t.Errorf("%v: %d pills swallowed by %d consumers", args, pills, cfg.numConsumers)
+		}
+	}
+}
+
+func TestPoisonPillOptions(t *testing.T) {
+	for _, args := range [][]string{
+		{"-shutdown", "eventually"},
+		{"-shutdown", "pill", "-batchsize", "5"},
+		{"-shutdown", "pill", "-fanout", "2"},
+		{"-shutdown", "pill", "-weights", "1,2", "-c", "2"},
+		{"consume", "-shutdown", "pill"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v was accepted", args)
+		}
+	}
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PIPELINE LOGIC
+// Pipeline is a run of producers and consumers in this process, communicating over a channel.
+// NewPipeline sets a run up and Run carries it out. Status may be called from any goroutine in
+// the meantime, e.g. by a health check in a service embedding the pipeline.
+type Pipeline struct {
+	cfg             config
+	producers       producerGroup
+	consumers       []*consumerGroup // one group, or one per -fanout stream
+	producerWG      sync.WaitGroup
+	consumerWG      sync.WaitGroup
+	shouldStop      bool
+	shouldStopMutex sync.Mutex
+	widgetChan      chan widget
+	producedChan    chan widget // what producers send on, passed on to widgetChan by the dedup stage; widgetChan without -dedup
+	dedup           *deduper    // with -dedup
+	batchChan       chan []widget
+	sink            Sink
+	output          widgetWriter
+	handler         WidgetHandler // closed once the consumers are done with it, if it's an io.Closer
+	cleanup         []func()      // releases what NewPipeline acquired, run in reverse order
+	running         atomic.Bool
+	acks            *ackTracker        // with -ack
+	cancel          context.CancelFunc // cancels cfg.ctx, abandoning the run
+}
+
+// ErrProductionStopped is returned, wrapped with the offending widget's id, when a broken widget
+// signaled production to stop. The Result still describes what was done.
+var ErrProductionStopped = errors.New("production stopped early")
+
+// ErrMaxRuntime is returned when a run outlasts -maxruntime, which usually means it deadlocked.
+var ErrMaxRuntime = errors.New("run exceeded its maximum run time")
+
+// Result summarizes a finished run of the pipeline.
+type Result struct {
+	Produced     int                // widgets made by producers
+	Consumed     int                // widgets handled by consumers, counted once per group with -fanout
+	Abandoned    int                // widgets left unconsumed when the drain timed out
+	Duplicates   int                // widgets whose id had already been consumed, counted only with -verify-unique
+	OutOfOrder   int                // widgets received before a later one from the same producer, counted only with -verify-order
+	Expired      int                // widgets dropped for exceeding the ttl
+	Dropped      int                // widgets shed by producers because the channel was full, only with -overflow
+	Suppressed   int                // widgets whose id had already been produced, held back from consumers with -dedup
+	DeadLettered int                // broken widgets set aside while the circuit breaker tolerated them
+	Broken       int                // broken widgets consumed, including dead-lettered ones
+	Latency      Latency            // from production to handling, only measured with -report or -histogram
+	Unacked      int                // widgets sent but never acknowledged, only tracked with -ack
+	Panics       int                // times the handler panicked and was recovered from
+	Injected     int                // widgets failed on purpose by -consumer-error-rate, tallied as failed too
+	Results      map[ResultCode]int // widgets by final result, summing to Produced (once per group with -fanout)
+	Elapsed      time.Duration      // from starting producers until the last consumer returned
+}
+
+// Status is a snapshot of a pipeline's progress.
+type Status struct {
+	Running   bool // Run has started and not yet returned
+	Stopping  bool // production has been signaled to stop
+	Producers int  // producer goroutines still running
+	Consumers int  // consumer goroutines still running
+	Produced  int  // widgets made so far
+	Consumed  int  // widgets handled so far
+	Queued    int  // widgets waiting in the channel, or batches when batching
+	HighWater int  // highest id consumed so far, by the group furthest behind with -fanout; ids below it may not be
+}
+
+// RunPipeline runs producers and consumers in this process, communicating over a channel, and
+// returns once every consumer has finished. Production stops gracefully on the first signal
+// received on signals. If a broken widget stops production, the error wraps ErrProductionStopped.
+func RunPipeline(cfg config, signals <-chan os.Signal) (Result, error) {
+	p, err := NewPipeline(cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	return p.Run(signals)
+}
+
+// NewPipeline opens everything a run needs -- the replay log, forwarding connection, span exporter,
+// sink, and admin API -- so a bad configuration fails before any widgets are produced. Run must
+// be called to release them.
+func NewPipeline(cfg config) (*Pipeline, error) {
+	if _, err := validateRunnable(cfg); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(cfg.context())
+	cfg.ctx = ctx
+	p := &Pipeline{cfg: cfg, sink: cfg.customSink, handler: cfg.handler, cancel: cancel}
+	if err := p.open(); err != nil {
+		p.release()
+		p.finish()
+		cancel()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Pipeline) open() error {
+	cfg := p.cfg
+	if cfg.replay != "" {
+		replay, err := openReplay(cfg.replay, cfg.replayRebase, cfg.replayPace)
+		if err != nil {
+			return err
+		}
+		p.cleanup = append(p.cleanup, func() { replay.Close() })
+		cfg.source = replay
+	}
+	if cfg.from != "" {
+		listed, err := openTextSource(cfg.from)
+		if err != nil {
+			return err
+		}
+		p.cleanup = append(p.cleanup, func() { listed.Close() })
+		cfg.source = listed
+	}
+	if cfg.forward != "" {
+		forwarder, err := dialForward(cfg.forward)
+		if err != nil {
+			return err
+		}
+		cfg.handler, p.handler = forwarder, forwarder
+	}
+	if cfg.otel != "" {
+		endpoint, err := otelEndpoint(cfg.otel)
+		if err != nil {
+			return err
+		}
+		cfg.tracer = newSpanExporter(endpoint, cfg.runID)
+		p.cleanup = append(p.cleanup, cfg.tracer.Close)
+	}
+
+	var err error
+	if p.sink == nil {
+		if p.sink, err = openRoutedSink(cfg.sink, cfg.classifier()); err != nil {
+			return err
+		}
+	}
+	if p.output, err = newWidgetWriter(cfg.format, cfg.stdout()); err != nil {
+		return err
+	}
+
+	bufferSize := cfg.channelBuffer()
+	if cfg.batchSize > 1 {
+		// Buffer the same number of widgets, just grouped into batches
+		p.batchChan = make(chan []widget, max(1, bufferSize/cfg.batchSize))
+	} else {
+		p.widgetChan = make(chan widget, bufferSize)
+	}
+	p.producedChan = p.widgetChan
+	if cfg.dedup {
+		p.producedChan = make(chan widget, bufferSize)
+		p.dedup = newDeduper()
+	}
+
+	// https://stackoverflow.com/questions/19208725/example-for-sync-waitgroup-correct
+	p.producerWG.Add(cfg.numProducers)
+	p.consumerWG.Add(cfg.numConsumers)
+
+	p.producers = newProducerGroup(cfg, p.producedChan, &p.shouldStop, &p.producerWG, &p.shouldStopMutex)
+	p.producers.batchChan = p.batchChan
+	if cfg.fanout > 1 {
+		// Each group drains its own copy of the stream
+		p.consumerWG.Add(cfg.numConsumers * (cfg.fanout - 1))
+		for i := 0; i < cfg.fanout; i++ {
+			group := newConsumerGroup(cfg, make(chan widget, bufferSize), &p.consumerWG, &p.shouldStop, &p.shouldStopMutex, p.sink, p.output)
+			group.consumerOffset = i * cfg.numConsumers
+			p.consumers = append(p.consumers, &group)
+		}
+	} else {
+		group := newConsumerGroup(cfg, p.widgetChan, &p.consumerWG, &p.shouldStop, &p.shouldStopMutex, p.sink, p.output)
+		group.batchChan = p.batchChan
+		if cfg.ordered {
+			group.ordered = newOrderedPrinter(&group, p.producers.idStart)
+		}
+		if cfg.maxInFlight > 0 {
+			group.inflight = make(chan struct{}, cfg.maxInFlight)
+			p.producers.inflight = group.inflight
+		}
+		if cfg.ack {
+			p.acks = newAckTracker(bufferSize)
+			p.producers.acks, group.acks = p.acks, p.acks
+		}
+		if cfg.weights != nil {
+			group.consumerChans = make([]chan widget, cfg.numConsumers)
+			for i := range group.consumerChans {
+				group.consumerChans[i] = make(chan widget, max(1, bufferSize/cfg.numConsumers))
+			}
+		}
+		p.consumers = []*consumerGroup{&group}
+	}
+	// Whichever group finds a broken widget, the first one found is what stopped production
+	for _, group := range p.consumers[1:] {
+		group.brokenID = p.consumers[0].brokenID
+	}
+
+	if cfg.checkpoint != "" {
+		if err := p.resume(cfg.checkpoint); err != nil {
+			return err
+		}
+	}
+
+	if cfg.admin != "" {
+		stopAdmin, err := startAdmin(cfg.admin, &p.producers, p.consumers[0].window, cfg.runID)
+		if err != nil {
+			return err
+		}
+		p.cleanup = append(p.cleanup, stopAdmin)
+	}
+	if cfg.pprof != "" {
+		stopPprof, err := startPprof(cfg.pprof)
+		if err != nil {
+			return err
+		}
+		p.cleanup = append(p.cleanup, stopPprof)
+	}
+	return nil
+}
+
+// resume opens the checkpoint at path, so widgets consumed by an earlier run aren't produced again
+// and those consumed now are recorded.
+func (p *Pipeline) resume(path string) error {
+	cp, err := openCheckpoint(path)
+	if err != nil {
+		return err
+	}
+	p.cleanup = append(p.cleanup, func() {
+		if err := cp.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't close checkpoint: %v\n", err)
+		}
+	})
+
+	if done := cp.doneBetween(p.producers.idStart, p.cfg.numWidgets); done > 0 {
+		fmt.Fprintf(os.Stderr, "Resuming from %s: %d of %d widgets already consumed\n", path, done, p.cfg.numWidgets)
+		p.producers.numOfWidgets.Add(int64(-done))
+	}
+	p.producers.checkpoint = cp
+	for _, group := range p.consumers {
+		group.checkpoint = cp
+	}
+	return nil
+}
+
+// finish flushes the output and closes the sink and the handler, once the consumers are done with
+// them or the pipeline failed to open. Whichever sink and handler the run was given, it owns them.
+func (p *Pipeline) finish() error {
+	return errors.Join(finishConsumers(p.output, p.sink), closeHandler(p.handler))
+}
+
+// release undoes open, in reverse order.
+func (p *Pipeline) release() {
+	for i := len(p.cleanup) - 1; i >= 0; i-- {
+		p.cleanup[i]()
+	}
+}
+
+// stop signals producers to stop gracefully.
+func (p *Pipeline) stop() {
+	requestStop(&p.shouldStop, &p.shouldStopMutex)
+}
+
+// Run carries out the run, returning once every consumer has finished. Production stops
+// gracefully on the first signal received on signals. Run may only be called once.
+//
+// With a maximum run time, a watchdog gives up on a run that outlasts it: production is stopped,
+// the run's context is cancelled so nothing is left waiting on a channel, and Run returns an error
+// wrapping ErrMaxRuntime once the run has finished, sink and handler closed. A handler blocked in
+// Handle can't be interrupted, only a ContextHandler can, so Run waits at most cancelGrace for the
+// run to finish; if it hasn't by then, it's left behind along with whatever it holds.
+func (p *Pipeline) Run(signals <-chan os.Signal) (Result, error) {
+	defer p.cancel()
+	if p.cfg.maxRuntime == 0 {
+		return p.run(signals)
+	}
+	timer := time.NewTimer(p.cfg.maxRuntime)
+	defer timer.Stop()
+
+	type outcome struct {
+		result Result
+		err    error
+	}
+	done := make(chan outcome, 1)
+	start := time.Now()
+	go func() {
+		result, err := p.run(signals)
+		done <- outcome{result, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.result, o.err
+	case <-timer.C:
+	}
+	status := p.Status()
+	err := fmt.Errorf("%w of %s, likely deadlocked: %d producers and %d consumers still running, %d goroutines",
+		ErrMaxRuntime, p.cfg.maxRuntime, status.Producers, status.Consumers, runtime.NumGoroutine())
+	p.stop()
+	p.cancel()
+
+	grace := time.NewTimer(cancelGrace)
+	defer grace.Stop()
+	select {
+	case o := <-done:
+		return o.result, err
+	case <-grace.C:
+	}
+	result := Result{Produced: status.Produced, Consumed: status.Consumed, Elapsed: time.Since(start)}
+	return result, fmt.Errorf("%w, and it didn't finish within %s of being cancelled", err, cancelGrace)
+}
+
+// cancelGrace is how long Run waits for a run given up on by -maxruntime to finish once cancelled.
+const cancelGrace = time.Second
+
+// run is Run without the watchdog.
+func (p *Pipeline) run(signals <-chan os.Signal) (Result, error) {
+	p.running.Store(true)
+	defer p.running.Store(false)
+	defer p.release()
+
+	finished := handleInterrupts(signals, p.cfg.forceAfter, p.stop, p.cfg.forceExit())
+	defer finished()
+
+	start := time.Now()
+	if p.acks != nil {
+		go p.acks.drain()
+	}
+	if p.dedup != nil {
+		// A suppressed widget is never taken by a consumer, so gives up its place in flight here, and
+		// is never acknowledged
+		go p.dedup.run(p.cfg.ctx, p.producedChan, p.widgetChan, func(w widget) {
+			p.consumers[0].releaseInFlight()
+			if p.acks != nil {
+				p.acks.forget(w.id)
+			}
+		})
+	}
+	if len(p.consumers) > 1 {
+		go fanOut(p.cfg.ctx, p.widgetChan, p.consumers)
+	} else if chans := p.consumers[0].consumerChans; chans != nil {
+		go dispatch(p.cfg.ctx, p.widgetChan, chans, p.cfg.weights)
+	}
+	p.producers.spawnProducers()
+	for _, group := range p.consumers {
+		group.spawnConsumers()
+	}
+	stopReporting := startThroughputReporter(os.Stderr, p.cfg.reportInterval, p.consumed, p.consumers[0].window)
+	stopProgress := func() {}
+	if p.cfg.progress {
+		// Every group consumes every widget
+		stopProgress = startProgressBar(os.Stderr, p.cfg.numWidgets*len(p.consumers), p.consumed)
+	}
+
+	p.producerWG.Wait() // Will wait until all producers exit
+	if p.dedup != nil {
+		// Let the dedup stage pass on what's left before the consumers are told to return
+		close(p.producedChan)
+		<-p.dedup.done
+	}
+
+	// Signal consumers to return
+	if p.batchChan != nil {
+		close(p.batchChan)
+	} else if p.cfg.shutdown == shutdownPill {
+		select {
+		case p.widgetChan <- poisonPill(p.cfg.numConsumers):
+		case <-p.cfg.ctx.Done():
+		}
+	} else {
+		close(p.widgetChan)
+	}
+	reportDuration(p.cfg, &p.producers)
+	reportProducerRates(p.cfg, &p.producers)
+	dropped := reportDropped(p.cfg, &p.producers)
+	suppressed := reportSuppressed(os.Stderr, p.dedup)
+	for _, group := range p.consumers {
+		group.startDrainTimer()
+	}
+	p.consumerWG.Wait()
+	stopProgress()
+	stopReporting()
+	result := Result{Produced: p.producers.produced(),
+		Consumed:   p.consumed(),
+		Dropped:    dropped,
+		Suppressed: suppressed,
+		Results:    make(map[ResultCode]int),
+		Elapsed:    time.Since(start)}
+	if dropped > 0 {
+		result.Results[resultDropped] = dropped
+	}
+	if suppressed > 0 {
+		// Every group would have consumed them
+		result.Results[resultSkipped] = suppressed * len(p.consumers)
+	}
+	var errs []error
+	if ordered := p.consumers[0].ordered; ordered != nil {
+		errs = append(errs, ordered.flush())
+	}
+	errs = append(errs, p.finish())
+	var allLatencies []time.Duration
+	for _, group := range p.consumers {
+		result.Abandoned += reportAbandoned(p.cfg, group)
+		result.Expired += reportExpired(p.cfg, group)
+		reportThrottle(os.Stderr, group.throttle)
+		result.Panics += reportPanics(p.cfg, group)
+		result.Injected += reportInjected(p.cfg, group)
+		result.DeadLettered += reportBreaker(p.cfg, group)
+		result.Broken += int(group.brokenCount.Load())
+		for _, latencies := range group.latencies {
+			allLatencies = append(allLatencies, latencies...)
+		}
+		result.Duplicates += int(group.duplicates.Load())
+		group.results.addTo(result.Results)
+		if group.order != nil {
+			result.OutOfOrder += int(group.order.violations.Load())
+		}
+		errs = append(errs, group.duplicateError(), group.orderError(), group.fatalError())
+	}
+	result.Latency = newLatency(allLatencies)
+	if p.cfg.histogram {
+		writeHistogram(os.Stderr, allLatencies, p.cfg.histogramBuckets)
+	}
+	if p.acks != nil {
+		result.Unacked = reportUnacked(os.Stderr, p.acks.unacked())
+	}
+	errs = append(errs, p.consumers[0].stoppedError())
+	// Every group sees the whole stream, so one group's tallies describe it
+	p.consumers[0].typeTallies.report(os.Stderr)
+	if tallies := p.consumers[0].sourceTallies; tallies != nil {
+		tallies.report(os.Stderr)
+	}
+	reportResults(os.Stderr, result.Results)
+
+	return result, errors.Join(errs...)
+}
+
+// consumed totals the widgets handled by every consumer group.
+func (p *Pipeline) consumed() int {
+	consumed := 0
+	for _, group := range p.consumers {
+		consumed += int(group.consumed.Load())
+	}
+	return consumed
+}
+
+// consumersAlive totals the consumers still running in every group.
+func (p *Pipeline) consumersAlive() int {
+	alive := 0
+	for _, group := range p.consumers {
+		alive += int(group.alive.Load())
+	}
+	return alive
+}
+
+// fanOut copies every widget from in to each group's channel, closing those channels once in is
+// closed or ctx is cancelled. Delivery to one group waits for it to have room, so the slowest group
+// sets the pace.
+func fanOut(ctx context.Context, in <-chan widget, groups []*consumerGroup) {
+	defer func() {
+		for _, group := range groups {
+			close(group.widgetChan)
+		}
+	}()
+	for w := range in {
+		for _, group := range groups {
+			select {
+			case group.widgetChan <- w:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// Status reports the pipeline's progress. It is safe to call at any time, from any goroutine.
+func (p *Pipeline) Status() Status {
+	queued := len(p.widgetChan) + len(p.batchChan)
+	if p.dedup != nil {
+		queued += len(p.producedChan)
+	}
+	return Status{Running: p.running.Load(),
+		Stopping:  stopRequested(&p.shouldStop, &p.shouldStopMutex),
+		Producers: int(p.producers.alive.Load()),
+		Consumers: p.consumersAlive(),
+		Produced:  p.producers.produced(),
+		Consumed:  p.consumed(),
+		Queued:    queued,
+		HighWater: p.highWaterMark()}
+}
+
+// highWaterMark returns the lowest of the consumer groups' high-water marks, since every group
+// consumes the whole stream.
+func (p *Pipeline) highWaterMark() int {
+	mark := p.consumers[0].highWaterMark()
+	for _, group := range p.consumers[1:] {
+		mark = min(mark, group.highWaterMark())
+	}
+	return mark
+}
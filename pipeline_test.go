@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingHandler holds every consumer until release is closed.
+type blockingHandler struct {
+	release chan struct{}
+}
+
+func (h blockingHandler) Handle(w widget) error {
+	<-h.release
+	return nil
+}
+
+// waitingHandler holds every consumer until the run is cancelled, and records being closed.
+type waitingHandler struct {
+	closed atomic.Bool
+}
+
+func (h *waitingHandler) Handle(w widget) error {
+	return errors.New("Handle called instead of HandleContext")
+}
+
+func (h *waitingHandler) HandleContext(ctx context.Context, w widget) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (h *waitingHandler) Close() error {
+	h.closed.Store(true)
+	return nil
+}
+
+func TestPipelineStatus(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.numWidgets, cfg.numProducers, cfg.numConsumers = 100, 2, 3
+	handler := blockingHandler{release: make(chan struct{})}
+	cfg.handler = handler
+	cfg.out = io.Discard
+	p, err := NewPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.Status(); s.Running || s.Produced != 0 {
+		t.Errorf("Unexpected status before running: %+v", s)
+	}
+
+	done := make(chan Result)
+	go func() {
+		result, _ := p.Run(nil)
+		done <- result
+	}()
+
+	// Producers finish while every consumer is stuck on its first widget
+	deadline := time.Now().Add(5 * time.Second)
+	for s := p.Status(); s.Producers > 0 || s.Produced < 100; s = p.Status() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Producers never finished: %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if s := p.Status(); !s.Running || s.Consumers != 3 || s.Consumed != 0 || s.Queued != 100-3 {
+		t.Errorf("Unexpected status while consumers are blocked: %+v", s)
+	}
+
+	close(handler.release)
+	result := <-done
+	if s := p.Status(); s.Running || s.Consumers != 0 || s.Consumed != 100 || result.Consumed != 100 {
+		t.Errorf("Unexpected status after running: %+v", s)
+	}
+}
+
+// tallyingHandler counts how many times each widget id is handled.
+type tallyingHandler struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func (h *tallyingHandler) Handle(w widget) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.counts[w.id]++
+	return nil
+}
+
+func TestProductionStopped(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.numWidgets, cfg.kthBadWidget, cfg.bufferSize = 1000, 5, 0
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if !errors.Is(err, ErrProductionStopped) || !strings.Contains(err.Error(), "widget 5") {
+		t.Errorf("Broken widget stop not reported: %v", err)
+	}
+	if result.Consumed < 5 || result.Produced >= 1000 {
+		t.Errorf("Unexpected result after a broken widget: %+v", result)
+	}
+
+	// A complete run succeeds
+	cfg.kthBadWidget = -1
+	if result, err := RunPipeline(cfg, nil); err != nil || result.Consumed != 1000 {
+		t.Errorf("Complete run reported %d consumed: %v", result.Consumed, err)
+	}
+}
+
+func TestNoGoroutineLeak(t *testing.T) {
+	// Every goroutine a run starts must have exited by the time RunPipeline returns
+	before := runtime.NumGoroutine()
+	for _, args := range [][]string{
+		{"-n", "1000", "-p", "4", "-c", "4"},
+		{"-n", "1000", "-k", "10"},
+		{"-n", "1000", "-batchsize", "16"},
+		{"-n", "1000", "-fanout", "3"},
+		{"-n", "1000", "-c", "2", "-weights", "1,3"},
+		{"-n", "1000", "-reorder-window", "8", "-ordered"},
+		{"-duration", "20ms"},
+	} {
+		cfg, err := parseConfig(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.out = io.Discard
+		if _, err := RunPipeline(cfg, nil); err != nil && !errors.Is(err, ErrProductionStopped) {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+
+	// Goroutines that have been told to exit may not have been scheduled yet
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before running, %d after", before, after)
+	}
+}
+
+func TestMaxRuntime(t *testing.T) {
+	// Consumers that never return would hang the run without the watchdog
+	cfg := defaultConfig()
+	cfg.numWidgets, cfg.maxRuntime = 100, 200*time.Millisecond
+	handler := blockingHandler{release: make(chan struct{})}
+	defer close(handler.release)
+	cfg.handler = handler
+	cfg.out = io.Discard
+	start := time.Now()
+	_, err := RunPipeline(cfg, nil)
+	if !errors.Is(err, ErrMaxRuntime) || !strings.Contains(err.Error(), "1 consumers still running") ||
+		!strings.Contains(err.Error(), "didn't finish") {
+		t.Errorf("Watchdog didn't report the stuck run: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Watchdog took %s to give up", elapsed)
+	}
+
+	// Cancelling the run frees producers waiting to send and a handler that takes the context, so the
+	// run has finished, its handler closed, by the time the watchdog reports it
+	waiting := &waitingHandler{}
+	cfg.handler, cfg.bufferSize, cfg.numConsumers = waiting, 0, 2
+	start = time.Now()
+	_, err = RunPipeline(cfg, nil)
+	if !errors.Is(err, ErrMaxRuntime) || strings.Contains(err.Error(), "didn't finish") || !waiting.closed.Load() {
+		t.Errorf("Cancelled run didn't finish before the watchdog reported it (closed %t): %v", waiting.closed.Load(), err)
+	}
+	if elapsed := time.Since(start); elapsed > cfg.maxRuntime+cancelGrace {
+		t.Errorf("Watchdog took %s to give up on a run it could cancel", elapsed)
+	}
+	cfg.bufferSize, cfg.numConsumers = -1, 1
+
+	// A run that finishes in time is unaffected
+	cfg.handler, cfg.maxRuntime = nil, time.Minute
+	if result, err := RunPipeline(cfg, nil); err != nil || result.Consumed != 100 {
+		t.Errorf("Run within the maximum reported %d consumed: %v", result.Consumed, err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.numWidgets, cfg.bufferSize, cfg.breakerThreshold = 1000, 0, 5
+	cfg.types = []widgetType{{"dud", 1}}
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if !errors.Is(err, ErrProductionStopped) || !strings.Contains(err.Error(), "widget 6") {
+		t.Errorf("Breaker didn't trip at the sixth broken widget: %v", err)
+	}
+	if result.DeadLettered != 5 || result.Produced >= 1000 {
+		t.Errorf("Unexpected result after the breaker tripped: %+v", result)
+	}
+
+	// Broken widgets under the threshold don't stop production
+	cfg.types, cfg.kthBadWidget = nil, 500
+	result, err = RunPipeline(cfg, nil)
+	if err != nil || result.Consumed != 1000 || result.DeadLettered != 1 {
+		t.Errorf("Breaker tripped below its threshold: %+v, %v", result, err)
+	}
+}
+
+func TestFanout(t *testing.T) {
+	cfg, err := parseConfig([]string{"-fanout", "3", "-c", "2", "-n", "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &tallyingHandler{counts: make(map[string]int)}
+	cfg.handler = handler
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Consumed != 300 {
+		t.Fatalf("Consumed %d widgets, expected 300: %v", result.Consumed, err)
+	}
+	for i := 1; i <= 100; i++ {
+		if n := handler.counts[strconv.Itoa(i)]; n != 3 {
+			t.Errorf("Widget %d handled %d times, expected once per group", i, n)
+		}
+	}
+
+	// Whichever group finds the broken widget, production stops
+	cfg.handler = nil
+	cfg.numWidgets, cfg.kthBadWidget, cfg.bufferSize = 100000, 10, 0
+	result, err = RunPipeline(cfg, nil)
+	if !errors.Is(err, ErrProductionStopped) || result.Produced >= 100000 {
+		t.Errorf("Broken widget didn't stop a fanned out run: %d produced, %v", result.Produced, err)
+	}
+
+	if _, err := parseConfig([]string{"-fanout", "2", "-batchsize", "10"}); err == nil {
+		t.Errorf("-fanout with batching not rejected")
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	cases := []struct {
+		producers, consumers, buffer, prefetch int
+	}{
+		{1, 1, 0, 1},
+		{1, 1, 1000, 1},
+		{1, 1, 1000, 64},
+		{4, 4, 0, 1},
+		{4, 4, 1000, 1},
+		{4, 4, 1000, 64},
+		{16, 16, 1000, 1},
+		{16, 16, 100000, 1},
+		{16, 16, 100000, 64},
+	}
+	for _, c := range cases {
+		b.Run(fmt.Sprintf("p=%d/c=%d/buffer=%d/prefetch=%d", c.producers, c.consumers, c.buffer, c.prefetch), func(b *testing.B) {
+			cfg := defaultConfig()
+			cfg.numWidgets = b.N
+			cfg.numProducers = c.producers
+			cfg.numConsumers = c.consumers
+			cfg.bufferSize = c.buffer
+			cfg.prefetch = c.prefetch
+			cfg.out = io.Discard
+
+			b.ResetTimer()
+			result, err := RunPipeline(cfg, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if result.Consumed != b.N {
+				b.Fatalf("Consumed %d widgets, expected %d", result.Consumed, b.N)
+			}
+			b.ReportMetric(float64(result.Consumed)/result.Elapsed.Seconds(), "widgets/sec")
+		})
+	}
+}
+
+// closingSink counts the widgets written to it and how often it's closed, failing writes after Close.
+type closingSink struct {
+	written atomic.Int64
+	closes  atomic.Int64
+}
+
+func (s *closingSink) Write(w widget, result ResultCode) error {
+	if s.closes.Load() > 0 {
+		return errors.New("write after close")
+	}
+	s.written.Add(1)
+	return nil
+}
+
+func (s *closingSink) Close() error {
+	s.closes.Add(1)
+	return nil
+}
+
+// closingHandler counts how often it's closed, returning a fatal error for widget fail.
+type closingHandler struct {
+	fail   string
+	closes atomic.Int64
+}
+
+func (h *closingHandler) Handle(w widget) error {
+	if w.id == h.fail {
+		return &FatalError{Err: errors.New("can't handle widget " + w.id)}
+	}
+	return nil
+}
+
+func (h *closingHandler) Close() error {
+	h.closes.Add(1)
+	return errors.New("closed")
+}
+
+func TestClose(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		args []string
+		fail string
+	}{
+		{"finished", []string{"-n", "20", "-c", "3"}, ""},
+		{"stopped by a broken widget", []string{"-n", "20", "-c", "3", "-k", "5"}, ""},
+		{"stopped by a fatal error", []string{"-n", "20", "-c", "3"}, "5"},
+		{"failed to open", []string{"-n", "20", "-replay", "missing.jsonl"}, ""},
+	} {
+		cfg, err := parseConfig(tc.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sink, handler := &closingSink{}, &closingHandler{fail: tc.fail}
+		cfg.customSink, cfg.handler, cfg.out = sink, handler, io.Discard
+		result, err := RunPipeline(cfg, nil)
+		if sink.closes.Load() != 1 || handler.closes.Load() != 1 {
+			t.Errorf("%s: sink closed %d times and handler %d times, expected once each", tc.name, sink.closes.Load(), handler.closes.Load())
+		}
+		if int(sink.written.Load()) != result.Consumed {
+			t.Errorf("%s: sink recorded %d widgets of %d consumed", tc.name, sink.written.Load(), result.Consumed)
+		}
+		// The handler's error from Close is part of the run's
+		if tc.name != "failed to open" && (err == nil || !strings.Contains(err.Error(), "closed")) {
+			t.Errorf("%s: run returned %v, expected the error closing the handler", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// PROFILING LOGIC
+// -pprof serves the standard net/http/pprof handlers while the pipeline runs, under /debug/pprof/,
+// so CPU, heap, goroutine, and mutex profiles can be captured with go tool pprof. Mutex and block
+// profiling are off by default in the runtime, so they're turned on for as long as it's served.
+
+// mutexProfileFraction samples one in this many mutex contention events while profiling.
+const mutexProfileFraction = 5
+
+// newPprofHandler returns the pprof handlers on a mux of their own, rather than the default mux
+// that importing net/http/pprof registers them on.
+func newPprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// startPprof serves the pprof handlers on addr, and enables mutex and block profiling. Binding
+// happens before returning, so a bad address fails before any widgets are produced. The returned
+// function shuts the server down and puts the profiling rates back.
+func startPprof(addr string) (stop func(), err error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	previousFraction := runtime.SetMutexProfileFraction(mutexProfileFraction)
+	runtime.SetBlockProfileRate(1)
+	srv := &http.Server{Handler: newPprofHandler()}
+	go srv.Serve(ln)
+	return func() {
+		srv.Close()
+		runtime.SetMutexProfileFraction(previousFraction)
+		runtime.SetBlockProfileRate(0)
+	}, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPprof(t *testing.T) {
+	server := httptest.NewServer(newPprofHandler())
+	defer server.Close()
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/mutex?debug=1", "/debug/pprof/goroutine?debug=1"} {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || len(body) == 0 {
+			t.Errorf("GET %s returned %s", path, resp.Status)
+		}
+	}
+
+	// Mutex profiling is on only while serving
+	stop, err := startPprof("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fraction := runtime.SetMutexProfileFraction(-1); fraction != mutexProfileFraction {
+		t.Errorf("Mutex profile fraction is %d while profiling", fraction)
+	}
+	stop()
+	if fraction := runtime.SetMutexProfileFraction(-1); fraction != 0 {
+		t.Errorf("Mutex profile fraction left at %d", fraction)
+	}
+
+	if _, err := startPprof("not an address"); err == nil || !strings.Contains(err.Error(), "not an address") {
+		t.Errorf("Bad address not reported: %v", err)
+	}
+}
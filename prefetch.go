@@ -0,0 +1,36 @@
+package main
+
+// PREFETCH LOGIC
+// With -prefetch n, a consumer that receives a widget also takes up to n-1 more that are already
+// waiting in the channel, without waiting for any, and then handles them in order. That's the
+// consumers' counterpart to -batchsize: each widget costs a cheap non-blocking receive rather than
+// a turn through the consumer's full select. A consumer never waits to fill its prefetch, so other
+// consumers aren't kept waiting while widgets sit in one consumer's hands, though a large n lets
+// one consumer take most of a burst.
+//
+// Prefetching stops at a broken widget, so it's handled as soon as those taken before it, and
+// production is stopped no later than it would be without prefetching. Widgets already prefetched
+// are handled even if the drain times out meanwhile.
+
+// prefetchAfter appends to batch, which holds a widget just received from widgetChan, the widgets
+// waiting behind it, until batch holds g.prefetch widgets, the channel is empty, or a broken widget
+// has been taken. A poison pill or the channel closing also ends it; they're reported for the
+// consumer to act on once it has handled the batch.
+func (g *consumerGroup) prefetchAfter(widgetChan chan widget, batch []widget) (_ []widget, pill widget, closed bool) {
+	for len(batch) < g.prefetch && !batch[len(batch)-1].broken {
+		select {
+		case val, ok := <-widgetChan:
+			if !ok {
+				return batch, widget{}, true
+			}
+			if val.pill > 0 {
+				return batch, val, false
+			}
+			g.releaseInFlight()
+			batch = append(batch, val)
+		default:
+			return batch, widget{}, false
+		}
+	}
+	return batch, widget{}, false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"testing"
+)
+
+func TestPrefetch(t *testing.T) {
+	cfg, err := parseConfig([]string{"-n", "10000", "-p", "4", "-c", "4", "-buffer", "1000", "-prefetch", "16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := &capturingHandler{widgets: make(map[string]widget)}
+	cfg.handler, cfg.out = handler, io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Consumed != 10000 || len(handler.widgets) != 10000 {
+		t.Fatalf("%d widgets consumed and %d handled, expected 10000 of each", result.Consumed, len(handler.widgets))
+	}
+	for i := 1; i <= 10000; i++ {
+		if _, ok := handler.widgets[strconv.Itoa(i)]; !ok {
+			t.Fatalf("Widget %d never handled", i)
+		}
+	}
+
+	// A prefetched broken widget still stops production
+	cfg, err = parseConfig([]string{"-n", "100000", "-c", "4", "-buffer", "1000", "-prefetch", "64", "-k", "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = io.Discard
+	result, err = RunPipeline(cfg, nil)
+	if !errors.Is(err, ErrProductionStopped) || result.Produced >= 100000 {
+		t.Errorf("Broken widget didn't stop a prefetching run: %d produced, %v", result.Produced, err)
+	}
+
+	for _, args := range [][]string{{"-prefetch", "0"}, {"-prefetch", "8", "-batchsize", "10"}} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
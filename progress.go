@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// PROGRESS LOGIC
+// -progress draws a bar of the widgets consumed out of the total on standard error, redrawn in
+// place with a carriage return a few times a second, for watching a long count-mode run. It's
+// only drawn to a terminal: redirected to a file, the redraws would be a mess of partial lines.
+// Printing a line per widget to the same terminal would scroll the bar away, so when standard
+// output is a terminal too, -progress also makes the run quiet.
+
+// progressInterval is how often the progress bar is redrawn.
+const progressInterval = 100 * time.Millisecond
+
+// progressWidth is how many characters the bar itself takes, not counting the figures after it.
+const progressWidth = 40
+
+// showProgress reports whether a progress bar can be drawn to f.
+func showProgress(f *os.File) bool {
+	return isTerminal(f) && os.Getenv("TERM") != "dumb"
+}
+
+// renderProgress returns the progress bar for done of total widgets.
+func renderProgress(done, total int) string {
+	fraction := 1.0
+	if total > 0 {
+		fraction = min(float64(done)/float64(total), 1)
+	}
+	filled := int(fraction * progressWidth)
+	return fmt.Sprintf("[%s%s] %3.0f%% %d/%d widgets", strings.Repeat("#", filled), strings.Repeat(".", progressWidth-filled),
+		fraction*100, done, total)
+}
+
+// startProgressBar draws consumed()'s progress towards total on out until the returned function is
+// called, which draws it one last time, ends its line, and waits for the drawing to stop.
+func startProgressBar(out io.Writer, total int, consumed func() int) (stop func()) {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	draw := func() {
+		// Clear the rest of the line, in case something else was printed on it
+		fmt.Fprintf(out, "\r%s\x1b[K", renderProgress(consumed(), total))
+	}
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			draw()
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+		draw()
+		fmt.Fprintln(out)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRenderProgress(t *testing.T) {
+	for _, test := range []struct {
+		done, total int
+		expected    string
+	}{
+		{0, 100, "[" + strings.Repeat(".", 40) + "]   0% 0/100 widgets"},
+		{25, 100, "[" + strings.Repeat("#", 10) + strings.Repeat(".", 30) + "]  25% 25/100 widgets"},
+		{100, 100, "[" + strings.Repeat("#", 40) + "] 100% 100/100 widgets"},
+		{150, 100, "[" + strings.Repeat("#", 40) + "] 100% 150/100 widgets"},
+	} {
+		if got := renderProgress(test.done, test.total); got != test.expected {
+			t.Errorf("%d of %d rendered as %q, expected %q", test.done, test.total, got, test.expected)
+		}
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	var out lockedBuilder
+	var consumed atomic.Int64
+	stop := startProgressBar(&out, 10, func() int { return int(consumed.Load()) })
+	consumed.Store(10)
+	stop()
+	drawn := out.b.String() // the bar has stopped drawing
+	if !strings.HasPrefix(drawn, "\r[") || !strings.HasSuffix(drawn, "] 100% 10/10 widgets\x1b[K\n") {
+		t.Errorf("Progress bar drawn as %q", drawn)
+	}
+
+	for _, args := range [][]string{{"-progress", "-duration", "1s"}, {"-progress", "-report-interval", "1s"}} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v accepted", args)
+		}
+	}
+}
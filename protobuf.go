@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PROTOBUF LOGIC
+// -format protobuf writes each consumed widget as a length-delimited protobuf message: the
+// message's size as a varint, then the message, as read by parseDelimitedFrom in the protobuf
+// libraries. The wire format is encoded by hand, so there is no generated code to keep in step.
+// The message is:
+//
+//	message Widget {
+//	  string id = 1;
+//	  string source = 2;
+//	  int64 producer_id = 3;
+//	  string type = 4;
+//	  int64 produced_unix_nano = 5;
+//	  bool broken = 6;
+//	  bytes payload = 7;
+//	  int64 consumed_unix_nano = 8;
+//	  map<string, string> metadata = 9;
+//	}
+//
+// As in proto3, fields holding their zero value are left out. Metadata entries are written in key
+// order, so the same widget always encodes the same way.
+
+// Field numbers of the Widget message.
+const (
+	protoFieldID = iota + 1
+	protoFieldSource
+	protoFieldProducerID
+	protoFieldType
+	protoFieldProduced
+	protoFieldBroken
+	protoFieldPayload
+	protoFieldConsumed
+	protoFieldMetadata
+)
+
+// Protobuf wire types used by the Widget message, or possibly by fields added to it later.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protobufWriter writes consumed widgets as length-delimited Widget messages.
+type protobufWriter struct {
+	mutex sync.Mutex // exclusion on writes from concurrent consumers
+	out   *bufio.Writer
+}
+
+func newProtobufWriter(out io.Writer) *protobufWriter {
+	return &protobufWriter{out: bufio.NewWriter(out)}
+}
+
+func (p *protobufWriter) Write(w widget) error {
+	message := marshalWidget(w, time.Now())
+	frame := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+len(message)), uint64(len(message)))
+	frame = append(frame, message...)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	_, err := p.out.Write(frame)
+	return err
+}
+
+func (p *protobufWriter) Flush() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.out.Flush()
+}
+
+// marshalWidget encodes w, consumed at the given time, as a Widget message.
+func marshalWidget(w widget, consumed time.Time) []byte {
+	var b []byte
+	b = appendProtoBytes(b, protoFieldID, []byte(w.id))
+	b = appendProtoBytes(b, protoFieldSource, []byte(w.source))
+	b = appendProtoVarint(b, protoFieldProducerID, uint64(w.producerID))
+	b = appendProtoBytes(b, protoFieldType, []byte(w.widgetType))
+	if !w.time.IsZero() {
+		b = appendProtoVarint(b, protoFieldProduced, uint64(w.time.UnixNano()))
+	}
+	if w.broken {
+		b = appendProtoVarint(b, protoFieldBroken, 1)
+	}
+	b = appendProtoBytes(b, protoFieldPayload, w.payload)
+	b = appendProtoVarint(b, protoFieldConsumed, uint64(consumed.UnixNano()))
+	for _, key := range slices.Sorted(maps.Keys(w.metadata)) {
+		// A map is encoded as repeated entry messages, with the key as field 1 and the value as field 2
+		entry := appendProtoBytes(nil, 1, []byte(key))
+		entry = appendProtoBytes(entry, 2, []byte(w.metadata[key]))
+		b = binary.AppendUvarint(b, uint64(protoFieldMetadata<<3|protoBytes))
+		b = binary.AppendUvarint(b, uint64(len(entry)))
+		b = append(b, entry...)
+	}
+	return b
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field<<3|protoVarint))
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field<<3|protoBytes))
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// errBadProtobuf is returned when a Widget message can't be decoded.
+var errBadProtobuf = errors.New("malformed protobuf message")
+
+// readDelimitedWidget reads one length-delimited Widget message from in, as a downstream consumer
+// of -format protobuf would, returning the widget and when it was consumed. It returns io.EOF once
+// in is exhausted between messages.
+func readDelimitedWidget(in *bufio.Reader) (widget, time.Time, error) {
+	size, err := binary.ReadUvarint(in)
+	if err != nil {
+		return widget{}, time.Time{}, err
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(in, message); err != nil {
+		return widget{}, time.Time{}, err
+	}
+	return unmarshalWidget(message)
+}
+
+// unmarshalWidget decodes a Widget message, skipping any fields it doesn't know.
+func unmarshalWidget(b []byte) (widget, time.Time, error) {
+	var w widget
+	var consumed time.Time
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return widget{}, time.Time{}, errBadProtobuf
+		}
+		b = b[n:]
+		field, wireType := int(key>>3), int(key&7)
+
+		var varint uint64
+		var bytes []byte
+		switch wireType {
+		case protoVarint:
+			if varint, n = binary.Uvarint(b); n <= 0 {
+				return widget{}, time.Time{}, errBadProtobuf
+			}
+			b = b[n:]
+		case protoBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return widget{}, time.Time{}, errBadProtobuf
+			}
+			bytes, b = b[n:n+int(size)], b[n+int(size):]
+		case protoFixed64, protoFixed32:
+			size := 8
+			if wireType == protoFixed32 {
+				size = 4
+			}
+			if len(b) < size {
+				return widget{}, time.Time{}, errBadProtobuf
+			}
+			b = b[size:]
+			continue
+		default:
+			return widget{}, time.Time{}, fmt.Errorf("%w: wire type %d", errBadProtobuf, wireType)
+		}
+
+		switch field {
+		case protoFieldID:
+			w.id = string(bytes)
+		case protoFieldSource:
+			w.source = string(bytes)
+		case protoFieldProducerID:
+			w.producerID = int(int64(varint))
+		case protoFieldType:
+			w.widgetType = string(bytes)
+		case protoFieldProduced:
+			w.time = time.Unix(0, int64(varint))
+		case protoFieldBroken:
+			w.broken = varint != 0
+		case protoFieldPayload:
+			w.payload = append([]byte(nil), bytes...)
+		case protoFieldConsumed:
+			consumed = time.Unix(0, int64(varint))
+		case protoFieldMetadata:
+			entry, _, err := unmarshalWidget(bytes)
+			if err != nil {
+				return widget{}, time.Time{}, err
+			}
+			if w.metadata == nil {
+				w.metadata = make(map[string]string)
+			}
+			// An entry's key and value have the field numbers of a Widget's id and source
+			w.metadata[entry.id] = entry.source
+		}
+	}
+	return w, consumed, nil
+}
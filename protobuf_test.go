@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProtobufRoundTrip(t *testing.T) {
+	produced := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.Local)
+	consumed := produced.Add(time.Millisecond)
+	for _, w := range []widget{
+		{id: "42", source: "Producer_3", producerID: 3, widgetType: "gizmo", time: produced, broken: true, payload: []byte{0, 1, 255},
+			metadata: map[string]string{"env": "prod", "region": "", "": "x"}},
+		{id: "7", source: "Producer_1", producerID: 1, time: produced},
+		{},
+	} {
+		var out bytes.Buffer
+		writer := newProtobufWriter(&out)
+		if err := writer.Write(w); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		message := marshalWidget(w, consumed)
+		got, gotConsumed, err := unmarshalWidget(message)
+		if err != nil {
+			t.Fatalf("Can't decode %v: %v", w, err)
+		}
+		if !got.time.Equal(w.time) || !gotConsumed.Equal(consumed) {
+			t.Errorf("Times changed: produced %v became %v, consumed %v became %v", w.time, got.time, consumed, gotConsumed)
+		}
+		got.time = w.time
+		if !reflect.DeepEqual(got, w) {
+			t.Errorf("Widget changed in a round trip: %#v became %#v", w, got)
+		}
+
+		// The writer frames the same message with its length
+		framed, _, err := readDelimitedWidget(bufio.NewReader(&out))
+		if err != nil {
+			t.Fatalf("Can't read delimited %v: %v", w, err)
+		}
+		framed.time = w.time
+		if !reflect.DeepEqual(framed, w) {
+			t.Errorf("Widget changed when written: %#v became %#v", w, framed)
+		}
+	}
+}
+
+func TestProtobufUnknownFields(t *testing.T) {
+	message := marshalWidget(widget{id: "5", broken: true}, time.Now())
+	// Fields 9 (fixed64), 10 (fixed32), and 11 (bytes) are unknown
+	message = append(message, 9<<3|1, 1, 2, 3, 4, 5, 6, 7, 8, 10<<3|5, 1, 2, 3, 4, 11<<3|2, 2, 'h', 'i')
+	w, _, err := unmarshalWidget(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.id != "5" || !w.broken {
+		t.Errorf("Decoded %#v", w)
+	}
+	if _, _, err := unmarshalWidget([]byte{1<<3 | 2, 10, 'x'}); !errors.Is(err, errBadProtobuf) {
+		t.Errorf("Expected a truncated field to be rejected, got %v", err)
+	}
+}
+
+func TestProtobufOutput(t *testing.T) {
+	numConsumers := 4
+	numWidgets := 50
+	widgetChan := make(chan widget, numWidgets)
+	var wg sync.WaitGroup
+	wg.Add(numConsumers)
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+
+	var out bytes.Buffer
+	output, err := newWidgetWriter("protobuf", &out)
+	if err != nil {
+		t.Fatalf("Can't create protobuf writer: %v", err)
+	}
+	consumerGroup := newConsumerGroup(config{numConsumers: numConsumers}, widgetChan, &wg, &shouldStop, &shouldStopMutex, noopSink{}, output)
+	consumerGroup.spawnConsumers()
+	for i := 1; i <= numWidgets; i++ {
+		widgetChan <- widget{id: strconv.Itoa(i), source: "Producer_1", producerID: 1, time: time.Now(), payload: bytes.Repeat([]byte{byte(i)}, 200)}
+	}
+	close(widgetChan)
+	wg.Wait()
+	if err := output.Flush(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	// Messages from concurrent consumers mustn't interleave
+	seen := map[string]bool{}
+	in := bufio.NewReader(&out)
+	for {
+		w, _, err := readDelimitedWidget(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Can't read message %d: %v", len(seen)+1, err)
+		}
+		if id := mustAtoi(t, w.id); !bytes.Equal(w.payload, bytes.Repeat([]byte{byte(id)}, 200)) {
+			t.Errorf("Widget %s has the wrong payload", w.id)
+		}
+		seen[w.id] = true
+	}
+	if len(seen) != numWidgets {
+		t.Errorf("Expected %d widgets, read %d", numWidgets, len(seen))
+	}
+}
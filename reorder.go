@@ -0,0 +1,39 @@
+package main
+
+import "math/rand"
+
+// REORDER LOGIC
+// reorderBuffer holds back up to size widgets and releases them in random order, to simulate
+// delivery over a network that doesn't preserve ordering. Each consumer has its own buffer.
+type reorderBuffer struct {
+	widgets []widget
+	size    int
+	rng     *rand.Rand
+}
+
+func newReorderBuffer(size int, seed int64) *reorderBuffer {
+	return &reorderBuffer{widgets: make([]widget, 0, size), size: size, rng: rand.New(rand.NewSource(seed))}
+}
+
+// push adds w to the buffer. Once the buffer is full, a widget picked at random is removed and
+// returned with ok set.
+func (b *reorderBuffer) push(w widget) (released widget, ok bool) {
+	b.widgets = append(b.widgets, w)
+	if len(b.widgets) <= b.size {
+		return widget{}, false
+	}
+	i := b.rng.Intn(len(b.widgets))
+	released = b.widgets[i]
+	last := len(b.widgets) - 1
+	b.widgets[i] = b.widgets[last]
+	b.widgets = b.widgets[:last]
+	return released, true
+}
+
+// drain empties the buffer, returning what it held in shuffled order.
+func (b *reorderBuffer) drain() []widget {
+	remaining := b.widgets
+	b.rng.Shuffle(len(remaining), func(i, j int) { remaining[i], remaining[j] = remaining[j], remaining[i] })
+	b.widgets = make([]widget, 0, b.size)
+	return remaining
+}
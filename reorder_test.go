@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReorderBuffer(t *testing.T) {
+	buffer := newReorderBuffer(16, 3)
+	var ids []int
+	for i := 1; i <= 100; i++ {
+		if w, ok := buffer.push(widget{id: strconv.Itoa(i)}); ok {
+			ids = append(ids, mustAtoi(t, w.id))
+		}
+		if len(buffer.widgets) > 16 {
+			t.Fatalf("Reorder buffer holds %d widgets, expected at most 16", len(buffer.widgets))
+		}
+	}
+	if len(ids) != 100-16 {
+		t.Errorf("Released %d widgets before draining, expected %d", len(ids), 100-16)
+	}
+	for _, w := range buffer.drain() {
+		ids = append(ids, mustAtoi(t, w.id))
+	}
+
+	if sort.IntsAreSorted(ids) {
+		t.Errorf("Widgets weren't reordered")
+	}
+	sort.Ints(ids)
+	for i, id := range ids {
+		if id != i+1 {
+			t.Fatalf("Widgets lost or duplicated by reordering: %v", ids)
+		}
+	}
+}
+
+func TestReorderBrokenWidget(t *testing.T) {
+	widgetChan := make(chan widget, 10)
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	sink := &recordingSink{results: make(map[string]ResultCode)}
+	cfg := config{numConsumers: 1, reorderWindow: 16, out: io.Discard}
+	consumerGroup := newConsumerGroup(cfg, widgetChan, &wg, &shouldStop, &shouldStopMutex, sink, nil)
+	wg.Add(1)
+	consumerGroup.spawnConsumers()
+
+	// The broken widget must stop production even though the window never filled
+	for i := 1; i <= 3; i++ {
+		widgetChan <- widget{id: strconv.Itoa(i), source: "Producer_1", producerID: 1, time: time.Now(), broken: i == 3}
+	}
+	deadline := time.Now().Add(time.Second)
+	for !stopRequested(&shouldStop, &shouldStopMutex) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Broken widget held in the reorder buffer")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Held back widgets are still handled once the channel closes
+	close(widgetChan)
+	wg.Wait()
+	if len(sink.results) != 3 {
+		t.Errorf("Recorded %d widgets, expected 3", len(sink.results))
+	}
+}
+
+func mustAtoi(t *testing.T, s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatalf("Bad widget id %q", s)
+	}
+	return n
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// REPLAY LOGIC
+// replaySource is a WidgetSource that re-emits the widgets recorded by a file sink, so a
+// particular run can be fed through the consumers again. Widgets keep their recorded id, source,
+// type and broken flag. Their produced time is kept too, unless rebase is set, in which case each
+// widget is stamped with the time it is replayed. Gzipped logs (ending in .gz) are decompressed.
+//
+// At the real pace, each widget is held back until as long after the previous one as separated
+// their recorded times, reproducing the original timing. The gap is measured from when the
+// previous widget was emitted, so time spent waiting on a full channel counts towards it. A gap
+// that's negative, since the log is in the order widgets were consumed, or the clock was set back
+// while recording, isn't waited for at all; one longer than maxGap, e.g. across a pause in
+// recording, is cut short to it.
+type replaySource struct {
+	mutex    sync.Mutex
+	file     *os.File
+	gz       *gzip.Reader // nil unless the log is gzipped
+	dec      *json.Decoder
+	rebase   bool
+	pace     string        // how fast widgets are emitted, replayPaceFast or replayPaceReal
+	maxGap   time.Duration // longest wait between widgets at the real pace
+	recorded time.Time     // recorded time of the previous widget, zero before the first
+	emitted  time.Time     // when the previous widget was emitted
+	err      error         // set once the log is exhausted or unreadable, and returned from then on
+}
+
+// How fast a replay emits widgets.
+const (
+	replayPaceFast = "fast" // as fast as the consumers take them, the default
+	replayPaceReal = "real" // with the gaps between their recorded times
+)
+
+// replayMaxGap caps the wait between replayed widgets at the real pace.
+const replayMaxGap = time.Second
+
+func openReplay(path string, rebase bool, pace string) (*replaySource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &replaySource{file: file, rebase: rebase, pace: pace, maxGap: replayMaxGap}
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		if s.gz, err = gzip.NewReader(file); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("can't read %s: %w", path, err)
+		}
+		r = s.gz
+	}
+	s.dec = json.NewDecoder(r)
+	return s, nil
+}
+
+func (s *replaySource) Next() (widget, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return widget{}, s.err
+	}
+
+	var r sinkRecord
+	if err := s.dec.Decode(&r); err != nil {
+		if err == io.EOF {
+			s.err = errors.New("replay log exhausted")
+		} else {
+			fmt.Fprintf(os.Stderr, "Stopping replay, %s is malformed: %v\n", s.file.Name(), err)
+			s.err = err
+		}
+		return widget{}, s.err
+	}
+
+	w := widget{id: r.ID, source: r.Source, producerID: r.ProducerID, widgetType: r.Type, time: r.ProducedTime, broken: r.Broken,
+		metadata: r.Metadata}
+	if s.pace == replayPaceReal {
+		// Waiting with the lock held keeps the widgets in step however many producers share the log
+		s.wait(r.ProducedTime)
+	}
+	if s.rebase {
+		w.time = time.Now()
+	}
+	return w, nil
+}
+
+// wait holds back the widget recorded at recorded until its gap from the previous widget has passed.
+func (s *replaySource) wait(recorded time.Time) {
+	if !s.recorded.IsZero() {
+		gap := min(recorded.Sub(s.recorded), s.maxGap)
+		time.Sleep(gap - time.Since(s.emitted))
+	}
+	s.recorded, s.emitted = recorded, time.Now()
+}
+
+func (s *replaySource) Close() error {
+	if s.gz != nil {
+		s.gz.Close()
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// capturingHandler keeps every widget it handles, by id.
+type capturingHandler struct {
+	mutex   sync.Mutex
+	widgets map[string]widget
+}
+
+func (h *capturingHandler) Handle(w widget) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.widgets[w.id] = w
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "widgets.jsonl")
+
+	// Record a run with a broken widget
+	cfg := defaultConfig()
+	cfg.numWidgets, cfg.numProducers, cfg.kthBadWidget = 20, 2, 20
+	cfg.types = []widgetType{{"gizmo", 0}, {"gadget", 0}}
+	cfg.sink = "file:" + log
+	cfg.out = io.Discard
+	original := &capturingHandler{widgets: make(map[string]widget)}
+	cfg.handler = original
+	if _, err := RunPipeline(cfg, nil); !errors.Is(err, ErrProductionStopped) {
+		t.Fatal(err)
+	}
+
+	// Replaying it re-emits the same widgets, recorded times included, the broken one last
+	replayCfg := defaultConfig()
+	replayCfg.replay = log
+	replayCfg.numProducers = 3
+	replayed := &capturingHandler{widgets: make(map[string]widget)}
+	replayCfg.handler = replayed
+	result, err := RunPipeline(replayCfg, nil)
+	if !errors.Is(err, ErrProductionStopped) || result.Consumed != 20 {
+		t.Fatalf("Replayed %d widgets, expected 20: %v", result.Consumed, err)
+	}
+	for id, w := range original.widgets {
+		r := replayed.widgets[id]
+		if r.source != w.source || r.widgetType != w.widgetType || r.broken != w.broken || !r.time.Equal(w.time) {
+			t.Errorf("Widget %s replayed as %v, expected %v", id, r, w)
+		}
+	}
+	if !replayed.widgets["20"].broken {
+		t.Errorf("Broken flag not honored on replay")
+	}
+
+	// Rebasing stamps widgets with the replay time
+	replayCfg.replayRebase = true
+	start := time.Now()
+	replayed.widgets = make(map[string]widget)
+	if _, err := RunPipeline(replayCfg, nil); !errors.Is(err, ErrProductionStopped) {
+		t.Fatal(err)
+	}
+	for id, r := range replayed.widgets {
+		if r.time.Before(start) {
+			t.Errorf("Widget %s not rebased: %v", id, r.time)
+		}
+	}
+
+	replayCfg.replay = filepath.Join(t.TempDir(), "missing.jsonl")
+	if _, err := RunPipeline(replayCfg, nil); err == nil {
+		t.Errorf("Missing replay log not reported")
+	}
+}
+
+func TestReplayPace(t *testing.T) {
+	// Gaps of 60ms, then backwards as when consumed out of order, then an hour's pause in recording
+	log := filepath.Join(t.TempDir(), "widgets.jsonl")
+	recorded := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var lines []string
+	for i, offset := range []time.Duration{0, 60 * time.Millisecond, 30 * time.Millisecond, time.Hour} {
+		record, _ := json.Marshal(sinkRecord{ID: strconv.Itoa(i + 1), ProducedTime: recorded.Add(offset)})
+		lines = append(lines, string(record))
+	}
+	if err := os.WriteFile(log, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := openReplay(log, false, replayPaceReal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.maxGap = 200 * time.Millisecond
+	var gaps []time.Duration
+	last := time.Now()
+	for {
+		if _, err := s.Next(); err != nil {
+			break
+		}
+		gaps = append(gaps, time.Since(last))
+		last = time.Now()
+	}
+	if len(gaps) != 4 {
+		t.Fatalf("Replayed %d widgets, expected 4", len(gaps))
+	}
+	if gaps[1] < 60*time.Millisecond {
+		t.Errorf("Second widget replayed after %s, expected its recorded gap of 60ms", gaps[1])
+	}
+	if gaps[2] > 50*time.Millisecond {
+		t.Errorf("Widget recorded earlier than the one before replayed after %s, expected no wait", gaps[2])
+	}
+	if gaps[3] < s.maxGap || gaps[3] > time.Second {
+		t.Errorf("Widget recorded an hour later replayed after %s, expected the gap capped at %s", gaps[3], s.maxGap)
+	}
+
+	if _, err := parseConfig([]string{"-replay-pace", "real"}); err == nil {
+		t.Error("-replay-pace real accepted without -replay")
+	}
+	if _, err := parseConfig([]string{"-replay", log, "-replay-pace", "slow"}); err == nil {
+		t.Error("Unknown replay pace accepted")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"time"
+)
+
+// REPORT LOGIC
+// -report writes a JSON summary of the run once it has finished, however it finished, so runs can
+// be kept on record and compared.
+
+// reportSchemaVersion is bumped whenever a field of runReport changes meaning or is removed, so
+// tools reading old reports can tell them apart. Adding a field doesn't need a new version.
+const reportSchemaVersion = 1
+
+// Latency summarizes how long consumed widgets took to get from their producer to being handled.
+type Latency struct {
+	P50 time.Duration `json:"p50_ns"`
+	P90 time.Duration `json:"p90_ns"`
+	P99 time.Duration `json:"p99_ns"`
+	Max time.Duration `json:"max_ns"`
+}
+
+// newLatency summarizes latencies, sorting them in place.
+func newLatency(latencies []time.Duration) Latency {
+	if len(latencies) == 0 {
+		return Latency{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p int) time.Duration {
+		// Nearest rank, so every percentile is a latency that was actually seen
+		return latencies[(len(latencies)*p+99)/100-1]
+	}
+	return Latency{P50: percentile(50), P90: percentile(90), P99: percentile(99), Max: latencies[len(latencies)-1]}
+}
+
+// runReport is the JSON written by -report.
+type runReport struct {
+	SchemaVersion int                `json:"schema_version"`
+	RunID         string             `json:"run_id,omitempty"`
+	Config        reportConfig       `json:"config"`
+	Start         time.Time          `json:"start"`
+	End           time.Time          `json:"end"`
+	Produced      int                `json:"produced"`
+	Consumed      int                `json:"consumed"`
+	Broken        int                `json:"broken"`
+	DeadLettered  int                `json:"dead_lettered"`
+	Abandoned     int                `json:"abandoned"`
+	Duplicates    int                `json:"duplicates"`
+	OutOfOrder    int                `json:"out_of_order"`
+	Expired       int                `json:"expired"`
+	Dropped       int                `json:"dropped"`
+	Suppressed    int                `json:"suppressed"`
+	Panics        int                `json:"panics"`
+	Injected      int                `json:"injected_errors"`
+	Results       map[ResultCode]int `json:"results"`
+	StoppedEarly  bool               `json:"stopped_early"`
+	Error         string             `json:"error,omitempty"`
+	Latency       Latency            `json:"latency"`
+}
+
+// reportConfig records the options a run used.
+type reportConfig struct {
+	Args          []string      `json:"args"`
+	Producers     int           `json:"producers"`
+	Consumers     int           `json:"consumers"`
+	Widgets       int           `json:"widgets"`
+	BrokenWidget  int           `json:"broken_widget"`
+	BreakEvery    int           `json:"break_every,omitempty"`
+	Seed          int64         `json:"seed"`
+	Duration      time.Duration `json:"duration_ns,omitempty"`
+	BatchSize     int           `json:"batch_size"`
+	Buffer        int           `json:"buffer"`
+	IDStart       int           `json:"id_start"`
+	Fanout        int           `json:"fanout"`
+	BreakerLimit  int           `json:"breaker_threshold,omitempty"`
+	Warmup        int           `json:"warmup,omitempty"`
+	TypeNames     []string      `json:"types,omitempty"`
+	TypeAssigning string        `json:"type_assignment,omitempty"`
+}
+
+// writeReport writes the report of a run started at start, given its command line arguments and
+// what RunPipeline returned.
+func writeReport(path string, cfg config, args []string, start time.Time, result Result, runErr error) error {
+	report := runReport{SchemaVersion: reportSchemaVersion,
+		RunID: cfg.runID,
+		Config: reportConfig{Args: args,
+			Producers:    cfg.numProducers,
+			Consumers:    cfg.numConsumers,
+			Widgets:      cfg.numWidgets,
+			BrokenWidget: cfg.kthBadWidget,
+			BreakEvery:   cfg.breakEvery,
+			Seed:         cfg.seed,
+			Duration:     cfg.duration,
+			BatchSize:    cfg.batchSize,
+			Buffer:       cfg.channelBuffer(),
+			IDStart:      cfg.idStart,
+			Fanout:       cfg.fanout,
+			BreakerLimit: cfg.breakerThreshold,
+			Warmup:       cfg.warmup},
+		Start:        start,
+		End:          time.Now(),
+		Produced:     result.Produced,
+		Consumed:     result.Consumed,
+		Broken:       result.Broken,
+		DeadLettered: result.DeadLettered,
+		Abandoned:    result.Abandoned,
+		Duplicates:   result.Duplicates,
+		OutOfOrder:   result.OutOfOrder,
+		Expired:      result.Expired,
+		Dropped:      result.Dropped,
+		Suppressed:   result.Suppressed,
+		Panics:       result.Panics,
+		Injected:     result.Injected,
+		Results:      result.Results,
+		StoppedEarly: errors.Is(runErr, ErrProductionStopped),
+		Latency:      result.Latency}
+	for _, t := range cfg.types {
+		report.Config.TypeNames = append(report.Config.TypeNames, t.name)
+	}
+	if len(cfg.types) > 0 {
+		report.Config.TypeAssigning = cfg.typeAssignment
+	}
+	if runErr != nil {
+		report.Error = runErr.Error()
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.json")
+	cfg, err := parseConfig([]string{"-n", "1000", "-k", "500", "-c", "2", "-report", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = io.Discard
+	start := time.Now()
+	result, runErr := RunPipeline(cfg, nil)
+	if err := writeReport(cfg.report, cfg, []string{"-k", "500"}, start, result, runErr); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report runReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.SchemaVersion != reportSchemaVersion || report.Config.Widgets != 1000 || report.Config.BrokenWidget != 500 ||
+		len(report.Config.Args) != 2 {
+		t.Errorf("Report doesn't describe the run's config: %+v", report)
+	}
+	if !report.StoppedEarly || report.Broken != 1 || report.Error == "" || report.Consumed != result.Consumed {
+		t.Errorf("Report doesn't show the early stop: %+v", report)
+	}
+	if report.Latency.P50 <= 0 || report.Latency.P50 > report.Latency.P99 || report.Latency.P99 > report.Latency.Max {
+		t.Errorf("Implausible latencies %+v", report.Latency)
+	}
+	if !report.End.After(report.Start) {
+		t.Errorf("Report ended at %s, before starting at %s", report.End, report.Start)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i))
+	}
+	expected := Latency{P50: 50, P90: 90, P99: 99, Max: 100}
+	if latency := newLatency(latencies); latency != expected {
+		t.Errorf("Latency was %+v, expected %+v", latency, expected)
+	}
+	if latency := newLatency(nil); latency != (Latency{}) {
+		t.Errorf("Latency of no widgets was %+v", latency)
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	for warmup, measured := range map[int]int{0: 100, 30: 70, 200: 0} {
+		cfg, err := parseConfig([]string{"-n", "100", "-c", "3", "-warmup", strconv.Itoa(warmup), "-report", filepath.Join(t.TempDir(), "run.json")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.out = io.Discard
+		p, err := NewPipeline(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := p.Run(nil)
+		if err != nil || result.Consumed != 100 {
+			t.Fatalf("-warmup %d consumed %d widgets: %v", warmup, result.Consumed, err)
+		}
+		n := 0
+		for _, latencies := range p.consumers[0].latencies {
+			n += len(latencies)
+		}
+		if n != measured {
+			t.Errorf("-warmup %d measured the latency of %d widgets, expected %d", warmup, n, measured)
+		}
+	}
+	if _, err := parseConfig([]string{"-warmup", "-1"}); err == nil {
+		t.Errorf("Negative warm-up accepted")
+	}
+}
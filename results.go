@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// RESULTS LOGIC
+// Every widget produced ends up with exactly one ResultCode, so the run's outcome can be given as
+// a single breakdown instead of a count from each feature that classifies widgets. Consumers tally
+// the final result of each widget they take, and widgets that never reach a consumer are tallied
+// too: those left behind by a drain timeout as timed out, and those shed by -overflow as dropped.
+// The tallies sum to the widgets produced, once per consumer group with -fanout.
+
+// resultCodes lists every ResultCode, in the order the summary gives them.
+var resultCodes = []ResultCode{resultConsumed, resultBroken, resultDeadLettered, resultDuplicate,
+	resultFailed, resultSkipped, resultExpired, resultDropped, resultTimedOut}
+
+// resultTally counts widgets by result. The map is filled in once, so it's only ever read and the
+// counters can be added to concurrently.
+type resultTally map[ResultCode]*atomic.Int64
+
+func newResultTally() resultTally {
+	tally := make(resultTally, len(resultCodes))
+	for _, code := range resultCodes {
+		tally[code] = &atomic.Int64{}
+	}
+	return tally
+}
+
+// add counts n widgets with result code.
+func (t resultTally) add(code ResultCode, n int) {
+	t[code].Add(int64(n))
+}
+
+// addTo adds the tallies, leaving out results no widget had, to results.
+func (t resultTally) addTo(results map[ResultCode]int) {
+	for code, count := range t {
+		if n := int(count.Load()); n > 0 {
+			results[code] += n
+		}
+	}
+}
+
+// reportResults prints the breakdown of results, unless every widget was simply consumed.
+func reportResults(out io.Writer, results map[ResultCode]int) {
+	if len(results) == 0 || len(results) == 1 && results[resultConsumed] > 0 {
+		return
+	}
+	var entries []string
+	for _, code := range resultCodes {
+		if results[code] > 0 {
+			entries = append(entries, fmt.Sprintf("%s %d", code, results[code]))
+		}
+	}
+	fmt.Fprintf(out, "Results: %s\n", strings.Join(entries, ", "))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// failingHandler returns an error for one widget id and accepts every other.
+type failingHandler struct {
+	id string
+}
+
+func (h failingHandler) Handle(w widget) error {
+	if w.id == h.id {
+		return errors.New("can't handle widget " + w.id)
+	}
+	return nil
+}
+
+// sleepingHandler takes delay over each widget.
+type sleepingHandler struct {
+	delay time.Duration
+}
+
+func (h sleepingHandler) Handle(w widget) error {
+	time.Sleep(h.delay)
+	return nil
+}
+
+// sum totals the widgets in results.
+func sum(results map[ResultCode]int) int {
+	total := 0
+	for _, n := range results {
+		total += n
+	}
+	return total
+}
+
+func TestResults(t *testing.T) {
+	cfg, err := parseConfig([]string{"-n", "200", "-c", "4", "-every", "10", "-breaker-threshold", "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.handler, cfg.out = failingHandler{id: "7"}, io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[ResultCode]int{resultConsumed: 179, resultDeadLettered: 20, resultFailed: 1}
+	for code, n := range expected {
+		if result.Results[code] != n {
+			t.Errorf("%d widgets %s, expected %d: %v", result.Results[code], code, n, result.Results)
+		}
+	}
+	if len(result.Results) != len(expected) {
+		t.Errorf("Unexpected results %v", result.Results)
+	}
+
+	// However a run ends, every widget produced has a result
+	for _, test := range []struct {
+		args []string
+		code ResultCode // a result some widgets must have
+	}{
+		{[]string{"-n", "10000", "-c", "4", "-k", "100"}, resultBroken},
+		{[]string{"-n", "1000", "-c", "4", "-ttl", "1ns"}, resultExpired},
+		{[]string{"-n", "10000", "-c", "2", "-buffer", "10", "-overflow", "drop-newest"}, resultDropped},
+		{[]string{"-n", "1000", "-c", "2", "-fanout", "3", "-k", "500"}, resultBroken},
+	} {
+		cfg, err := parseConfig(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.out = io.Discard
+		result, _ := RunPipeline(cfg, nil)
+		if sum(result.Results) != result.Produced*cfg.fanout {
+			t.Errorf("%v: results %v sum to %d, but %d widgets were produced", test.args, result.Results, sum(result.Results), result.Produced)
+		}
+		if result.Results[test.code] == 0 {
+			t.Errorf("%v: results %v, expected some %s", test.args, result.Results, test.code)
+		}
+	}
+
+	// Expired widgets are told apart from those shed by -overflow
+	cfg, err = parseConfig([]string{"-n", "100", "-ttl", "1ns"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = io.Discard
+	result, _ = RunPipeline(cfg, nil)
+	if result.Results[resultExpired] != 100 || result.Results[resultDropped] != 0 || result.Expired != 100 {
+		t.Errorf("Results %v after %d widgets expired, expected all 100 expired", result.Results, result.Expired)
+	}
+
+	// Widgets left behind by a drain timeout are timed out
+	cfg, err = parseConfig([]string{"-n", "100", "-draintimeout", "50ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.handler, cfg.out = sleepingHandler{delay: 10 * time.Millisecond}, io.Discard
+	result, _ = RunPipeline(cfg, nil)
+	if result.Results[resultTimedOut] != result.Abandoned || result.Abandoned == 0 || sum(result.Results) != 100 {
+		t.Errorf("Results %v after %d widgets were abandoned, expected them timed out", result.Results, result.Abandoned)
+	}
+}
+
+func TestReportResults(t *testing.T) {
+	var out bytes.Buffer
+	reportResults(&out, map[ResultCode]int{resultConsumed: 10})
+	if out.Len() != 0 {
+		t.Errorf("A run with every widget consumed reported %q", out.String())
+	}
+	reportResults(&out, map[ResultCode]int{resultTimedOut: 2, resultConsumed: 10, resultBroken: 1})
+	if got, expected := out.String(), "Results: consumed 10, broken 1, timed_out 2\n"; got != expected {
+		t.Errorf("Reported %q, expected %q", got, expected)
+	}
+}
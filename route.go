@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ROUTING LOGIC
+// A routing sink splits the sink's records by category, so that e.g. even and odd ids, or each type
+// of widget, end up in a file of their own. Each category's sink is opened the first time a widget
+// in it arrives, from the configured spec with the category worked into the path.
+
+// Classifier names the category a widget belongs to. It is called concurrently by every consumer.
+// The category becomes part of a file name, so it must not be empty or contain a path separator.
+type Classifier func(w widget) string
+
+// Built-in classifiers, chosen with -split-by.
+var classifiers = map[string]Classifier{
+	"parity": byParity,
+	"type":   byType,
+}
+
+// byParity puts widgets with even ids in "even" and the rest in "odd".
+func byParity(w widget) string {
+	if id, err := strconv.Atoi(w.id); err == nil && id%2 == 0 {
+		return "even"
+	}
+	return "odd"
+}
+
+// byType puts widgets in a category named after their type, or "untyped".
+func byType(w widget) string {
+	if w.widgetType == "" {
+		return "untyped"
+	}
+	return w.widgetType
+}
+
+// routingSink records each widget in the sink for its category.
+type routingSink struct {
+	mutex    sync.Mutex // exclusion on opening sinks
+	classify Classifier
+	kind     string // sink kind, e.g. file
+	path     string // sink path, which each category's path is derived from
+	sinks    map[string]Sink
+}
+
+// openRoutedSink opens the sink described by spec, split by classify unless it is nil.
+func openRoutedSink(spec string, classify Classifier) (Sink, error) {
+	if classify == nil {
+		return openSink(spec)
+	}
+	// Check the spec up front, rather than when the first widget arrives
+	kind, path, found := strings.Cut(spec, ":")
+	if !found || path == "" {
+		return nil, errors.New("splitting needs a sink, given as <kind>:<path>")
+	}
+	if kind != "file" && kind != "sqlite" {
+		return nil, errors.New("unknown sink kind " + kind)
+	}
+	if kind == "sqlite" {
+		if err := checkSQLite(); err != nil {
+			return nil, err
+		}
+	}
+	return &routingSink{classify: classify, kind: kind, path: path, sinks: make(map[string]Sink)}, nil
+}
+
+func (r *routingSink) Write(w widget, result ResultCode) error {
+	sink, err := r.sinkFor(r.classify(w))
+	if err != nil {
+		return err
+	}
+	return sink.Write(w, result)
+}
+
+// sinkFor returns the sink for category, opening it if this is the category's first widget.
+func (r *routingSink) sinkFor(category string) (Sink, error) {
+	if category == "" || strings.ContainsAny(category, `/\`) {
+		return nil, errors.New("invalid category " + strconv.Quote(category))
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if sink, ok := r.sinks[category]; ok {
+		return sink, nil
+	}
+	sink, err := openSink(r.kind + ":" + categoryPath(r.path, category))
+	if err != nil {
+		return nil, err
+	}
+	r.sinks[category] = sink
+	return sink, nil
+}
+
+// Close closes every category's sink.
+func (r *routingSink) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var errs []error
+	for _, sink := range r.sinks {
+		errs = append(errs, closeSink(sink))
+	}
+	return errors.Join(errs...)
+}
+
+// categoryPath works category into path ahead of its extensions, so widgets.jsonl.gz becomes
+// widgets.even.jsonl.gz and stays gzipped.
+func categoryPath(path, category string) string {
+	dir, base := filepath.Split(path)
+	name, ext, _ := strings.Cut(base, ".")
+	if ext != "" {
+		ext = "." + ext
+	}
+	return dir + name + "." + category + ext
+}
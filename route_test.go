@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// readSinkIDs returns the ids recorded in a file sink's output, in order.
+func readSinkIDs(t *testing.T, path string) []int {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Can't open sink output: %v", err)
+	}
+	defer file.Close()
+	var ids []int
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r sinkRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Malformed record %q: %v", scanner.Text(), err)
+		}
+		ids = append(ids, mustAtoi(t, r.ID))
+	}
+	return ids
+}
+
+func TestSplitByParity(t *testing.T) {
+	dir := t.TempDir()
+	cfg, err := parseConfig([]string{"-n", "101", "-p", "3", "-c", "3", "-sink", "file:" + filepath.Join(dir, "widgets.jsonl"), "-split-by", "parity"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = io.Discard
+	if _, err := RunPipeline(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every record is flushed to the file for its parity, and nothing is left in the unsplit path
+	even, odd := readSinkIDs(t, filepath.Join(dir, "widgets.even.jsonl")), readSinkIDs(t, filepath.Join(dir, "widgets.odd.jsonl"))
+	if len(even) != 50 || len(odd) != 51 {
+		t.Errorf("Recorded %d even and %d odd widgets, expected 50 and 51", len(even), len(odd))
+	}
+	for _, id := range even {
+		if id%2 != 0 {
+			t.Errorf("Odd widget %d recorded with the even ones", id)
+		}
+	}
+	for _, id := range odd {
+		if id%2 == 0 {
+			t.Errorf("Even widget %d recorded with the odd ones", id)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "widgets.jsonl")); !os.IsNotExist(err) {
+		t.Errorf("Unsplit sink was written: %v", err)
+	}
+}
+
+func TestCustomClassifier(t *testing.T) {
+	dir := t.TempDir()
+	cfg := defaultConfig()
+	cfg.perProducer, cfg.numWidgets, cfg.numProducers = 15, 60, 4
+	cfg.sink = "file:" + filepath.Join(dir, "widgets")
+	cfg.classify = func(w widget) string { return "p" + strconv.Itoa(w.producerID) }
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := 0
+	for producer := 1; producer <= 4; producer++ {
+		recorded += len(readSinkIDs(t, filepath.Join(dir, "widgets.p"+strconv.Itoa(producer))))
+	}
+	if recorded != result.Consumed {
+		t.Errorf("Recorded %d of %d widgets across the producers' sinks", recorded, result.Consumed)
+	}
+
+	// A category that can't be a file name is refused
+	cfg.classify = func(w widget) string { return "../escape" }
+	sink, err := openRoutedSink(cfg.sink, cfg.classify)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Write(widget{id: "1"}, resultConsumed); err == nil {
+		t.Error("Category with a path separator accepted")
+	}
+}
+
+func TestCategoryPath(t *testing.T) {
+	for path, expected := range map[string]string{
+		"widgets.jsonl.gz":      "widgets.even.jsonl.gz",
+		"out/widgets.jsonl":     "out/widgets.even.jsonl",
+		"widgets":               "widgets.even",
+		"/tmp/run.1/widgets.db": "/tmp/run.1/widgets.even.db",
+	} {
+		if got := categoryPath(path, "even"); got != expected {
+			t.Errorf("categoryPath(%q) = %q, expected %q", path, got, expected)
+		}
+	}
+	for _, args := range [][]string{
+		{"-split-by", "colour", "-sink", "file:widgets"},
+		{"-split-by", "parity"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v not rejected", args)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+)
+
+// RUN ID LOGIC
+// Every run has an id, given with -run-id or generated as a random UUID, for correlating the
+// output of many runs once it's gathered in one place. It tags each line written to standard
+// error, and is recorded in the -report, the admin API's /status, and the resource of exported
+// spans. Standard output isn't tagged, since it holds the consumed widgets in whatever -format was
+// asked for.
+//
+// Lines are tagged by swapping standard error for a pipe, and copying what's written to it on to
+// the real standard error, so nothing that writes to standard error needs to know about it.
+
+// newRunID returns a random version 4 UUID.
+func newRunID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 9562 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// lineTagger writes to out, starting each line with tag. A line is tagged as soon as any of it is
+// written, so a progress bar redrawn without a newline still shows up at once.
+type lineTagger struct {
+	out     io.Writer
+	tag     []byte
+	midLine bool // whether the last write ended partway through a line
+}
+
+func (t *lineTagger) Write(p []byte) (int, error) {
+	tagged := make([]byte, 0, len(p)+len(t.tag))
+	for rest := p; len(rest) > 0; {
+		if !t.midLine {
+			tagged = append(tagged, t.tag...)
+			t.midLine = true
+		}
+		end := bytes.IndexByte(rest, '\n')
+		if end < 0 {
+			tagged = append(tagged, rest...)
+			break
+		}
+		tagged = append(tagged, rest[:end+1]...)
+		rest = rest[end+1:]
+		t.midLine = false
+	}
+	if _, err := t.out.Write(tagged); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// tagStderr starts tagging every line written to os.Stderr with runID. untag must be called
+// before exiting, to stop tagging and pass on anything not yet written.
+func tagStderr(runID string) (untag func(), err error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := os.Stderr
+	os.Stderr = w
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		io.Copy(&lineTagger{out: stderr, tag: []byte("[run " + runID + "] ")}, r)
+	}()
+	return func() {
+		os.Stderr = stderr
+		w.Close()
+		<-copied
+		r.Close()
+	}, nil
+}
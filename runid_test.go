@@ -0,0 +1,30 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestNewRunID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, second := newRunID(), newRunID()
+	if !uuid.MatchString(first) || !uuid.MatchString(second) || first == second {
+		t.Errorf("Generated %q and %q, expected two different version 4 UUIDs", first, second)
+	}
+}
+
+func TestLineTagger(t *testing.T) {
+	var out strings.Builder
+	tagger := &lineTagger{out: &out, tag: []byte("[run r1] ")}
+	// Lines split across writes, and writes holding several lines, are each tagged once
+	for _, write := range []string{"Using seed 1\nResu", "lts: consumed 4", ", broken 1\n", "\n", "a\nb\n"} {
+		if n, err := tagger.Write([]byte(write)); n != len(write) || err != nil {
+			t.Fatalf("Write(%q) returned %d, %v", write, n, err)
+		}
+	}
+	expected := "[run r1] Using seed 1\n[run r1] Results: consumed 4, broken 1\n[run r1] \n[run r1] a\n[run r1] b\n"
+	if out.String() != expected {
+		t.Errorf("Wrote %q, expected %q", out.String(), expected)
+	}
+}
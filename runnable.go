@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// RUNNABILITY LOGIC
+// validateRunnable looks for configurations that are bound to hang or be cut short, before anything
+// is spawned, so they're reported up front instead of leaving the user watching a stuck process.
+// Options that are each valid can still combine badly, so these checks are about combinations
+// rather than single values, which parseConfig covers. Under -strict the warnings are errors too,
+// for CI runs where any likely misconfiguration should fail.
+
+// validateRunnable returns an error for a configuration that can never finish, and warnings for
+// one that is likely to stall, be given up on, or not do what was meant. Under -strict any warning
+// is returned as the error instead.
+func validateRunnable(cfg config) ([]string, error) {
+	if cfg.mode != "consume" && cfg.numProducers < 1 {
+		return nil, errors.New("no producers, so consumers would wait forever")
+	}
+	if cfg.mode != "produce" && cfg.numConsumers < 1 {
+		return nil, errors.New("no consumers, so producers would block forever once the buffer filled")
+	}
+	warnings := warningCollector{strict: cfg.strict}
+
+	// -k counts widgets made, so past the last one nothing is ever broken. -duration and -replay
+	// don't decide the count up front, and -every and -random-break don't use -k.
+	if cfg.mode != "consume" && cfg.duration == 0 && cfg.replay == "" && cfg.kthBadWidget > cfg.numWidgets {
+		warnings.warnf("-k %d is past the last of %d widgets, so no widget will be broken",
+			cfg.kthBadWidget, cfg.numWidgets)
+	}
+
+	if cfg.maxRuntime > 0 && cfg.mode == "run" {
+		if cfg.duration >= cfg.maxRuntime {
+			warnings.warnf("-duration %s is at least -maxruntime %s, so the run will always be given up on",
+				cfg.duration, cfg.maxRuntime)
+		}
+		if rampUp := time.Duration(cfg.numProducers-1) * cfg.rampUp; rampUp >= cfg.maxRuntime {
+			warnings.warnf("the last producer starts after %s, but -maxruntime is %s", rampUp, cfg.maxRuntime)
+		}
+		if least := leastProductionTime(cfg); least >= cfg.maxRuntime {
+			warnings.warnf("-producerdelays mean production takes at least %s, but -maxruntime is %s",
+				least, cfg.maxRuntime)
+		}
+	}
+	return warnings.result()
+}
+
+// leastProductionTime estimates the shortest time producers' delays allow for making every widget,
+// or 0 if some producer has no delay or the run isn't for a fixed number of widgets.
+func leastProductionTime(cfg config) time.Duration {
+	if len(cfg.producerDelays) == 0 || cfg.duration > 0 || cfg.replay != "" {
+		return 0
+	}
+	var rate float64 // widgets per second from every producer together
+	var slowest time.Duration
+	unlimited := false // some producer has no delay
+	for i := 0; i < cfg.numProducers; i++ {
+		delay := cfg.producerDelays[i%len(cfg.producerDelays)]
+		if delay > slowest {
+			slowest = delay
+		}
+		if delay == 0 {
+			unlimited = true
+			continue
+		}
+		rate += 1 / delay.Seconds()
+	}
+	if cfg.perProducer > 0 {
+		// Each producer makes its own share, so the slowest one sets the pace
+		return time.Duration(cfg.perProducer) * slowest
+	}
+	if unlimited {
+		return 0
+	}
+	return time.Duration(float64(cfg.numWidgets) / rate * float64(time.Second))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRunnable(t *testing.T) {
+	for _, test := range []struct {
+		args     []string
+		warnings []string // a fragment of each warning expected, in order
+	}{
+		{[]string{"-n", "100"}, nil},
+		{[]string{"-duration", "2s", "-maxruntime", "1s"}, []string{"-duration 2s"}},
+		{[]string{"-p", "5", "-rampup", "1s", "-maxruntime", "3s"}, []string{"starts after 4s"}},
+		{[]string{"-p", "5", "-rampup", "1s", "-maxruntime", "5s"}, nil},
+		{[]string{"-n", "100", "-p", "2", "-producerdelays", "10ms,40ms", "-maxruntime", "500ms"}, []string{"at least 800ms"}},
+		{[]string{"-n", "100", "-p", "2", "-producerdelays", "0,40ms", "-maxruntime", "500ms"}, nil},
+		{[]string{"-perproducer", "20", "-p", "2", "-producerdelays", "0,40ms", "-maxruntime", "500ms"}, []string{"at least 800ms"}},
+		{[]string{"-n", "10", "-k", "500"}, []string{"-k 500 is past the last of 10"}},
+		{[]string{"-n", "10", "-k", "10"}, nil},
+		{[]string{"-perproducer", "5", "-p", "2", "-k", "11"}, []string{"-k 11 is past the last of 10"}},
+		{[]string{"-duration", "1s", "-k", "500"}, nil},
+		{[]string{"-n", "10", "-every", "500"}, nil},
+	} {
+		cfg, err := parseConfig(test.args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		warnings, err := validateRunnable(cfg)
+		if err != nil {
+			t.Errorf("%v: %v", test.args, err)
+		}
+		if len(warnings) != len(test.warnings) {
+			t.Errorf("%v: expected %d warnings, got %q", test.args, len(test.warnings), warnings)
+			continue
+		}
+		for i, warning := range warnings {
+			if !strings.Contains(warning, test.warnings[i]) {
+				t.Errorf("%v: expected a warning about %q, got %q", test.args, test.warnings[i], warning)
+			}
+		}
+	}
+
+	// -strict makes the warning an error, including for a pipeline built directly
+	cfg, err := parseConfig([]string{"-n", "10", "-k", "500", "-strict"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warnings, err := validateRunnable(cfg); err == nil || !strings.Contains(err.Error(), "-k 500") || warnings != nil {
+		t.Errorf("-strict gave warnings %q and error %v, expected only an error about -k", warnings, err)
+	}
+	if _, err := NewPipeline(cfg); err == nil {
+		t.Error("Pipeline created under -strict despite a warning")
+	}
+
+	// Configurations built without parseConfig are checked too
+	cfg = defaultConfig()
+	cfg.numConsumers = 0
+	if _, err := NewPipeline(cfg); err == nil {
+		t.Error("Pipeline with no consumers was created")
+	}
+	cfg = defaultConfig()
+	cfg.numProducers, cfg.mode = 0, "consume"
+	if _, err := validateRunnable(cfg); err != nil {
+		t.Errorf("Consume mode needs no producers: %v", err)
+	}
+}
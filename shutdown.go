@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// SHUTDOWN LOGIC
+// shutdownHandler turns interrupt signals into a graceful shutdown that escalates to a forced exit.
+// The first signal calls stop, so producers halt and consumers drain whatever is still buffered.
+// A second signal forces an immediate exit, as does the drain outlasting forceAfter (if non-zero).
+type shutdownHandler struct {
+	signals    <-chan os.Signal
+	forceAfter time.Duration // grace period for the drain after the first signal, 0 waits indefinitely
+	stop       func()        // begins a graceful shutdown
+	force      func()        // exits immediately
+}
+
+// watch handles signals until done is closed, which should happen once the pipeline has finished.
+func (h *shutdownHandler) watch(done <-chan struct{}) {
+	select {
+	case <-h.signals:
+	case <-done:
+		return
+	}
+	fmt.Fprintln(os.Stderr, "Interrupted -- stopping production (interrupt again to exit immediately)")
+	h.stop()
+
+	// A nil channel never fires, so without a grace period only a second signal forces an exit
+	var deadline <-chan time.Time
+	if h.forceAfter > 0 {
+		timer := time.NewTimer(h.forceAfter)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	select {
+	case <-h.signals:
+		fmt.Fprintln(os.Stderr, "Interrupted again -- exiting immediately")
+	case <-deadline:
+		fmt.Fprintf(os.Stderr, "Shutdown did not finish within %s -- exiting immediately\n", h.forceAfter)
+	case <-done:
+		return
+	}
+	h.force()
+}
+
+// handleInterrupts watches signals in the background, calling stop on the first and exiting the
+// process through exit on the second or once forceAfter has passed. exit is os.Exit, or wraps it to
+// clean up what deferred calls would have. The returned function must be called when the pipeline
+// finishes.
+func handleInterrupts(signals <-chan os.Signal, forceAfter time.Duration, stop func(), exit func(code int)) (finished func()) {
+	h := shutdownHandler{signals: signals,
+		forceAfter: forceAfter,
+		stop:       stop,
+		force:      func() { exit(exitInterrupted) }}
+	done := make(chan struct{})
+	go h.watch(done)
+	return func() { close(done) }
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// timeToForce sends numSignals signals to a shutdownHandler whose drain never finishes, and returns
+// how long it took to force an exit.
+func timeToForce(t *testing.T, numSignals int, forceAfter time.Duration) time.Duration {
+	signals := make(chan os.Signal, numSignals)
+	stopped := make(chan struct{})
+	forced := make(chan struct{})
+	h := shutdownHandler{signals: signals,
+		forceAfter: forceAfter,
+		stop:       func() { close(stopped) },
+		force:      func() { close(forced) }}
+
+	done := make(chan struct{})
+	defer close(done)
+	go h.watch(done)
+
+	start := time.Now()
+	for i := 0; i < numSignals; i++ {
+		signals <- os.Interrupt
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("First signal did not stop production")
+	}
+	select {
+	case <-forced:
+	case <-time.After(forceAfter + time.Second):
+		t.Fatalf("Shutdown was never forced")
+	}
+	return time.Since(start)
+}
+
+func TestShutdown(t *testing.T) {
+	forceAfter := 300 * time.Millisecond
+
+	// A single signal waits out the grace period before forcing an exit
+	graceful := timeToForce(t, 1, forceAfter)
+	if graceful < forceAfter {
+		t.Errorf("Exit forced after %s, before the %s grace period ended", graceful, forceAfter)
+	}
+
+	// A second signal forces an exit without waiting for the drain
+	rapid := timeToForce(t, 2, forceAfter)
+	if rapid >= graceful {
+		t.Errorf("Second signal took %s to force an exit, no faster than draining (%s)", rapid, graceful)
+	}
+
+	// Finishing normally means signals are never acted on
+	called := false
+	h := shutdownHandler{signals: make(chan os.Signal),
+		stop:  func() { called = true },
+		force: func() { called = true }}
+	done := make(chan struct{})
+	close(done)
+	h.watch(done)
+	if called {
+		t.Errorf("Finished pipeline still reacted to shutdown")
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SINK LOGIC
+// Sink durably records consumed widgets along with what happened to them. Consumers share a single
+// Sink, so implementations must be safe for concurrent use.
+type Sink interface {
+	Write(w widget, result ResultCode) error
+}
+
+// ResultCode is the fate of a widget once it reaches a consumer. It gives downstream tooling a
+// single field to key off regardless of which mode the pipeline ran in. A sink is told a widget's
+// final result once it has been handled, the same result the run's results summary tallies.
+type ResultCode string
+
+const (
+	resultConsumed     ResultCode = "consumed"      // handled normally
+	resultBroken       ResultCode = "broken"        // found broken, production was signaled to stop
+	resultDeadLettered ResultCode = "dead_lettered" // found broken and set aside without stopping production
+	resultSkipped      ResultCode = "skipped"       // deliberately not handled, e.g. a duplicate
+	resultExpired      ResultCode = "expired"       // discarded before handling for being older than the ttl
+	resultDropped      ResultCode = "dropped"       // shed by -overflow before reaching a consumer
+	resultTimedOut     ResultCode = "timed_out"     // abandoned when a deadline passed
+	resultDuplicate    ResultCode = "duplicate"     // handled, but its id had already been consumed; only with -verify-unique
+	resultFailed       ResultCode = "failed"        // the handler returned an error or panicked
+)
+
+// openSink opens the sink described by spec, which is one of:
+//
+//	""                  - no sink
+//	file:<path>         - one JSON record per line, gzipped if path ends in .gz
+//	sqlite:<path>       - a widgets table in a SQLite database, written through the sqlite3 CLI
+//
+// Sinks that hold resources implement io.Closer and must be closed after the last Write.
+func openSink(spec string) (Sink, error) {
+	if spec == "" {
+		return noopSink{}, nil
+	}
+	kind, path, found := strings.Cut(spec, ":")
+	if !found || path == "" {
+		return nil, errors.New("sink must be given as <kind>:<path>")
+	}
+	// Errors return a nil Sink rather than a nil pointer, which callers would go on to close
+	var sink Sink
+	var err error
+	switch kind {
+	case "file":
+		sink, err = newFileSink(path)
+	case "sqlite":
+		sink, err = newSQLiteSink(path)
+	default:
+		return nil, errors.New("unknown sink kind " + kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// closeSink closes sink if it holds resources.
+func closeSink(sink Sink) error {
+	if closer, ok := sink.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// sinkRecord is the form in which a consumed widget is persisted.
+type sinkRecord struct {
+	ID           string            `json:"id"`
+	Source       string            `json:"source"`
+	ProducerID   int               `json:"producer_id"`
+	Type         string            `json:"type,omitempty"`
+	ProducedTime time.Time         `json:"produced_time"`
+	ConsumedTime time.Time         `json:"consumed_time"`
+	Broken       bool              `json:"broken"`
+	Result       ResultCode        `json:"result"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// newSinkRecord describes w as reaching a consumer right now with the given result.
+func newSinkRecord(w widget, result ResultCode) sinkRecord {
+	return sinkRecord{ID: w.id, Source: w.source, ProducerID: w.producerID, Type: w.widgetType, ProducedTime: w.time, ConsumedTime: time.Now(), Broken: w.broken, Result: result,
+		Metadata: w.metadata}
+}
+
+// noopSink discards every widget.
+type noopSink struct{}
+
+func (noopSink) Write(w widget, result ResultCode) error {
+	return nil
+}
+
+// fileSink writes one JSON record per line, gzipped if the path ends in .gz.
+type fileSink struct {
+	mutex sync.Mutex // exclusion on writes from concurrent consumers
+	file  *os.File
+	gz    *gzip.Writer // nil unless compressing
+	out   *bufio.Writer
+	enc   *json.Encoder
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSink{file: file}
+	var w io.Writer = file
+	if strings.HasSuffix(path, ".gz") {
+		s.gz = gzip.NewWriter(file)
+		w = s.gz
+	}
+	s.out = bufio.NewWriter(w)
+	s.enc = json.NewEncoder(s.out)
+	return s, nil
+}
+
+func (s *fileSink) Write(w widget, result ResultCode) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.enc.Encode(newSinkRecord(w, result))
+}
+
+// Close flushes buffered records and closes the file. When compressing, the gzip trailer is
+// written first; without it the file can't be read back.
+func (s *fileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.out.Flush()
+	if s.gz != nil && err == nil {
+		err = s.gz.Close()
+	}
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// sqliteSink streams INSERT statements to a sqlite3 process, so no database driver is needed.
+// Writes are serialized by a mutex. Rows are committed in batches, every sqliteBatchRows rows or
+// sqliteBatchInterval, whichever comes first, so they become durable while the run goes on.
+type sqliteSink struct {
+	mutex   sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	out     *bufio.Writer
+	pending int           // rows written since the last commit
+	err     error         // the first failed periodic commit, returned by the next Write or Close
+	stop    chan struct{} // closed to stop the periodic commits
+	stopped chan struct{} // closed once the periodic commits have stopped
+}
+
+const (
+	sqliteBatchRows     = 1000        // rows committed together at most
+	sqliteBatchInterval = time.Second // longest a written row waits to be committed
+)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS widgets (
+	id TEXT NOT NULL,
+	source TEXT NOT NULL,
+	producer_id INTEGER NOT NULL,
+	type TEXT NOT NULL,
+	produced_time TEXT NOT NULL,
+	consumed_time TEXT NOT NULL,
+	broken INTEGER NOT NULL,
+	result TEXT NOT NULL
+);
+BEGIN;
+`
+
+func newSQLiteSink(path string) (*sqliteSink, error) {
+	if err := checkSQLite(); err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("sqlite3", "-bail", path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("can't start sqlite3 (is it installed?): %v", err)
+	}
+	s := &sqliteSink{cmd: cmd, stdin: stdin, out: bufio.NewWriter(stdin), stop: make(chan struct{}), stopped: make(chan struct{})}
+	go s.commitPeriodically()
+	if _, err := s.out.WriteString(sqliteSchema); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// checkSQLite reports whether the sqlite3 command line tool can be found, so a missing one is
+// reported when the sink is opened rather than partway through a run.
+func checkSQLite() error {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		return fmt.Errorf("the sqlite sink needs the sqlite3 command line tool: %v", err)
+	}
+	return nil
+}
+
+// commitPeriodically commits the rows written so far every sqliteBatchInterval until stop is closed.
+func (s *sqliteSink) commitPeriodically() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(sqliteBatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.mutex.Lock()
+			if err := s.commit(); err != nil && s.err == nil {
+				s.err = err
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// commit ends the current transaction, if any rows were written in it, and starts the next one.
+// The caller must hold the mutex.
+func (s *sqliteSink) commit() error {
+	if s.pending == 0 {
+		return nil
+	}
+	s.pending = 0
+	if _, err := s.out.WriteString("COMMIT;\nBEGIN;\n"); err != nil {
+		return err
+	}
+	return s.out.Flush()
+}
+
+func (s *sqliteSink) Write(w widget, result ResultCode) error {
+	r := newSinkRecord(w, result)
+	broken := 0
+	if r.Broken {
+		broken = 1
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	_, err := fmt.Fprintf(s.out, "INSERT INTO widgets VALUES (%s, %s, %d, %s, '%s', '%s', %d, %s);\n",
+		sqlQuote(r.ID), sqlQuote(r.Source), r.ProducerID, sqlQuote(r.Type), r.ProducedTime.Format(time.RFC3339Nano), r.ConsumedTime.Format(time.RFC3339Nano), broken, sqlQuote(string(r.Result)))
+	if err != nil {
+		return err
+	}
+	if s.pending++; s.pending >= sqliteBatchRows {
+		return s.commit()
+	}
+	return nil
+}
+
+// Close commits the last batch and waits for sqlite3 to exit.
+func (s *sqliteSink) Close() error {
+	close(s.stop)
+	<-s.stopped
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.err
+	if _, writeErr := s.out.WriteString("COMMIT;\n"); err == nil {
+		err = writeErr
+	}
+	if err == nil {
+		err = s.out.Flush()
+	}
+	s.stdin.Close()
+	if waitErr := s.cmd.Wait(); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// sqlQuote renders str as a SQL string literal.
+func sqlQuote(str string) string {
+	return "'" + strings.ReplaceAll(str, "'", "''") + "'"
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeConcurrently writes numWidgets widgets to sink from several goroutines, with every third broken.
+func writeConcurrently(t *testing.T, sink Sink, numWidgets int) {
+	var wg sync.WaitGroup
+	for i := 1; i <= numWidgets; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			w := widget{id: strconv.Itoa(id), source: "Producer_1", producerID: 1, time: time.Now(), broken: id%3 == 0}
+			result := resultConsumed
+			if w.broken {
+				result = resultBroken
+			}
+			if err := sink.Write(w, result); err != nil {
+				t.Errorf("Write of widget %d failed: %v", id, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := closeSink(sink); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "widgets.jsonl")
+	sink, err := openSink("file:" + path)
+	if err != nil {
+		t.Fatalf("Can't open file sink: %v", err)
+	}
+	writeConcurrently(t, sink, 30)
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Can't open sink output: %v", err)
+	}
+	defer file.Close()
+
+	records, broken := 0, 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r sinkRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("Malformed record %q: %v", scanner.Text(), err)
+		}
+		if r.ProducerID != 1 {
+			t.Errorf("Widget %s recorded with producer %d", r.ID, r.ProducerID)
+		}
+		if r.ConsumedTime.Before(r.ProducedTime) {
+			t.Errorf("Widget %s consumed before it was produced", r.ID)
+		}
+		records++
+		if r.Broken {
+			broken++
+		}
+		if r.Broken != (r.Result == resultBroken) {
+			t.Errorf("Widget %s recorded with result %s", r.ID, r.Result)
+		}
+	}
+	if records != 30 || broken != 10 {
+		t.Errorf("Expected 30 records with 10 broken, got %d with %d broken", records, broken)
+	}
+}
+
+func TestGzipFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "widgets.jsonl.gz")
+	sink, err := openSink("file:" + path)
+	if err != nil {
+		t.Fatalf("Can't open file sink: %v", err)
+	}
+	writeConcurrently(t, sink, 3000)
+
+	// The output is only readable if the gzip trailer was written on close
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Sink output isn't gzipped: %v", err)
+	}
+	records := 0
+	dec := json.NewDecoder(gz)
+	for {
+		var r sinkRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Corrupt sink output after %d records: %v", records, err)
+		}
+		records++
+	}
+	if records != 3000 {
+		t.Errorf("Read back %d records, expected 3000", records)
+	}
+
+	// A gzipped log can be replayed directly
+	replay, err := openReplay(path, false, replayPaceFast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	replayed := 0
+	for _, err := replay.Next(); err == nil; _, err = replay.Next() {
+		replayed++
+	}
+	if replayed != 3000 {
+		t.Errorf("Replayed %d widgets from the gzipped log, expected 3000", replayed)
+	}
+}
+
+func TestSQLiteSink(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+
+	path := filepath.Join(t.TempDir(), "widgets.db")
+	sink, err := openSink("sqlite:" + path)
+	if err != nil {
+		t.Fatalf("Can't open sqlite sink: %v", err)
+	}
+	writeConcurrently(t, sink, 30)
+
+	out, err := exec.Command("sqlite3", path, "SELECT count(*), sum(broken), sum(result = 'broken') FROM widgets").Output()
+	if err != nil {
+		t.Fatalf("Can't query database: %v", err)
+	}
+	if strings.TrimSpace(string(out)) != "30|10|10" {
+		t.Errorf("Expected 30 rows with 10 broken, got %q", out)
+	}
+}
+
+func TestSQLiteSinkWithoutSQLite(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	path := filepath.Join(t.TempDir(), "widgets.db")
+	for _, classify := range []Classifier{nil, classifiers["type"]} {
+		sink, err := openRoutedSink("sqlite:"+path, classify)
+		if err == nil || sink != nil {
+			t.Errorf("Opened a sqlite sink without sqlite3 installed: %v, %v", sink, err)
+		}
+	}
+}
+
+func TestSQLiteSinkCommitsDuringRun(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+
+	path := filepath.Join(t.TempDir(), "widgets.db")
+	sink, err := openSink("sqlite:" + path)
+	if err != nil {
+		t.Fatalf("Can't open sqlite sink: %v", err)
+	}
+	defer closeSink(sink)
+	for i := range 5 {
+		if err := sink.Write(widget{id: strconv.Itoa(i)}, resultConsumed); err != nil {
+			t.Fatalf("Can't write widget: %v", err)
+		}
+	}
+
+	// The rows should be committed by the timer, well before the sink is closed
+	deadline := time.Now().Add(sqliteBatchInterval + 5*time.Second)
+	for {
+		out, err := exec.Command("sqlite3", path, "SELECT count(*) FROM widgets").Output()
+		if err == nil && strings.TrimSpace(string(out)) == "5" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Rows weren't committed before the sink was closed, got %q (%v)", out, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// recordingSink remembers the result recorded for each widget id.
+type recordingSink struct {
+	mutex   sync.Mutex
+	results map[string]ResultCode
+}
+
+func (s *recordingSink) Write(w widget, result ResultCode) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.results[w.id] = result
+	return nil
+}
+
+func TestSinkResults(t *testing.T) {
+	numWidgets, kthBadWidget := 8, 3
+
+	// Each mode feeds the widgets of a run to consumers through widgetChan, returning once it is closed
+	modes := map[string]func(t *testing.T, widgetChan chan widget){
+		"local": func(t *testing.T, widgetChan chan widget) {
+			var wg sync.WaitGroup
+			wg.Add(1)
+			shouldStop := false
+			shouldStopMutex := sync.Mutex{}
+			producerGroup := newProducerGroup(config{numProducers: 1, numWidgets: numWidgets, kthBadWidget: kthBadWidget}, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+			producerGroup.spawnProducers()
+			wg.Wait()
+			close(widgetChan)
+		},
+		"socket": func(t *testing.T, widgetChan chan widget) {
+			if runtime.GOOS == "windows" {
+				t.Skip("Unix domain sockets are not supported on Windows")
+			}
+			path := filepath.Join(t.TempDir(), "widgets.sock")
+			ln, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatalf("Can't listen on %s: %v", path, err)
+			}
+			defer ln.Close()
+			go produceToSocket(config{numProducers: 1, numWidgets: numWidgets, kthBadWidget: kthBadWidget, unixSocket: path, codec: codecNDJSON}, nil)
+			receiveFromSocket(ln, codecNDJSON, widgetChan, func() bool { return false }, nil)
+		},
+	}
+
+	for name, runMode := range modes {
+		t.Run(name, func(t *testing.T) {
+			widgetChan := make(chan widget, numWidgets)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			shouldStop := false
+			shouldStopMutex := sync.Mutex{}
+			sink := &recordingSink{results: make(map[string]ResultCode)}
+			consumerGroup := newConsumerGroup(config{numConsumers: 1}, widgetChan, &wg, &shouldStop, &shouldStopMutex, sink, csvDiscard(t))
+			consumerGroup.spawnConsumers()
+			runMode(t, widgetChan)
+			wg.Wait()
+
+			// Production may stop anywhere after the broken widget
+			if len(sink.results) < kthBadWidget {
+				t.Errorf("Expected at least %d records, got %d", kthBadWidget, len(sink.results))
+			}
+			for id, result := range sink.results {
+				expected := resultConsumed
+				if id == strconv.Itoa(kthBadWidget) {
+					expected = resultBroken
+				}
+				if result != expected {
+					t.Errorf("Widget %s classified as %s, expected %s", id, result, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestSinkAgreesWithResults(t *testing.T) {
+	// A widget whose handler failed is recorded as failed, not as consumed
+	path := filepath.Join(t.TempDir(), "widgets.jsonl")
+	cfg, err := parseConfig([]string{"-n", "200", "-c", "2", "-consumer-error-rate", "0.1", "-sink", "file:" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Results[resultFailed] == 0 {
+		t.Fatalf("No widgets failed: %v", result.Results)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := make(map[ResultCode]int)
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var r sinkRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("Malformed record %q: %v", line, err)
+		}
+		recorded[r.Result]++
+	}
+	if len(recorded) != len(result.Results) {
+		t.Errorf("Sink recorded %v, but the results were %v", recorded, result.Results)
+	}
+	for code, n := range result.Results {
+		if recorded[code] != n {
+			t.Errorf("Sink recorded %d widgets %s, but %d were tallied", recorded[code], code, n)
+		}
+	}
+}
+
+// csvDiscard returns a widgetWriter that keeps consumers from printing during tests.
+func csvDiscard(t *testing.T) widgetWriter {
+	output, err := newWidgetWriter("csv", io.Discard)
+	if err != nil {
+		t.Fatalf("Can't create csv writer: %v", err)
+	}
+	return output
+}
+
+func TestOpenSink(t *testing.T) {
+	for _, spec := range []string{"file", "file:", "postgres:widgets"} {
+		if _, err := openSink(spec); err == nil {
+			t.Errorf("Invalid sink %q not rejected", spec)
+		}
+	}
+	if sink, err := openSink(""); err != nil || sink != (noopSink{}) {
+		t.Errorf("Empty sink should be a no-op")
+	}
+}
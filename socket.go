@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// SOCKET LOGIC
+// In produce mode the producers' widgets are encoded onto a Unix domain socket instead of being
+// consumed locally; in consume mode the consumers are fed from a socket instead of local producers.
+// The consume side listens and the produce side dials, so the consumer should be started first.
+
+// produceToSocket runs the producers and forwards every widget to the consumer listening at cfg.unixSocket.
+// Production stops gracefully on the first signal received on signals. If the consumer hangs up
+// after a broken widget was sent, the error wraps ErrProductionStopped.
+func produceToSocket(cfg config, signals <-chan os.Signal) error {
+	if cfg.replay != "" {
+		replay, err := openReplay(cfg.replay, cfg.replayRebase, cfg.replayPace)
+		if err != nil {
+			return err
+		}
+		defer replay.Close()
+		cfg.source = replay
+	}
+	if cfg.from != "" {
+		listed, err := openTextSource(cfg.from)
+		if err != nil {
+			return err
+		}
+		defer listed.Close()
+		cfg.source = listed
+	}
+
+	conn, err := net.Dial("unix", cfg.unixSocket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	enc, err := newWidgetEncoder(cfg.codec, conn)
+	if err != nil {
+		return err
+	}
+
+	widgetChan := make(chan widget, cfg.channelBuffer())
+
+	var producerWG sync.WaitGroup
+	producerWG.Add(cfg.numProducers)
+
+	producersShouldStopMutex := sync.Mutex{}
+	producersShouldStop := false
+
+	producerGroup := newProducerGroup(cfg, widgetChan, &producersShouldStop, &producerWG, &producersShouldStopMutex)
+
+	if cfg.admin != "" {
+		stopAdmin, err := startAdmin(cfg.admin, &producerGroup, nil, cfg.runID)
+		if err != nil {
+			return err
+		}
+		defer stopAdmin()
+	}
+	if cfg.pprof != "" {
+		stopPprof, err := startPprof(cfg.pprof)
+		if err != nil {
+			return err
+		}
+		defer stopPprof()
+	}
+
+	finished := handleInterrupts(signals, cfg.forceAfter, func() {
+		requestStop(&producersShouldStop, &producersShouldStopMutex)
+	}, cfg.forceExit())
+	defer finished()
+
+	producerGroup.spawnProducers()
+
+	type forwarded struct {
+		brokenID string
+		err      error
+	}
+	forwardDone := make(chan forwarded)
+	go func() {
+		brokenID, err := forwardWidgets(enc, widgetChan, func() {
+			requestStop(&producersShouldStop, &producersShouldStopMutex)
+		})
+		forwardDone <- forwarded{brokenID, err}
+	}()
+
+	producerWG.Wait()
+	close(widgetChan)
+	reportDuration(cfg, &producerGroup)
+	reportProducerRates(cfg, &producerGroup)
+
+	// The consumer hangs up once it finds a broken widget, so a failed write just ends production
+	f := <-forwardDone
+	if f.err == nil {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Consumer closed the connection (%v) -- stopping production\n", f.err)
+	if f.brokenID != "" {
+		return fmt.Errorf("%w by broken widget %s", ErrProductionStopped, f.brokenID)
+	}
+	return nil
+}
+
+// forwardWidgets encodes every widget received on widgetChan until the channel is closed, returning
+// the id of the first broken widget sent, if any. After the first failed write, stop is called and
+// the remaining widgets are discarded so producers never block.
+func forwardWidgets(enc widgetEncoder, widgetChan <-chan widget, stop func()) (string, error) {
+	var brokenID string
+	var writeErr error
+	for w := range widgetChan {
+		if writeErr != nil {
+			continue
+		}
+		if writeErr = enc.Encode(w); writeErr != nil {
+			stop()
+		} else if w.broken && brokenID == "" {
+			brokenID = w.id
+		}
+	}
+	return brokenID, writeErr
+}
+
+// consumeFromSocket listens at cfg.unixSocket and runs the consumers on widgets received from a
+// single producer connection. The socket file is removed when the listener is closed. On the first
+// signal received on signals, consumers stop taking new widgets and drain what was already received.
+// As with a pipeline, if a broken widget stops production the error wraps ErrProductionStopped.
+func consumeFromSocket(cfg config, signals <-chan os.Signal) (Result, error) {
+	start := time.Now()
+	sink, err := openRoutedSink(cfg.sink, cfg.classifier())
+	if err != nil {
+		return Result{}, err
+	}
+
+	output, err := newWidgetWriter(cfg.format, cfg.stdout())
+	if err != nil {
+		closeSink(sink)
+		return Result{}, err
+	}
+
+	ln, codec, err := listenForProducer(cfg)
+	if err != nil {
+		finishConsumers(output, sink)
+		return Result{}, err
+	}
+	defer ln.Close()
+	if cfg.listening != nil {
+		if err := cfg.listening(ln); err != nil {
+			finishConsumers(output, sink)
+			return Result{}, err
+		}
+	}
+
+	if cfg.pprof != "" {
+		stopPprof, err := startPprof(cfg.pprof)
+		if err != nil {
+			finishConsumers(output, sink)
+			return Result{}, err
+		}
+		defer stopPprof()
+	}
+
+	if cfg.otel != "" {
+		endpoint, err := otelEndpoint(cfg.otel)
+		if err != nil {
+			finishConsumers(output, sink)
+			return Result{}, err
+		}
+		cfg.tracer = newSpanExporter(endpoint, cfg.runID)
+		defer cfg.tracer.Close()
+	}
+
+	widgetChan := make(chan widget, cfg.channelBuffer())
+
+	var consumerWG sync.WaitGroup
+	consumerWG.Add(cfg.numConsumers)
+
+	producersShouldStopMutex := sync.Mutex{}
+	producersShouldStop := false
+
+	consumerGroup := newConsumerGroup(cfg, widgetChan, &consumerWG, &producersShouldStop, &producersShouldStopMutex, sink, output)
+
+	// Stopping can't wait for the producer to connect or send its next widget, so it hangs up
+	interrupted := make(chan struct{})
+	exit := cfg.forceExit()
+	finished := handleInterrupts(signals, cfg.forceAfter, func() {
+		requestStop(&producersShouldStop, &producersShouldStopMutex)
+		close(interrupted)
+	}, func(code int) {
+		if cfg.listen == "" {
+			// Exiting skips the deferred Close that would have removed the socket file
+			os.Remove(cfg.unixSocket)
+		}
+		exit(code)
+	})
+	defer finished()
+
+	consumerGroup.spawnConsumers()
+	stopReporting := startThroughputReporter(os.Stderr, cfg.reportInterval, func() int {
+		return int(consumerGroup.consumed.Load())
+	}, consumerGroup.window)
+
+	err = receiveFromSocket(ln, codec, widgetChan, func() bool {
+		return stopRequested(&producersShouldStop, &producersShouldStopMutex)
+	}, interrupted)
+	consumerGroup.startDrainTimer()
+	consumerWG.Wait()
+	stopReporting()
+	result := Result{Consumed: int(consumerGroup.consumed.Load()), Results: make(map[ResultCode]int)}
+	result.Abandoned = reportAbandoned(cfg, &consumerGroup)
+	result.Expired = reportExpired(cfg, &consumerGroup)
+	reportThrottle(os.Stderr, consumerGroup.throttle)
+	result.Panics = reportPanics(cfg, &consumerGroup)
+	result.Injected = reportInjected(cfg, &consumerGroup)
+	consumerGroup.typeTallies.report(os.Stderr)
+	consumerGroup.results.addTo(result.Results)
+	reportResults(os.Stderr, result.Results)
+	result.Elapsed = time.Since(start)
+	if cfg.drain {
+		reportDrained(cfg.stdout(), result.Consumed, result.Elapsed)
+	}
+
+	if finishErr := finishConsumers(output, sink); err == nil {
+		err = finishErr
+	}
+	if err == nil {
+		err = errors.Join(consumerGroup.duplicateError(), consumerGroup.orderError(), consumerGroup.fatalError())
+	}
+	return result, errors.Join(err, consumerGroup.stoppedError())
+}
+
+// listenForProducer listens where consume mode expects its producer to connect, returning the
+// codec to decode widgets with. That is a TCP address for -listen, which always uses length-prefixed
+// frames to match -forward, or the Unix domain socket otherwise.
+func listenForProducer(cfg config) (net.Listener, string, error) {
+	if cfg.listen != "" {
+		ln, err := net.Listen("tcp", cfg.listen)
+		return ln, codecBinary, err
+	}
+	ln, err := net.Listen("unix", cfg.unixSocket)
+	return ln, cfg.codec, err
+}
+
+// receiveFromSocket accepts one connection on ln and decodes widgets from it onto widgetChan until
+// the producer disconnects or shouldStop reports true. Closing interrupted closes ln and the
+// connection, so an interrupt doesn't wait for a producer to connect or send; a nil channel never
+// does. widgetChan is closed before returning.
+func receiveFromSocket(ln net.Listener, codec string, widgetChan chan<- widget, shouldStop func() bool, interrupted <-chan struct{}) error {
+	defer close(widgetChan)
+
+	var mutex sync.Mutex // guards conn and hungUp
+	var conn net.Conn
+	hungUp := false
+	received := make(chan struct{})
+	defer close(received)
+	go func() {
+		select {
+		case <-interrupted:
+		case <-received:
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		hungUp = true
+		ln.Close()
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	// Once interrupted, the errors from Accept and Decode are only the closing showing through
+	interrupt := func(err error) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if hungUp {
+			return nil
+		}
+		return err
+	}
+
+	accepted, err := ln.Accept()
+	if err != nil {
+		return interrupt(err)
+	}
+	mutex.Lock()
+	conn = accepted
+	if hungUp {
+		conn.Close()
+	}
+	mutex.Unlock()
+	// Hanging up is how the producer side learns that production should stop
+	defer accepted.Close()
+
+	dec, err := newWidgetDecoder(codec, accepted)
+	if err != nil {
+		return err
+	}
+
+	for !shouldStop() {
+		w, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return interrupt(err)
+		}
+		widgetChan <- w
+	}
+	return nil
+}
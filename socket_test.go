@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are not supported on Windows")
+	}
+
+	for _, codec := range []string{codecNDJSON, codecBinary} {
+		path := filepath.Join(t.TempDir(), "widgets.sock")
+		cfg := config{numProducers: 3, numWidgets: 20, kthBadWidget: -1, mode: "produce", unixSocket: path, codec: codec}
+
+		ln, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatalf("Can't listen on %s: %v", path, err)
+		}
+
+		widgetChan := make(chan widget, cfg.numWidgets)
+		received := make(chan error)
+		go func() {
+			received <- receiveFromSocket(ln, codec, widgetChan, func() bool { return false }, nil)
+		}()
+
+		if err := produceToSocket(cfg, nil); err != nil {
+			t.Errorf("%s: produceToSocket failed: %v", codec, err)
+		}
+		if err := <-received; err != nil {
+			t.Errorf("%s: receiveFromSocket failed: %v", codec, err)
+		}
+		ln.Close()
+
+		// Every widget should arrive exactly once
+		seen := make(map[string]bool)
+		for w := range widgetChan {
+			if w.source != "Producer_"+strconv.Itoa(w.producerID) {
+				t.Errorf("%s: widget %s has source %s but producer %d", codec, w.id, w.source, w.producerID)
+			}
+			if seen[w.id] {
+				t.Errorf("%s: widget %s received twice", codec, w.id)
+			}
+			seen[w.id] = true
+		}
+		for i := 1; i <= cfg.numWidgets; i++ {
+			if !seen[strconv.Itoa(i)] {
+				t.Errorf("%s: widget %d never received", codec, i)
+			}
+		}
+	}
+}
+
+func TestConsumeInterrupted(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are not supported on Windows")
+	}
+
+	// An interrupt stops consume mode whether or not a producer has connected, or is sending
+	for _, connect := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "widgets.sock")
+		cfg := defaultConfig()
+		cfg.mode, cfg.unixSocket, cfg.out = "consume", path, io.Discard
+		signals := make(chan os.Signal, 1)
+		cfg.listening = func(net.Listener) error {
+			if connect {
+				conn, err := net.Dial("unix", path)
+				if err != nil {
+					return err
+				}
+				t.Cleanup(func() { conn.Close() })
+			}
+			signals <- os.Interrupt
+			return nil
+		}
+
+		done := make(chan error, 1)
+		go func() { _, err := consumeFromSocket(cfg, signals); done <- err }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Connected %t: interrupted consume failed: %v", connect, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Connected %t: consume didn't stop within 5s of an interrupt", connect)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Connected %t: socket file left behind: %v", connect, err)
+		}
+	}
+}
+
+// TestSocketExitBroken runs each socket mode as the program, and checks that a broken widget makes
+// both sides exit as a pipeline stopped by one would.
+func TestSocketExitBroken(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix domain sockets are not supported on Windows")
+	}
+	// start runs the program with args as main, failing the test if it hasn't exited within 10s
+	start := func(args ...string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], args...)
+		cmd.Env = append(os.Environ(), runMainEnv+"=1")
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		kill := time.AfterFunc(10*time.Second, func() { cmd.Process.Kill() })
+		t.Cleanup(func() { kill.Stop() })
+		return cmd
+	}
+	exitStatus := func(cmd *exec.Cmd) (int, error) {
+		err := cmd.Wait()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode(), err
+		}
+		return 0, err
+	}
+	expectBroken := func(side string, cmd *exec.Cmd) {
+		if status, err := exitStatus(cmd); status != exitBroken {
+			t.Errorf("%s exited with %v, expected status %d", side, err, exitBroken)
+		}
+	}
+
+	t.Run("unix-socket", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "widgets.sock")
+		consumer := start("consume", "-unix-socket", path)
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if _, err := os.Stat(path); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Consumer side never listened at %s", path)
+			}
+		}
+		// Producing for long enough that the consumer hangs up part way
+		producer := start("produce", "-unix-socket", path, "-duration", "1m", "-k", "2")
+		expectBroken("consume", consumer)
+		expectBroken("produce", producer)
+	})
+
+	t.Run("listen", func(t *testing.T) {
+		probe, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := probe.Addr().String()
+		probe.Close()
+		consumer := start("-listen", address)
+		// Until the consumer side is listening, -forward fails before producing anything
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			status, err := exitStatus(start("-forward", address, "-n", "20", "-k", "5"))
+			if status != exitFailed || time.Now().After(deadline) {
+				if status != exitBroken {
+					t.Errorf("-forward exited with %v, expected status %d", err, exitBroken)
+				}
+				break
+			}
+		}
+		expectBroken("-listen", consumer)
+	})
+
+	t.Run("multiprocess", func(t *testing.T) {
+		expectBroken("-multiprocess", start("-multiprocess", "-n", "5", "-k", "2"))
+	})
+}
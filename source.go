@@ -0,0 +1,47 @@
+package main
+
+// SOURCE LOGIC
+// WidgetSource supplies the widgets that producers send to consumers, so the pipeline can be fed
+// from something other than the built-in generator. Next returns an error once there are no more
+// widgets to produce. A custom source is shared by every producer, so it must be safe for
+// concurrent use.
+type WidgetSource interface {
+	Next() (widget, error)
+}
+
+// generatedSource is the default source for a single producer. It makes widgets with sequential
+// ids, marking them broken according to -k and their type, until the widget count or the duration
+// runs out.
+type generatedSource struct {
+	g              *producerGroup
+	producerNumber int
+}
+
+func (s generatedSource) Next() (widget, error) {
+	return s.g.getWidget(s.producerNumber)
+}
+
+// customSource wraps the group's WidgetSource so that pausing and stop signals still apply to it.
+type customSource struct {
+	g *producerGroup
+}
+
+func (s customSource) Next() (widget, error) {
+	if err := s.g.mayProduce(); err != nil {
+		return widget{}, err
+	}
+	w, err := s.g.source.Next()
+	if err == nil {
+		// The source picks its own ids, but advancing the counter keeps produced() accurate
+		s.g.currentID.Add(1)
+	}
+	return w, err
+}
+
+// sourceFor returns the source producer producerNumber takes widgets from.
+func (g *producerGroup) sourceFor(producerNumber int) WidgetSource {
+	if g.source == nil {
+		return generatedSource{g: g, producerNumber: producerNumber}
+	}
+	return customSource{g: g}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sliceSource hands out a fixed list of widgets.
+type sliceSource struct {
+	mutex   sync.Mutex
+	widgets []widget
+}
+
+func (s *sliceSource) Next() (widget, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.widgets) == 0 {
+		return widget{}, errors.New("no more widgets")
+	}
+	w := s.widgets[0]
+	s.widgets = s.widgets[1:]
+	return w, nil
+}
+
+func TestWidgetSource(t *testing.T) {
+	newSource := func(n, broken int) *sliceSource {
+		source := &sliceSource{}
+		for i := 1; i <= n; i++ {
+			source.widgets = append(source.widgets, widget{id: "custom-" + strconv.Itoa(i), source: "File", time: time.Now(), broken: i == broken})
+		}
+		return source
+	}
+
+	// Every widget from the source reaches the consumers
+	cfg := defaultConfig()
+	cfg.numProducers, cfg.numConsumers = 3, 2
+	cfg.source = newSource(50, -1)
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Produced != 50 || result.Consumed != 50 {
+		t.Errorf("Produced %d and consumed %d widgets from a custom source, expected 50: %v", result.Produced, result.Consumed, err)
+	}
+
+	// A broken widget from the source still stops production
+	cfg.numProducers, cfg.numConsumers = 1, 1
+	cfg.bufferSize = 0
+	source := newSource(1000, 5)
+	cfg.source = source
+	result, err = RunPipeline(cfg, nil)
+	if !errors.Is(err, ErrProductionStopped) || result.Consumed >= 1000 || len(source.widgets) == 0 {
+		t.Errorf("Broken widget from a custom source didn't stop production: %d consumed", result.Consumed)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SOURCES LOGIC
+// A widget's source normally names the producer goroutine that made it, Producer_N. With -sources
+// it's a logical source instead, picked for each widget from a fixed pool, so grouping widgets by
+// source downstream groups them by something meaningful:
+//
+//	-sources warehouse=3,factory=1,dock
+//
+// Each source is picked in proportion to its weight, 1 if not given, using the producer's seeded
+// random source so a run can be reproduced. Widgets still record which producer made them, for
+// -verify-order. Consumers then also report how many widgets from each source they consumed.
+
+// sourcePool is the sources generated widgets are given, with their weights.
+type sourcePool struct {
+	names      []string
+	cumulative []int // running total of the weights, up to and including each name's
+}
+
+// parseSources parses a list like "warehouse=3,factory=1,dock".
+func parseSources(list string) (*sourcePool, error) {
+	pool := &sourcePool{}
+	total := 0
+	for _, entry := range strings.Split(list, ",") {
+		name, weightStr, hasWeight := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, errors.New("source names can't be empty")
+		}
+		if slices.Contains(pool.names, name) {
+			return nil, errors.New("source " + name + " given more than once")
+		}
+		weight := 1
+		if hasWeight {
+			var err error
+			if weight, err = strconv.Atoi(strings.TrimSpace(weightStr)); err != nil || weight < 1 {
+				return nil, errors.New("weight of source " + name + " must be a whole number of at least 1")
+			}
+		}
+		total += weight
+		pool.names = append(pool.names, name)
+		pool.cumulative = append(pool.cumulative, total)
+	}
+	return pool, nil
+}
+
+// pick chooses a source with rng, in proportion to the weights.
+func (p *sourcePool) pick(rng *rand.Rand) string {
+	n := rng.Intn(p.cumulative[len(p.cumulative)-1])
+	return p.names[sort.SearchInts(p.cumulative, n+1)]
+}
+
+// newSourceTallies counts consumed widgets by source.
+func newSourceTallies() *typeTallies {
+	return &typeTallies{label: "Source", key: func(w widget) string { return w.source }, byType: make(map[string]*typeTally)}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestParseSources(t *testing.T) {
+	pool, err := parseSources("warehouse=3, factory=1,dock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 50000; i++ {
+		counts[pool.pick(rng)]++
+	}
+	// Weights 3:1:1 give shares of 60%, 20%, and 20%
+	for name, share := range map[string]float64{"warehouse": 0.6, "factory": 0.2, "dock": 0.2} {
+		if got := float64(counts[name]) / 50000; got < share-0.02 || got > share+0.02 {
+			t.Errorf("Source %s picked for %.3f of widgets, expected about %.1f", name, got, share)
+		}
+	}
+	if len(counts) != 3 {
+		t.Errorf("Picked sources %v", counts)
+	}
+
+	for _, list := range []string{"a,a", "a=0", "a=x", "a,,b", "a=1.5"} {
+		if _, err := parseSources(list); err == nil {
+			t.Errorf("Sources %q accepted", list)
+		}
+	}
+}
+
+func TestSources(t *testing.T) {
+	run := func() map[string]widget {
+		cfg, err := parseConfig([]string{"-n", "200", "-c", "2", "-sources", "warehouse,dock", "-seed", "7"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler := &capturingHandler{widgets: make(map[string]widget)}
+		cfg.handler, cfg.out = handler, io.Discard
+		if _, err := RunPipeline(cfg, nil); err != nil {
+			t.Fatal(err)
+		}
+		return handler.widgets
+	}
+	first, second := run(), run()
+	sources := make(map[string]int)
+	for id, w := range first {
+		sources[w.source]++
+		if w.producerID != 1 {
+			t.Errorf("Widget %s made by producer %d, expected 1", id, w.producerID)
+		}
+		if second[id].source != w.source {
+			t.Errorf("Widget %s from %s, then %s with the same seed", id, w.source, second[id].source)
+		}
+	}
+	if len(sources) != 2 || sources["warehouse"] == 0 || sources["dock"] == 0 {
+		t.Errorf("Widgets came from %v", sources)
+	}
+
+	if _, err := parseConfig([]string{"-sources", "a,b", "-replay", "widgets.jsonl"}); err == nil {
+		t.Error("-sources with -replay accepted")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// STDIN LOGIC
+// -n - takes what to produce from standard input, so a script can drive the producers. The input
+// is either a single number, the count of widgets to generate, or one JSON widget spec per line,
+// in which case exactly those widgets are produced, in order:
+//
+//	{"id": "7", "type": "gizmo", "broken": true}
+//
+// Every field of a spec is optional. A widget without an id gets its position in the input,
+// counting from -idstart.
+
+// widgetCount is the value of -n: a number of widgets, or - to read them from standard input.
+type widgetCount struct {
+	cfg *config
+}
+
+func (c widgetCount) String() string {
+	if c.cfg == nil {
+		return ""
+	}
+	if c.cfg.stdin {
+		return "-"
+	}
+	return strconv.Itoa(c.cfg.numWidgets)
+}
+
+func (c widgetCount) Set(value string) error {
+	if value == "-" {
+		c.cfg.stdin = true
+		return nil
+	}
+	n, err := strconv.ParseInt(value, 0, strconv.IntSize)
+	if err != nil {
+		return errors.New("parse error")
+	}
+	c.cfg.numWidgets, c.cfg.stdin = int(n), false
+	return nil
+}
+
+// widgetSpec describes one widget to produce, as read from standard input.
+type widgetSpec struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Broken  bool   `json:"broken"`
+	Payload []byte `json:"payload"` // base64 encoded
+}
+
+// readStdin sets cfg up to produce what in describes: a count of widgets to generate, or a spec
+// per line of the widgets to produce. Blank lines are ignored.
+func readStdin(cfg *config, in io.Reader) error {
+	var lines []string
+	var numbers []int // line number of each line kept, for errors
+	scanner := bufio.NewScanner(in)
+	for number := 1; scanner.Scan(); number++ {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+			numbers = append(numbers, number)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return errors.New("nothing on standard input, expected a widget count or widget specs")
+	}
+
+	if n, err := strconv.Atoi(lines[0]); err == nil {
+		if len(lines) > 1 {
+			return fmt.Errorf("line %d: expected only a widget count", numbers[1])
+		}
+		if n < 0 {
+			return errors.New("number of widgets can't be negative")
+		}
+		if n == 0 {
+			return errors.New("a widget count of 0 would produce nothing")
+		}
+		cfg.numWidgets = n
+		return nil
+	}
+
+	if cfg.kthBadWidget != -1 || cfg.randomBreak || cfg.breakEvery > 0 {
+		return errors.New("-k, -random-break, and -every don't apply to widget specs, which say which widgets are broken")
+	}
+	specs := make([]widgetSpec, len(lines))
+	for i, line := range lines {
+		dec := json.NewDecoder(bytes.NewReader([]byte(line)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&specs[i]); err != nil {
+			return fmt.Errorf("line %d: malformed widget spec: %w", numbers[i], err)
+		}
+		if dec.More() {
+			return fmt.Errorf("line %d: expected one widget spec per line", numbers[i])
+		}
+	}
+	idStart := cfg.idStart
+	if idStart == 0 {
+		idStart = 1
+	}
+	cfg.source = &specSource{specs: specs, idStart: idStart}
+	cfg.numWidgets = len(specs)
+	return nil
+}
+
+// specSource is a WidgetSource producing the widgets described by a list of specs, in order.
+type specSource struct {
+	mutex   sync.Mutex
+	specs   []widgetSpec
+	next    int // index of the next spec to produce
+	idStart int // id of a widget without one is its index plus idStart
+}
+
+func (s *specSource) Next() (widget, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.next == len(s.specs) {
+		return widget{}, errors.New("no more widget specs")
+	}
+	spec := s.specs[s.next]
+	id := spec.ID
+	if id == "" {
+		id = strconv.Itoa(s.idStart + s.next)
+	}
+	s.next++
+	return widget{id: id, source: "stdin", widgetType: spec.Type, time: time.Now(), broken: spec.Broken, payload: spec.Payload}, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestStdinCount(t *testing.T) {
+	cfg, err := parseConfig([]string{"-n", "-", "-p", "2"})
+	if err != nil || !cfg.stdin {
+		t.Fatalf("-n - not accepted: %v", err)
+	}
+	if err := readStdin(&cfg, strings.NewReader("\n  25 \n\n")); err != nil || cfg.numWidgets != 25 || cfg.source != nil {
+		t.Errorf("Read a count of %d: %v", cfg.numWidgets, err)
+	}
+
+	// A later -n overrides reading from stdin, as with any repeated flag
+	if cfg, err := parseConfig([]string{"-n", "-", "--num-widgets=4"}); err != nil || cfg.stdin || cfg.numWidgets != 4 {
+		t.Errorf("-n 4 after -n - gave %d widgets, stdin %t: %v", cfg.numWidgets, cfg.stdin, err)
+	}
+}
+
+func TestStdinSpecs(t *testing.T) {
+	cfg, err := parseConfig([]string{"-n", "-", "-p", "3", "-idstart", "100", "-breaker-threshold", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := `{"id": "a", "type": "gizmo"}
+{"broken": true, "payload": "AAEC"}
+
+{}
+`
+	if err := readStdin(&cfg, strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	handler := &capturingHandler{widgets: make(map[string]widget)}
+	cfg.handler = handler
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Produced != 3 || result.Consumed != 3 {
+		t.Fatalf("Produced %d and consumed %d of 3 widgets: %v", result.Produced, result.Consumed, err)
+	}
+	if w := handler.widgets["a"]; w.widgetType != "gizmo" || w.broken {
+		t.Errorf("Widget a is %v", w)
+	}
+	// Widgets without an id are numbered by their position in the input
+	if w := handler.widgets["101"]; !w.broken || string(w.payload) != "\x00\x01\x02" {
+		t.Errorf("Second widget is %v", w)
+	}
+	if _, ok := handler.widgets["102"]; !ok {
+		t.Errorf("Third widget missing from %v", handler.widgets)
+	}
+}
+
+func TestStdinErrors(t *testing.T) {
+	for input, expected := range map[string]string{
+		"":                          "nothing on standard input",
+		"\n \n":                     "nothing on standard input",
+		"5\n6\n":                    "line 2: expected only a widget count",
+		"-3":                        "can't be negative",
+		"0":                         "would produce nothing",
+		"{\"id\": \"1\"}\n{broken}": "line 2: malformed widget spec",
+		`{"colour": "red"}`:         "line 1: malformed widget spec",
+		`{"id": "1"} {"id": "2"}`:   "line 1: expected one widget spec per line",
+	} {
+		cfg := defaultConfig()
+		if err := readStdin(&cfg, strings.NewReader(input)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Reading %q: expected an error about %q, got %v", input, expected, err)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.kthBadWidget = 2
+	if err := readStdin(&cfg, strings.NewReader(`{"id": "1"}`)); err == nil {
+		t.Error("-k accepted with widget specs")
+	}
+	for _, args := range [][]string{
+		{"-n", "-", "-duration", "1s"},
+		{"-n", "-", "-perproducer", "2"},
+		{"-n", "x"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v not rejected", args)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// SWEEP LOGIC
+// -sweep is a benchmark driver for capacity planning. It runs the pipeline once for every
+// combination of producer count, consumer count, and buffer size in a grid, one run at a time with
+// the rest of the options as given, then prints each run's throughput and p99 latency as a table,
+// or as CSV with -format csv. An interrupt, or the -sweep-budget running out, stops the run in
+// progress and skips the rest; only the runs that finished are reported.
+
+// sweepGrid is the values a sweep tries for each dimension. A dimension left out of -sweep keeps
+// the value given by its own option.
+type sweepGrid struct {
+	producers []int
+	consumers []int
+	buffers   []int
+}
+
+// parseSweepGrid parses a grid like "p=1,4,16/c=1,4,16/buffer=0,1000".
+func parseSweepGrid(spec string) (*sweepGrid, error) {
+	grid := &sweepGrid{}
+	for _, dimension := range strings.Split(spec, "/") {
+		name, list, _ := strings.Cut(dimension, "=")
+		var values *[]int
+		least := 1
+		switch strings.TrimSpace(name) {
+		case "p":
+			values = &grid.producers
+		case "c":
+			values = &grid.consumers
+		case "buffer":
+			values, least = &grid.buffers, 0
+		default:
+			return nil, errors.New("unknown sweep dimension " + name + ", expected p, c, or buffer")
+		}
+		if *values != nil {
+			return nil, errors.New("sweep dimension " + name + " given more than once")
+		}
+		for _, entry := range strings.Split(list, ",") {
+			value, err := strconv.Atoi(strings.TrimSpace(entry))
+			if err != nil || value < least {
+				return nil, fmt.Errorf("invalid %s %q in sweep, expected an integer of at least %d", name, entry, least)
+			}
+			*values = append(*values, value)
+		}
+	}
+	return grid, nil
+}
+
+// sweepCell is one run of a sweep.
+type sweepCell struct {
+	producers, consumers, buffer int
+	result                       Result
+}
+
+// runSweep runs the pipeline for every combination in cfg.sweep and prints the results to
+// cfg.stdout(). The first signal received on signals ends the sweep early.
+func runSweep(cfg config, signals <-chan os.Signal) error {
+	grid := *cfg.sweep
+	if grid.producers == nil {
+		grid.producers = []int{cfg.numProducers}
+	}
+	if grid.consumers == nil {
+		grid.consumers = []int{cfg.numConsumers}
+	}
+	if grid.buffers == nil {
+		grid.buffers = []int{cfg.channelBuffer()}
+	}
+	total := len(grid.producers) * len(grid.consumers) * len(grid.buffers)
+
+	stopped := make(chan struct{})
+	stop := sync.OnceFunc(func() { close(stopped) })
+	finished := handleInterrupts(signals, cfg.forceAfter, stop, cfg.forceExit())
+	defer finished()
+	if cfg.sweepBudget > 0 {
+		budget := time.AfterFunc(cfg.sweepBudget, func() {
+			fmt.Fprintf(os.Stderr, "Sweep time budget of %s spent -- stopping\n", cfg.sweepBudget)
+			stop()
+		})
+		defer budget.Stop()
+	}
+
+	// Only the table is printed, not the widgets of each run. The sweep stays set, so the runs
+	// measure latency
+	out, format := cfg.stdout(), cfg.format
+	cfg.out, cfg.format = io.Discard, "text"
+	var cells []sweepCell
+	var err error
+sweep:
+	for _, producers := range grid.producers {
+		for _, consumers := range grid.consumers {
+			for _, buffer := range grid.buffers {
+				cell := sweepCell{producers: producers, consumers: consumers, buffer: buffer}
+				if cell.result, err = runSweepCell(cfg, cell, stopped); err != nil {
+					err = fmt.Errorf("sweep run with %d producers, %d consumers, and a buffer of %d: %w", producers, consumers, buffer, err)
+					break sweep
+				}
+				select {
+				case <-stopped:
+					// The run was cut short, so its numbers aren't comparable
+					break sweep
+				default:
+				}
+				cells = append(cells, cell)
+			}
+		}
+	}
+	if len(cells) < total {
+		fmt.Fprintf(os.Stderr, "Sweep stopped after %d of %d runs\n", len(cells), total)
+	}
+
+	if format == "csv" {
+		return errors.Join(err, writeSweepCSV(out, cells))
+	}
+	return errors.Join(err, writeSweepTable(out, cells))
+}
+
+// runSweepCell runs the pipeline for one cell of a sweep, stopping production once stopped is
+// closed. A broken widget stopping production isn't an error here; it's up to -k whether there is
+// one.
+func runSweepCell(cfg config, cell sweepCell, stopped <-chan struct{}) (Result, error) {
+	cfg.numProducers, cfg.numConsumers, cfg.bufferSize = cell.producers, cell.consumers, cell.buffer
+	p, err := NewPipeline(cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-stopped:
+			p.stop()
+		case <-done:
+		}
+	}()
+	result, err := p.Run(nil)
+	if errors.Is(err, ErrProductionStopped) {
+		err = nil
+	}
+	return result, err
+}
+
+// throughput returns the widgets consumed per second in result.
+func throughput(result Result) float64 {
+	return float64(result.Consumed) / result.Elapsed.Seconds()
+}
+
+func writeSweepTable(out io.Writer, cells []sweepCell) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "PRODUCERS\tCONSUMERS\tBUFFER\tWIDGETS\tELAPSED\tWIDGETS/SEC\tP99 LATENCY\t")
+	for _, cell := range cells {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%s\t%.1f\t%s\t\n", cell.producers, cell.consumers, cell.buffer, cell.result.Consumed,
+			cell.result.Elapsed.Round(time.Microsecond), throughput(cell.result), cell.result.Latency.P99)
+	}
+	return w.Flush()
+}
+
+var sweepCSVHeader = []string{"producers", "consumers", "buffer", "widgets", "elapsed_ns", "widgets_per_sec", "p99_latency_ns"}
+
+func writeSweepCSV(out io.Writer, cells []sweepCell) error {
+	w := csv.NewWriter(out)
+	w.Write(sweepCSVHeader)
+	for _, cell := range cells {
+		w.Write([]string{strconv.Itoa(cell.producers),
+			strconv.Itoa(cell.consumers),
+			strconv.Itoa(cell.buffer),
+			strconv.Itoa(cell.result.Consumed),
+			strconv.FormatInt(cell.result.Elapsed.Nanoseconds(), 10),
+			strconv.FormatFloat(throughput(cell.result), 'f', 1, 64),
+			strconv.FormatInt(cell.result.Latency.P99.Nanoseconds(), 10)})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSweepGrid(t *testing.T) {
+	grid, err := parseSweepGrid("p=1,4/buffer=0, 1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (sweepGrid{producers: []int{1, 4}, buffers: []int{0, 1000}}); !reflect.DeepEqual(*grid, want) {
+		t.Errorf("Parsed %+v, expected %+v", *grid, want)
+	}
+	for _, spec := range []string{"", "q=1", "p=0", "c=-1", "buffer=-1", "p=1/p=2", "c=one"} {
+		if _, err := parseSweepGrid(spec); err == nil {
+			t.Errorf("%q not rejected", spec)
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	cfg, err := parseConfig([]string{"-n", "1000", "-sweep", "p=1,2/c=1,3", "-buffer", "10", "-format", "csv"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	cfg.out = &out
+	if err := runSweep(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatalf("Sweep output is not valid CSV: %v", err)
+	}
+	if len(rows) != 5 || !reflect.DeepEqual(rows[0], sweepCSVHeader) {
+		t.Fatalf("Expected a header and 4 rows, got %v", rows)
+	}
+	for i, cell := range [][]string{{"1", "1"}, {"1", "3"}, {"2", "1"}, {"2", "3"}} {
+		row := rows[i+1]
+		if row[0] != cell[0] || row[1] != cell[1] || row[2] != "10" || row[3] != "1000" {
+			t.Errorf("Row %d is %v, expected %s producers and %s consumers with a buffer of 10 consuming 1000 widgets", i+1, row, cell[0], cell[1])
+		}
+		if rate, err := strconv.ParseFloat(row[5], 64); err != nil || rate <= 0 {
+			t.Errorf("Invalid throughput in row %v", row)
+		}
+		if p99, err := strconv.ParseInt(row[6], 10, 64); err != nil || p99 <= 0 {
+			t.Errorf("Invalid p99 latency in row %v", row)
+		}
+	}
+
+	// The budget cuts the sweep short, leaving out the run it interrupted
+	cfg, err = parseConfig([]string{"-duration", "1h", "-sweep", "p=1,2", "-sweep-budget", "50ms"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	cfg.out = &out
+	start := time.Now()
+	if err := runSweep(cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Sweep took %s with a 50ms budget", elapsed)
+	}
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 1 || !strings.Contains(lines[0], "WIDGETS/SEC") {
+		t.Errorf("Expected just the table header, got %q", out.String())
+	}
+
+	for _, args := range [][]string{
+		{"-sweep", "p=1", "-report", "report.json"},
+		{"-sweep", "p=1", "-format", "protobuf"},
+		{"-sweep-budget", "1s"},
+	} {
+		if _, err := parseConfig(args); err == nil {
+			t.Errorf("%v not rejected", args)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// TCP LOGIC
+// forwardDialTimeout bounds how long connecting to the -forward endpoint may take.
+const forwardDialTimeout = 5 * time.Second
+
+// forwardHandler is a WidgetHandler that sends each consumed widget to a remote endpoint as a
+// length-prefixed JSON frame (the binary codec), making this process the sending half of a
+// distributed pipeline.
+type forwardHandler struct {
+	mutex sync.Mutex // exclusion on writes from concurrent consumers
+	conn  net.Conn
+	enc   widgetEncoder
+}
+
+// dialForward connects to addr, so an unreachable endpoint fails the run before anything is produced.
+func dialForward(addr string) (*forwardHandler, error) {
+	conn, err := net.DialTimeout("tcp", addr, forwardDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("can't forward widgets: %w", err)
+	}
+	enc, err := newWidgetEncoder(codecBinary, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &forwardHandler{conn: conn, enc: enc}, nil
+}
+
+func (f *forwardHandler) Handle(w widget) error {
+	if w.broken && !w.deadLettered {
+		fmt.Fprintf(os.Stderr, "Forwarding broken widget %s -- stopping production\n", w.id)
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.enc.Encode(w); err != nil {
+		// Without the connection there's nowhere for widgets to go
+		return &FatalError{Err: fmt.Errorf("forwarding to %s: %w", f.conn.RemoteAddr(), err)}
+	}
+	return nil
+}
+
+// Close closes the connection once all consumers have returned, so the receiver sees the end of
+// the stream.
+func (f *forwardHandler) Close() error {
+	return f.conn.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestForward(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The remote end collects every widget until the connection closes
+	received := make(chan []widget)
+	go func() {
+		var widgets []widget
+		defer func() { received <- widgets }()
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec, _ := newWidgetDecoder(codecBinary, conn)
+		for {
+			w, err := dec.Decode()
+			if err != nil {
+				return
+			}
+			widgets = append(widgets, w)
+		}
+	}()
+
+	cfg := defaultConfig()
+	cfg.numWidgets, cfg.numProducers, cfg.numConsumers = 50, 2, 3
+	cfg.forward = ln.Addr().String()
+	cfg.out = io.Discard
+	result, err := RunPipeline(cfg, nil)
+	if err != nil || result.Consumed != 50 {
+		t.Fatalf("Consumed %d widgets, expected 50: %v", result.Consumed, err)
+	}
+	if widgets := <-received; len(widgets) != 50 {
+		t.Errorf("Forwarded %d widgets, expected 50", len(widgets))
+	}
+
+	// An unreachable endpoint fails before anything is produced
+	ln.Close()
+	result, err = RunPipeline(cfg, nil)
+	if err == nil || result.Produced != 0 {
+		t.Errorf("Unreachable endpoint not reported up front: %+v, %v", result, err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	cfg, err := parseConfig([]string{"-listen", "127.0.0.1:0"})
+	if err != nil || cfg.mode != "consume" {
+		t.Fatalf("-listen doesn't imply consume mode: %q, %v", cfg.mode, err)
+	}
+	if _, err := parseConfig([]string{"-listen", ":9000", "-mode", "produce", "-unix-socket", "x"}); err == nil {
+		t.Errorf("-listen with -mode produce not rejected")
+	}
+
+	// Find a free port for the consumer side to listen on
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.listen = probe.Addr().String()
+	probe.Close()
+
+	handler := &capturingHandler{widgets: make(map[string]widget)}
+	cfg.handler = handler
+	cfg.numConsumers = 2
+	done := make(chan error)
+	go func() { _, err := consumeFromSocket(cfg, nil); done <- err }()
+
+	// Play the part of a remote -forward, retrying until the consumer side is listening
+	var conn net.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if conn, err = net.Dial("tcp", cfg.listen); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Consumer side never listened: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	enc, _ := newWidgetEncoder(codecBinary, conn)
+	for i := 1; i <= 20; i++ {
+		if err := enc.Encode(widget{id: strconv.Itoa(i), source: "Producer_1", producerID: 1, time: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	// Closing the connection shuts the consumer side down
+	select {
+	case err := <-done:
+		if err != nil || len(handler.widgets) != 20 {
+			t.Errorf("Received %d widgets, expected 20: %v", len(handler.widgets), err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Consumer side didn't shut down when the connection closed")
+	}
+}
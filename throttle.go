@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// THROTTLE LOGIC
+// With -target-latency, consumers pause for a think time before handling each widget, and a
+// controller adjusts that think time to keep end-to-end latency near the target. It demonstrates
+// backpressure: slower consumers let a backlog build in the channel, and the backlog is what makes
+// latency grow.
+//
+// The control loop is additive increase, multiplicative decrease, as in TCP congestion control.
+// Every consumed widget's latency feeds an exponentially weighted moving average, and every
+// throttleAdjustEvery widgets the think time is adjusted:
+//
+//   - Above the target, the think time is cut by a quarter, so consumers catch up on the backlog.
+//   - Below throttleLowWater of the target, it grows by throttleStep of the target, so consumers
+//     slow down gradually until the backlog brings latency up to the target.
+//   - In between, it's left alone.
+//
+// The think time never exceeds the target, since a single pause that long would miss it anyway.
+// Latency settles into a sawtooth around the target, as long as producers are slow enough that
+// consumers can meet it at all.
+
+const (
+	throttleSmoothing   = 0.1  // weight of each new latency in the moving average
+	throttleAdjustEvery = 10   // widgets consumed between adjustments
+	throttleLowWater    = 0.9  // fraction of the target below which consumers slow down
+	throttleStep        = 0.01 // fraction of the target added to the think time when slowing down
+)
+
+// throttle is the controller shared by a consumer group's consumers.
+type throttle struct {
+	target    time.Duration
+	thinkTime atomic.Int64 // current think time in nanoseconds, read by consumers without locking
+	mutex     sync.Mutex   // exclusion on the fields below
+	average   float64      // moving average of latency in nanoseconds
+	observed  int          // widgets observed
+}
+
+func newThrottle(target time.Duration) *throttle {
+	return &throttle{target: target}
+}
+
+// delay returns how long a consumer should think before handling its next widget.
+func (t *throttle) delay() time.Duration {
+	return time.Duration(t.thinkTime.Load())
+}
+
+// observe feeds the latency of a consumed widget to the controller.
+func (t *throttle) observe(latency time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.observed == 0 {
+		t.average = float64(latency)
+	} else {
+		t.average += throttleSmoothing * (float64(latency) - t.average)
+	}
+	t.observed++
+	if t.observed%throttleAdjustEvery != 0 {
+		return
+	}
+
+	thinkTime := time.Duration(t.thinkTime.Load())
+	switch {
+	case t.average > float64(t.target):
+		thinkTime = thinkTime * 3 / 4
+	case t.average < throttleLowWater*float64(t.target):
+		thinkTime += time.Duration(throttleStep * float64(t.target))
+		if thinkTime > t.target {
+			thinkTime = thinkTime * 3 / 4
+		}
+	}
+	t.thinkTime.Store(int64(thinkTime))
+}
+
+// latency returns the moving average of latency.
+func (t *throttle) latency() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return time.Duration(t.average)
+}
+
+// reportThrottle reports where the controller left the consumers' think time.
+func reportThrottle(out io.Writer, t *throttle) {
+	if t == nil {
+		return
+	}
+	fmt.Fprintf(out, "Consumer think time ended at %s, with latency averaging %s for a %s target\n",
+		t.delay().Round(time.Microsecond), t.latency().Round(time.Microsecond), t.target)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottleConverges(t *testing.T) {
+	// Simulate a consumer taking widgets that arrive every millisecond, in order, spending the
+	// throttle's think time on each, so latency is how long a widget waited plus that think time
+	const target, interval = 20 * time.Millisecond, time.Millisecond
+	th := newThrottle(target)
+	var arrived, free, total time.Duration
+	const widgets, settled = 40000, 30000
+	for i := 0; i < widgets; i++ {
+		arrived += interval
+		if free < arrived {
+			free = arrived
+		}
+		free += th.delay()
+		latency := free - arrived
+		th.observe(latency)
+		if i >= settled {
+			total += latency
+		}
+		if th.delay() > target {
+			t.Fatalf("think time %s exceeds the %s target", th.delay(), target)
+		}
+	}
+
+	if average := total / (widgets - settled); average < target/2 || average > target*3/2 {
+		t.Errorf("latency averaged %s once settled, expected near the %s target", average, target)
+	}
+	if th.delay() == 0 {
+		t.Error("consumers never slowed down")
+	}
+}
+
+func TestThrottleSpeedsUp(t *testing.T) {
+	th := newThrottle(10 * time.Millisecond)
+	for i := 0; i < 1000; i++ {
+		th.observe(0)
+	}
+	slow := th.delay()
+	for i := 0; i < 100; i++ {
+		th.observe(time.Second)
+	}
+	if th.delay() >= slow {
+		t.Errorf("think time went from %s to %s with latency far over the target", slow, th.delay())
+	}
+}
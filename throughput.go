@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// THROUGHPUT LOGIC
+// With -report-interval, a reporter logs how many widgets have been consumed so far every interval,
+// along with the rate since the previous line, for live feedback on a long run. With -window, each
+// line also gives how many of the most recent widgets were broken.
+
+// startThroughputReporter logs consumed()'s running total to out every interval until the returned
+// function is called, which waits for the reporter to exit so no line follows it. A zero interval
+// reports nothing. window is nil unless recent broken widgets are being tracked.
+func startThroughputReporter(out io.Writer, interval time.Duration, consumed func() int, window *brokenWindow) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last, lastAt := consumed(), time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				total := consumed()
+				rate := float64(total-last) / now.Sub(lastAt).Seconds()
+				if window != nil {
+					fmt.Fprintf(out, "Consumed %d widgets so far (%.1f/s), %s\n", total, rate, window.status())
+				} else {
+					fmt.Fprintf(out, "Consumed %d widgets so far (%.1f/s)\n", total, rate)
+				}
+				last, lastAt = total, now
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-exited
+	}
+}
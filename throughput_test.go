@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestThroughputReporter(t *testing.T) {
+	var consumed atomic.Int64
+	var out bytes.Buffer
+	stop := startThroughputReporter(&out, 10*time.Millisecond, func() int {
+		return int(consumed.Add(5))
+	}, nil)
+	time.Sleep(55 * time.Millisecond)
+	stop()
+
+	// Nothing may be written once stop returns, so out can be read safely
+	lines := regexp.MustCompile(`(?m)^Consumed (\d+) widgets so far \([0-9.]+/s\)$`).FindAllStringSubmatch(out.String(), -1)
+	if len(lines) < 2 {
+		t.Fatalf("expected several progress lines, got %q", out.String())
+	}
+	previous := 0
+	for _, line := range lines {
+		total := mustAtoi(t, line[1])
+		if total <= previous {
+			t.Errorf("running total went from %d to %d", previous, total)
+		}
+		previous = total
+	}
+}
+
+func TestThroughputReporterDisabled(t *testing.T) {
+	var out bytes.Buffer
+	stop := startThroughputReporter(&out, 0, func() int { return 0 }, nil)
+	stop()
+	if out.Len() != 0 {
+		t.Errorf("reported %q with no interval", out.String())
+	}
+	if _, err := parseConfig([]string{"-report-interval", "-1s"}); err == nil {
+		t.Error("accepted a negative report interval")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WIDGET TYPE LOGIC
+// widgetType is a kind of product with its own defect rate.
+type widgetType struct {
+	name       string
+	brokenRate float64 // probability in [0,1] that a widget of this type comes out broken
+}
+
+// Ways of assigning a type to each new widget
+const (
+	assignRoundRobin = "roundrobin" // cycle through the types in the order widgets are made
+	assignRandom     = "random"     // pick a type uniformly with the producer's random source
+)
+
+// parseTypes parses a list like "gizmo=0.01,gadget=0.05". A type given without a rate never breaks.
+func parseTypes(list string) ([]widgetType, error) {
+	var types []widgetType
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(list, ",") {
+		name, rateStr, hasRate := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, errors.New("widget type names can't be empty")
+		}
+		if seen[name] {
+			return nil, errors.New("widget type " + name + " given more than once")
+		}
+		seen[name] = true
+
+		rate := 0.0
+		if hasRate {
+			var err error
+			if rate, err = strconv.ParseFloat(strings.TrimSpace(rateStr), 64); err != nil {
+				return nil, errors.New("can't convert broken rate for widget type " + name)
+			}
+		}
+		if !(rate >= 0 && rate <= 1) {
+			return nil, fmt.Errorf("broken rate %v for widget type %s is not in [0,1]", rate, name)
+		}
+		types = append(types, widgetType{name: name, brokenRate: rate})
+	}
+	return types, nil
+}
+
+// assignType picks the type of the nth widget made, counting from 1.
+func (g *producerGroup) assignType(n, producerNumber int) widgetType {
+	if g.typeAssignment == assignRandom {
+		return g.types[g.rand(producerNumber).Intn(len(g.types))]
+	}
+	return g.types[(n-1)%len(g.types)]
+}
+
+// typeTally counts the widgets of one type, or one source, that reached consumers.
+type typeTally struct {
+	consumed int
+	broken   int
+}
+
+// typeTallies counts consumed widgets by type, or by whatever else key picks out of a widget. It
+// is shared by all consumers. Widgets without a key aren't counted, so untyped widgets aren't.
+type typeTallies struct {
+	mutex  sync.Mutex
+	label  string                // what the key is, starting each line of the report
+	key    func(w widget) string // what widgets are counted by
+	byType map[string]*typeTally
+}
+
+func newTypeTallies() *typeTallies {
+	return &typeTallies{label: "Type", key: func(w widget) string { return w.widgetType }, byType: make(map[string]*typeTally)}
+}
+
+func (t *typeTallies) add(w widget) {
+	key := t.key(w)
+	if key == "" {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tally, ok := t.byType[key]
+	if !ok {
+		tally = &typeTally{}
+		t.byType[key] = tally
+	}
+	tally.consumed++
+	if w.broken {
+		tally.broken++
+	}
+}
+
+// report writes one line per type, or other key, in name order.
+func (t *typeTallies) report(out io.Writer) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	names := make([]string, 0, len(t.byType))
+	for name := range t.byType {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "%s %s: %d consumed, %d broken\n", t.label, name, t.byType[name].consumed, t.byType[name].broken)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestParseTypes(t *testing.T) {
+	types, err := parseTypes("gizmo=0.25,gadget,doohickey=1")
+	if err != nil || len(types) != 3 {
+		t.Fatalf("Valid types not parsed: %v, %v", types, err)
+	}
+	if types[0] != (widgetType{"gizmo", 0.25}) || types[1] != (widgetType{"gadget", 0}) || types[2] != (widgetType{"doohickey", 1}) {
+		t.Errorf("Types parsed incorrectly: %v", types)
+	}
+
+	for _, list := range []string{"gizmo=1.5", "gizmo=-0.1", "gizmo=NaN", "gizmo=lots", "gizmo,gizmo", "=0.5", ""} {
+		if _, err := parseTypes(list); err == nil {
+			t.Errorf("Invalid types %q not rejected", list)
+		}
+	}
+}
+
+func TestWidgetTypes(t *testing.T) {
+	widgetChan := make(chan widget)
+	var wg sync.WaitGroup
+	shouldStop := false
+	shouldStopMutex := sync.Mutex{}
+	types := []widgetType{{"gizmo", 0}, {"gadget", 1}}
+
+	// Round robin cycles by id, and each type's rate decides brokenness
+	cfg := config{numProducers: 1, numWidgets: 6, kthBadWidget: -1, types: types, typeAssignment: assignRoundRobin}
+	producerGroup := newProducerGroup(cfg, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	for i := 1; i <= 6; i++ {
+		w, _ := producerGroup.getWidget(1)
+		expected := types[(i-1)%2]
+		if w.widgetType != expected.name || w.broken != (expected.name == "gadget") {
+			t.Errorf("Widget %d has type %s and broken=%t", i, w.widgetType, w.broken)
+		}
+	}
+
+	// Random assignment is reproducible from the seed
+	cfg.typeAssignment = assignRandom
+	cfg.seed = 11
+	group1 := newProducerGroup(cfg, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	group2 := newProducerGroup(cfg, widgetChan, &shouldStop, &wg, &shouldStopMutex)
+	for i := 1; i <= 6; i++ {
+		w1, _ := group1.getWidget(1)
+		w2, _ := group2.getWidget(1)
+		if w1.widgetType != w2.widgetType {
+			t.Errorf("Random type assignment not reproducible from seed")
+		}
+	}
+}
+
+func TestTypeTallies(t *testing.T) {
+	tallies := newTypeTallies()
+	for i := 1; i <= 5; i++ {
+		tallies.add(widget{id: strconv.Itoa(i), widgetType: "gizmo", broken: i == 5})
+	}
+	tallies.add(widget{id: "6", widgetType: "gadget"})
+	tallies.add(widget{id: "7"})
+
+	var out bytes.Buffer
+	tallies.report(&out)
+	expected := "Type gadget: 1 consumed, 0 broken\nType gizmo: 5 consumed, 1 broken\n"
+	if out.String() != expected {
+		t.Errorf("Type report is %q, expected %q", out.String(), expected)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// VERSION LOGIC
+// Release builds set version and commit with the linker, e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD)"
+//
+// Otherwise they're filled in from the build info Go embeds in the binary, where available.
+var (
+	version = ""
+	commit  = ""
+)
+
+// buildVersion returns the version and commit of this build, "unknown" for whichever can't be told.
+func buildVersion() (string, string) {
+	v, c := version, commit
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			if c == "" && setting.Key == "vcs.revision" {
+				c = setting.Value
+			}
+		}
+	}
+	if v == "" {
+		v = "unknown"
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	return v, c
+}
+
+// printVersion prints the version, commit, and Go version of this build.
+func printVersion(out io.Writer) {
+	v, c := buildVersion()
+	fmt.Fprintf(out, "Version: %s\nCommit:  %s\nGo:      %s\n", v, c, runtime.Version())
+}
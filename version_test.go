@@ -0,0 +1,29 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	if cfg, err := parseConfig([]string{"-version"}); err != nil || !cfg.showVersion {
+		t.Errorf("-version not parsed: %v", err)
+	}
+
+	var out bytes.Buffer
+	printVersion(&out)
+	if !strings.Contains(out.String(), "Go:      "+runtime.Version()) {
+		t.Errorf("Go version missing from %q", out.String())
+	}
+
+	// Values set with -ldflags take precedence
+	defer func(v, c string) { version, commit = v, c }(version, commit)
+	version, commit = "v1.2.3", "abc123"
+	out.Reset()
+	printVersion(&out)
+	if !strings.Contains(out.String(), "Version: v1.2.3\n") || !strings.Contains(out.String(), "Commit:  abc123\n") {
+		t.Errorf("Linker-set version ignored: %q", out.String())
+	}
+}
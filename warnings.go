@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// WARNINGS LOGIC
+// A check that finds a likely misconfiguration, rather than one that can't work at all, warns
+// instead of failing, since the user may mean it. The warnings are gathered in a warningCollector
+// and printed before the run starts. Under -strict they're errors instead, so a CI run with any
+// misconfiguration fails loudly before anything is produced.
+
+// warningCollector gathers the warnings about a configuration.
+type warningCollector struct {
+	strict   bool // whether the warnings are errors
+	warnings []string
+}
+
+// warnf adds a warning, formatted as fmt.Sprintf does.
+func (c *warningCollector) warnf(format string, args ...any) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, args...))
+}
+
+// result returns the warnings gathered, to be printed, or under -strict an error giving all of them.
+func (c *warningCollector) result() ([]string, error) {
+	if c.strict && len(c.warnings) > 0 {
+		return nil, errors.New(strings.Join(c.warnings, "; ") + " (an error under -strict)")
+	}
+	return c.warnings, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarningCollector(t *testing.T) {
+	lenient := warningCollector{}
+	lenient.warnf("-k %d is too large", 500)
+	warnings, err := lenient.result()
+	if err != nil || len(warnings) != 1 || warnings[0] != "-k 500 is too large" {
+		t.Errorf("gave warnings %q and error %v, expected only the warning", warnings, err)
+	}
+
+	strict := warningCollector{strict: true}
+	if warnings, err := strict.result(); err != nil || len(warnings) != 0 {
+		t.Errorf("-strict with no warnings gave warnings %q and error %v, expected neither", warnings, err)
+	}
+	strict.warnf("-k %d is too large", 500)
+	warnings, err = strict.result()
+	if err == nil || warnings != nil || !strings.Contains(err.Error(), "-k 500 is too large") {
+		t.Errorf("-strict gave warnings %q and error %v, expected only an error giving the warning", warnings, err)
+	}
+}
+
+func TestStrictMaxRuntimeWarning(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.mode = "run"
+	cfg.duration = time.Second
+	cfg.maxRuntime = time.Second
+	if warnings, err := validateRunnable(cfg); err != nil || len(warnings) != 1 {
+		t.Fatalf("gave warnings %q and error %v, expected one warning", warnings, err)
+	}
+
+	cfg.strict = true
+	warnings, err := validateRunnable(cfg)
+	if err == nil || warnings != nil || !strings.Contains(err.Error(), "-maxruntime") {
+		t.Errorf("-strict gave warnings %q and error %v, expected only an error about -maxruntime", warnings, err)
+	}
+}
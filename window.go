@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SLIDING WINDOW LOGIC
+// With -window, consumers keep track of how many of the most recently consumed widgets were broken,
+// so the defect rate can be watched as it settles during a run, e.g. with -types broken rates. The
+// ratio is logged alongside -report-interval's throughput, and returned by the admin /status.
+
+// brokenWindow is a ring buffer of whether each of the last size widgets consumed was broken.
+type brokenWindow struct {
+	mutex  sync.Mutex
+	broken []bool // ring buffer, oldest widget at next once full
+	next   int    // where the next widget goes
+	filled int    // widgets in the buffer, up to its size
+	count  int    // broken widgets in the buffer
+}
+
+func newBrokenWindow(size int) *brokenWindow {
+	return &brokenWindow{broken: make([]bool, size)}
+}
+
+// add records a consumed widget, pushing the oldest out of the window once it's full.
+func (b *brokenWindow) add(broken bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.filled == len(b.broken) {
+		if b.broken[b.next] {
+			b.count--
+		}
+	} else {
+		b.filled++
+	}
+	b.broken[b.next] = broken
+	if broken {
+		b.count++
+	}
+	b.next = (b.next + 1) % len(b.broken)
+}
+
+// windowStatus describes the widgets in a window.
+type windowStatus struct {
+	Size    int     `json:"size"`    // widgets the window holds once full
+	Widgets int     `json:"widgets"` // widgets in the window so far
+	Broken  int     `json:"broken"`  // broken widgets among them
+	Ratio   float64 `json:"ratio"`   // Broken / Widgets, 0 while the window is empty
+}
+
+// status returns a snapshot of the window.
+func (b *brokenWindow) status() windowStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	s := windowStatus{Size: len(b.broken), Widgets: b.filled, Broken: b.count}
+	if b.filled > 0 {
+		s.Ratio = float64(b.count) / float64(b.filled)
+	}
+	return s
+}
+
+func (s windowStatus) String() string {
+	return fmt.Sprintf("%d of the last %d broken (%.1f%%)", s.Broken, s.Widgets, 100*s.Ratio)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBrokenWindow(t *testing.T) {
+	window := newBrokenWindow(4)
+	if s := window.status(); s.Widgets != 0 || s.Ratio != 0 {
+		t.Errorf("Empty window reported %+v", s)
+	}
+	for i, expected := range []windowStatus{
+		{Size: 4, Widgets: 1, Broken: 1, Ratio: 1},
+		{Size: 4, Widgets: 2, Broken: 1, Ratio: 0.5},
+		{Size: 4, Widgets: 3, Broken: 1, Ratio: 1.0 / 3},
+		{Size: 4, Widgets: 4, Broken: 2, Ratio: 0.5},
+		// The first widget, which was broken, has now left the window
+		{Size: 4, Widgets: 4, Broken: 1, Ratio: 0.25},
+		{Size: 4, Widgets: 4, Broken: 1, Ratio: 0.25},
+	} {
+		window.add(i == 0 || i == 3)
+		if s := window.status(); s != expected {
+			t.Errorf("After %d widgets the window was %+v, expected %+v", i+1, s, expected)
+		}
+	}
+	if _, err := parseConfig([]string{"-window", "-5"}); err == nil {
+		t.Errorf("Negative window accepted")
+	}
+}
+
+func TestWindowReporting(t *testing.T) {
+	cfg, err := parseConfig([]string{"-n", "100", "-every", "4", "-breaker-threshold", "100", "-window", "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.out = io.Discard
+	p, err := NewPipeline(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Run(nil); err != nil {
+		t.Fatal(err)
+	}
+	window := p.consumers[0].window
+	if s := window.status(); s.Widgets != 10 {
+		t.Errorf("Window holds %d widgets, expected 10", s.Widgets)
+	}
+
+	var out bytes.Buffer
+	stop := startThroughputReporter(&out, 5*time.Millisecond, func() int { return 100 }, window)
+	time.Sleep(20 * time.Millisecond)
+	stop()
+	if !strings.Contains(out.String(), window.status().String()) {
+		t.Errorf("Progress lines don't give the broken ratio: %q", out.String())
+	}
+
+	var wg sync.WaitGroup
+	shouldStop := false
+	producerGroup := newProducerGroup(config{numProducers: 1, numWidgets: 10, kthBadWidget: -1}, nil, &shouldStop, &wg, &sync.Mutex{})
+	recorder := httptest.NewRecorder()
+	newAdminHandler(&producerGroup, window, "").ServeHTTP(recorder, httptest.NewRequest("GET", "/status", nil))
+	var status adminStatus
+	if err := json.NewDecoder(recorder.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Window == nil || *status.Window != window.status() {
+		t.Errorf("/status gave window %+v, expected %+v", status.Window, window.status())
+	}
+}